@@ -10,7 +10,7 @@ require (
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/jmoiron/sqlx v1.2.1-0.20190426154859-38398a30ed85
 	github.com/lib/pq v1.2.0 // indirect
-	github.com/mattn/go-sqlite3 v1.11.0 // indirect
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/orcaman/concurrent-map v0.0.0-20190314100340-2693aad1ed75
 //https://github.com/bbqbyte/govalidator
 )
@@ -1,11 +1,113 @@
 package log4go
 
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// 由loggerManager的输出goroutine调用；StartLogger前可能由多个goroutine同时调用
 type IAppender interface {
-	Write()
-	Close()
+	Name() string
+	Append(entry *Entry) error
+	Flush() error
+	Close() error
 }
 
 type Appender struct {
-	Name string
-	Layout Layout
+	Name      string
+	Layout    Layout
+	Threshold Level // 低于该级别的日志不输出
+}
+
+// 低于Threshold时返回nil
+func (a *Appender) format(entry *Entry) ([]byte, error) {
+	if entry.Level < Level(atomic.LoadUint32((*uint32)(&a.Threshold))) {
+		return nil, nil
+	}
+	layout := a.Layout
+	if layout == nil {
+		layout = defaultLayout
+	}
+	return layout.Format(entry)
+}
+
+func (a *Appender) SetThreshold(level Level) {
+	atomic.StoreUint32((*uint32)(&a.Threshold), uint32(level))
+}
+
+// WriterAppender 输出到io.Writer
+type WriterAppender struct {
+	Appender
+
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterAppender(name string, layout Layout, writer io.Writer) *WriterAppender {
+	return &WriterAppender{
+		Appender: Appender{Name: name, Layout: layout},
+		writer:   writer,
+	}
+}
+
+func (wa *WriterAppender) Name() string {
+	return wa.Appender.Name
+}
+
+func (wa *WriterAppender) Append(entry *Entry) error {
+	serialized, err := wa.format(entry)
+	if err != nil || serialized == nil {
+		return err
+	}
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	_, err = wa.writer.Write(serialized)
+	return err
+}
+
+func (wa *WriterAppender) Flush() error {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	if f, ok := wa.writer.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	if f, ok := wa.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// 不关闭writer，由创建者负责
+func (wa *WriterAppender) Close() error {
+	return wa.Flush()
+}
+
+// ConsoleAppender 输出到标准输出
+type ConsoleAppender struct {
+	WriterAppender
+}
+
+func NewConsoleAppender(name string, layout Layout) *ConsoleAppender {
+	ca := &ConsoleAppender{}
+	ca.Appender = Appender{Name: name, Layout: layout}
+	ca.writer = os.Stdout
+	return ca
+}
+
+// 输出到标准错误
+func NewStderrAppender(name string, layout Layout) *ConsoleAppender {
+	ca := NewConsoleAppender(name, layout)
+	ca.writer = os.Stderr
+	return ca
+}
+
+func (ca *ConsoleAppender) Flush() error {
+	// 终端不支持Sync
+	return nil
+}
+
+func (ca *ConsoleAppender) Close() error {
+	return nil
 }
@@ -0,0 +1,168 @@
+package log4go
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFileSize = 100 << 20
+	defaultBufferSize  = 32 << 10
+
+	backupTimeFormat = "20060102150405.000"
+)
+
+// RollingFileAppender 写入文件，超过MaxSize或跨天时滚动
+// 滚动后的文件名为 name.20060102150405.000.ext，保留最近MaxBackups个
+type RollingFileAppender struct {
+	Appender
+
+	Filename   string
+	MaxSize    int64 // 字节，<=0不按大小滚动
+	MaxBackups int   // <=0全部保留
+	Daily      bool
+	Perm       os.FileMode
+
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	openDay int
+}
+
+func NewRollingFileAppender(name string, layout Layout, filename string) *RollingFileAppender {
+	return &RollingFileAppender{
+		Appender:   Appender{Name: name, Layout: layout},
+		Filename:   filename,
+		MaxSize:    defaultMaxFileSize,
+		MaxBackups: 7,
+		Daily:      true,
+		Perm:       0660,
+	}
+}
+
+func (fa *RollingFileAppender) Name() string {
+	return fa.Appender.Name
+}
+
+func (fa *RollingFileAppender) Append(entry *Entry) error {
+	serialized, err := fa.format(entry)
+	if err != nil || serialized == nil {
+		return err
+	}
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	if fa.file == nil {
+		if err := fa.open(); err != nil {
+			return err
+		}
+	}
+	if fa.needRotate(int64(len(serialized)), entry.Time) {
+		if err := fa.rotate(entry.Time); err != nil {
+			return err
+		}
+	}
+	n, err := fa.writer.Write(serialized)
+	fa.size += int64(n)
+	return err
+}
+
+func (fa *RollingFileAppender) Flush() error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	if fa.writer == nil {
+		return nil
+	}
+	return fa.writer.Flush()
+}
+
+func (fa *RollingFileAppender) Close() error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.close()
+}
+
+func (fa *RollingFileAppender) open() error {
+	if dir := filepath.Dir(fa.Filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(fa.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fa.Perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fa.file = file
+	fa.writer = bufio.NewWriterSize(file, defaultBufferSize)
+	fa.size = info.Size()
+	fa.openDay = time.Now().YearDay()
+	return nil
+}
+
+func (fa *RollingFileAppender) close() error {
+	if fa.file == nil {
+		return nil
+	}
+	err := fa.writer.Flush()
+	if e := fa.file.Close(); err == nil {
+		err = e
+	}
+	fa.file = nil
+	fa.writer = nil
+	return err
+}
+
+func (fa *RollingFileAppender) needRotate(n int64, when time.Time) bool {
+	return (fa.MaxSize > 0 && fa.size > 0 && fa.size+n > fa.MaxSize) ||
+		(fa.Daily && when.YearDay() != fa.openDay)
+}
+
+func (fa *RollingFileAppender) rotate(when time.Time) error {
+	if err := fa.close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(fa.Filename)
+	prefix := strings.TrimSuffix(fa.Filename, ext) + "." + when.Format(backupTimeFormat)
+	backup := prefix + ext
+	for i := 1; fileExists(backup); i++ {
+		backup = fmt.Sprintf("%s.%d%s", prefix, i, ext)
+	}
+	if err := os.Rename(fa.Filename, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate %s: %v", fa.Filename, err)
+	}
+	fa.removeBackups()
+	return fa.open()
+}
+
+// 备份文件名中的时间可按字典序排序
+func (fa *RollingFileAppender) removeBackups() {
+	if fa.MaxBackups <= 0 {
+		return
+	}
+	ext := filepath.Ext(fa.Filename)
+	backups, err := filepath.Glob(strings.TrimSuffix(fa.Filename, ext) + ".*" + ext)
+	if err != nil {
+		return
+	}
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-fa.MaxBackups; i++ {
+		os.Remove(backups[i])
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,115 @@
+package log4go
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+// PBLogAppender 将log4go日志转发到pb/log，由pbcomponents/log的writer统一输出
+// 每个log4go logger对应一个名为Prefix+logger名的pb/log Logger
+type PBLogAppender struct {
+	Appender
+
+	Prefix string
+
+	mu      sync.RWMutex
+	loggers map[string]*log.Logger
+}
+
+func NewPBLogAppender(name string) *PBLogAppender {
+	return &PBLogAppender{
+		Appender: Appender{Name: name},
+		Prefix:   "[LOG4GO]",
+		loggers:  make(map[string]*log.Logger),
+	}
+}
+
+func (pa *PBLogAppender) Name() string {
+	return pa.Appender.Name
+}
+
+func (pa *PBLogAppender) logger(name string) *log.Logger {
+	pa.mu.RLock()
+	l, ok := pa.loggers[name]
+	pa.mu.RUnlock()
+	if ok {
+		return l
+	}
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if l, ok = pa.loggers[name]; !ok {
+		l = log.New(pa.Prefix + name)
+		pa.loggers[name] = l
+	}
+	return l
+}
+
+// Fatal/Panic只记录，退出或panic由log4go调用方处理
+func (pa *PBLogAppender) Append(entry *Entry) error {
+	if entry.Level < Level(atomic.LoadUint32((*uint32)(&pa.Threshold))) {
+		return nil
+	}
+
+	name := ""
+	if entry.Logger != nil {
+		name = entry.Logger.Name
+	}
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]log.Field, 0, len(keys)+3)
+	for _, k := range keys {
+		if err, ok := entry.Data[k].(error); ok {
+			fields = append(fields, log.String(k, err.Error()))
+			continue
+		}
+		fields = append(fields, log.Object(k, entry.Data[k]))
+	}
+	if entry.err != "" {
+		fields = append(fields, log.String("log4go_error", entry.err))
+	}
+	// 在输出goroutine中转发，调用栈与日志来源无关，调用位置只取自log4go记录的Caller
+	fields = append(fields, log.CallerSkip(-1))
+	if entry.Caller != nil {
+		fields = append(fields, log.String("caller", fmt.Sprintf("%s:%d", filepath.Base(entry.Caller.File), entry.Caller.Line)))
+	}
+
+	pa.logger(name).Log(toPBLevel(entry.Level), entry.Message, fields...)
+	return nil
+}
+
+// pb/log异步输出，由pbcomponents/log负责刷新
+func (pa *PBLogAppender) Flush() error {
+	return nil
+}
+
+func (pa *PBLogAppender) Close() error {
+	return nil
+}
+
+func toPBLevel(level Level) log.Level {
+	switch level {
+	case LevelTrace, LevelDebug:
+		return log.LevelDebug
+	case LevelInfo:
+		return log.LevelInfo
+	case LevelWarn:
+		return log.LevelWarn
+	case LevelError:
+		return log.LevelError
+	case LevelFatal:
+		return log.LevelFatal
+	case LevelPanic:
+		return log.LevelPanic
+	}
+	return log.LevelOff
+}
@@ -0,0 +1,38 @@
+package log4go
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+	pblog "keywea.com/cloud/pblib/pbcomponents/log"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+// log4go日志经PBLogAppender到达pbcomponents/log配置的writer
+func TestPBLogAppender(t *testing.T) {
+	defer useNewManager()()
+
+	configor, err := pbconfig.NewConfigData("json", []byte(`{"adapter": "memory", "default": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writer名称全局唯一，重复运行时使用新名称
+	writer, err := pblog.NewLogWriter("log4go.bridge."+strconv.FormatInt(time.Now().UnixNano(), 10), configor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Destroy()
+
+	logger := GetLogger("test.bridge", WithoutAddtivity()).(*Logger)
+	logger.SetAppenders(NewPBLogAppender("pblog"))
+	logger.WithFields(Fields{"user": "bbq"}).Warn("bridged")
+	log.GetFlushFunc()()
+
+	entries := writer.Memory().Entries(pblog.MemoryFilter{Logger: "[LOG4GO]test.bridge"})
+	if len(entries) != 1 || entries[0].Msg != "bridged" || entries[0].Level != log.LevelWarn ||
+		entries[0].Fields["user"] != "bbq" {
+		t.Fatalf("log4go entry must reach the pblog writer, got %+v", entries)
+	}
+}
@@ -0,0 +1,30 @@
+package log4go_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bbqbyte/go-farm/log4go"
+)
+
+// 外部测试包，调用位置不属于log4go包
+func TestReportCaller(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log4go.GetLogger("test.caller", log4go.WithReportCaller(), log4go.WithoutAddtivity()).(*log4go.Logger)
+	logger.SetAppenders(log4go.NewWriterAppender("caller", log4go.MustPatternLayout("%F:%L %M %m%n"), &buf))
+	logger.Info("located")
+	logger.WithFields(log4go.Fields{"k": "v"}).Infof("entry %s", "located")
+	log4go.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{" TestReportCaller located", " TestReportCaller entry located"}
+	if len(lines) != len(want) {
+		t.Fatalf("unexpected caller output %q", buf.String())
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "caller_test.go:") || !strings.HasSuffix(line, want[i]) {
+			t.Fatalf("unexpected caller output %q", line)
+		}
+	}
+}
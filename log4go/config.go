@@ -0,0 +1,404 @@
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+// Config log4go配置，可由任意pbconfig adapter加载
+//
+//	chanlen: 1024
+//	appenders:
+//	  - name: console
+//	    type: console          # console、stderr、file、pblog
+//	    threshold: INFO
+//	    layout: {type: pattern, pattern: "%d %-5p [%c] %m%n"}
+//	  - name: file
+//	    type: file
+//	    filename: logs/app.log
+//	    maxsize: 104857600
+//	    maxbackups: 7
+//	    layout: {type: json}
+//	loggers:
+//	  - name: a.b
+//	    level: DEBUG
+//	    appenders: [file]
+//	    addtivity: false
+//	root:
+//	  level: INFO
+//	  appenders: [console]
+type Config struct {
+	ChanLen   int64            `json:"chanlen"`
+	Appenders []AppenderConfig `json:"appenders"`
+	Loggers   []LoggerConfig   `json:"loggers"`
+	Root      *LoggerConfig    `json:"root"`
+}
+
+type AppenderConfig struct {
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	Threshold string       `json:"threshold"`
+	Layout    LayoutConfig `json:"layout"`
+
+	// file
+	Filename   string `json:"filename"`
+	MaxSize    int64  `json:"maxsize"`
+	MaxBackups *int   `json:"maxbackups"`
+	Daily      *bool  `json:"daily"`
+	Perm       string `json:"perm"`
+}
+
+type LayoutConfig struct {
+	Type            string `json:"type"` // pattern、json、text，默认pattern
+	Pattern         string `json:"pattern"`
+	TimestampFormat string `json:"timestampformat"`
+	PrettyPrint     bool   `json:"prettyprint"`
+}
+
+type LoggerConfig struct {
+	Name         string   `json:"name"`
+	Level        string   `json:"level"`
+	Appenders    []string `json:"appenders"`
+	Addtivity    *bool    `json:"addtivity"`
+	ReportCaller bool     `json:"reportcaller"`
+}
+
+const (
+	AppenderConsole = "console"
+	AppenderStderr  = "stderr"
+	AppenderFile    = "file"
+	AppenderPBLog   = "pblog"
+
+	LayoutPattern = "pattern"
+	LayoutJSON    = "json"
+	LayoutText    = "text"
+)
+
+var (
+	configLock sync.Mutex
+	// 上次配置创建的appender及配置过的Logger，重新配置时替换
+	configuredAppenders map[string]IAppender
+	configuredLoggers   map[string]bool
+)
+
+// 从configor读取chanlen、appenders、loggers、root
+func LoadConfig(configor pbconfig.Configor) (*Config, error) {
+	conf := &Config{}
+	conf.ChanLen, _ = configor.GetInt64("chanlen", defaultLogChanLen)
+	for key, v := range map[string]interface{}{
+		"appenders": &conf.Appenders,
+		"loggers":   &conf.Loggers,
+		"root":      &conf.Root,
+	} {
+		raw, err := configor.GetRawValue(key)
+		if err != nil {
+			continue
+		}
+		if err := decodeRaw(raw, v); err != nil {
+			return nil, fmt.Errorf("log4go: invalid config %q, %v", key, err)
+		}
+	}
+	return conf, nil
+}
+
+// yaml解析出的map[interface{}]interface{}转为map[string]interface{}后经JSON解码
+func decodeRaw(raw interface{}, v interface{}) error {
+	data, err := json.Marshal(normalizeRaw(raw))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func normalizeRaw(raw interface{}) interface{} {
+	switch v := raw.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeRaw(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = normalizeRaw(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = normalizeRaw(val)
+		}
+		return s
+	}
+	return raw
+}
+
+// 应用配置，可在运行时重复调用
+// 在输出goroutine中切换，切换前已提交的日志先由旧的appender输出，之后旧appender flush并关闭
+func Configure(conf *Config) error {
+	appenders, err := buildAppenders(conf.Appenders)
+	if err != nil {
+		return err
+	}
+	type loggerSetting struct {
+		logger *Logger
+		conf   LoggerConfig
+		level  Level
+		set    bool
+		refs   []IAppender
+	}
+	var settings []loggerSetting
+	resolve := func(lc LoggerConfig) (loggerSetting, error) {
+		s := loggerSetting{conf: lc}
+		if lc.Level != "" {
+			level, err := ParseLevel(lc.Level)
+			if err != nil {
+				return s, err
+			}
+			s.level, s.set = level, true
+		}
+		for _, name := range lc.Appenders {
+			appender, ok := appenders[name]
+			if !ok {
+				if appender = GetAppender(name); appender == nil {
+					return s, fmt.Errorf("log4go: logger %q refers to unknown appender %q", lc.Name, name)
+				}
+			}
+			s.refs = append(s.refs, appender)
+		}
+		return s, nil
+	}
+	if conf.Root != nil {
+		s, err := resolve(*conf.Root)
+		if err != nil {
+			return err
+		}
+		s.logger = ilog.rootLogger
+		if !s.set {
+			s.level, s.set = defaultOption.level, true
+		}
+		settings = append(settings, s)
+	} else {
+		// 未配置root时恢复默认
+		settings = append(settings, loggerSetting{
+			logger: ilog.rootLogger,
+			level:  defaultOption.level,
+			set:    true,
+			refs:   []IAppender{defaultRootAppender},
+		})
+	}
+	for _, lc := range conf.Loggers {
+		if lc.Name == "" || lc.Name == rootLoggerName {
+			return fmt.Errorf("log4go: logger name %q is reserved, use root", lc.Name)
+		}
+		s, err := resolve(lc)
+		if err != nil {
+			return err
+		}
+		s.logger = ilog.getLogger(lc.Name).(*Logger)
+		settings = append(settings, s)
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	ilog.apply(func() {
+		ilog.lock.Lock()
+		// 上次配置过的Logger恢复默认
+		for name := range configuredLoggers {
+			if id, ok := ilog.logIds[name]; ok {
+				logger := ilog.loggs[id].(*Logger)
+				logger.ResetLevel()
+				logger.SetReportCaller(false)
+				atomic.StoreUint32(&logger.addtivity, 1)
+				logger.appenders.Store([]IAppender(nil))
+			}
+		}
+		configuredLoggers = make(map[string]bool)
+		for _, s := range settings {
+			if s.set {
+				s.logger.SetLevel(s.level)
+			} else {
+				s.logger.ResetLevel()
+			}
+			if s.conf.Addtivity == nil || *s.conf.Addtivity {
+				atomic.StoreUint32(&s.logger.addtivity, 1)
+			} else {
+				atomic.StoreUint32(&s.logger.addtivity, 0)
+			}
+			s.logger.SetReportCaller(s.conf.ReportCaller)
+			s.logger.appenders.Store(s.refs)
+			if s.logger != ilog.rootLogger {
+				configuredLoggers[s.logger.Name] = true
+			}
+		}
+		old := configuredAppenders
+		for name, appender := range appenders {
+			ilog.appenders[name] = appender
+		}
+		for name := range old {
+			if _, ok := appenders[name]; !ok {
+				delete(ilog.appenders, name)
+			}
+		}
+		configuredAppenders = appenders
+		ilog.lock.Unlock()
+
+		for _, appender := range old {
+			appender.Flush()
+			if err := appender.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "log4go: appender %q close error, %v\n", appender.Name(), err)
+			}
+		}
+	})
+	return nil
+}
+
+// Configure后启动异步输出
+func StartLoggerWithConfig(configor pbconfig.Configor) error {
+	conf, err := LoadConfig(configor)
+	if err != nil {
+		return err
+	}
+	if err := Configure(conf); err != nil {
+		return err
+	}
+	if conf.ChanLen <= 0 {
+		conf.ChanLen = defaultLogChanLen
+	}
+	startLogger(conf.ChanLen)
+	return nil
+}
+
+// 定期检查配置文件修改时间，变化时重新加载并Configure，返回的stop停止检查
+func WatchConfig(adapterName, filename string, interval time.Duration) (stop func(), err error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	done := make(chan struct{})
+	go func() {
+		modTime := info.ModTime()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(filename)
+				if err != nil || !info.ModTime().After(modTime) {
+					continue
+				}
+				modTime = info.ModTime()
+				if err := reloadConfig(adapterName, filename); err != nil {
+					fmt.Fprintf(os.Stderr, "log4go: reload config %s error, %v\n", filename, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+func reloadConfig(adapterName, filename string) error {
+	configor, err := pbconfig.NewConfig(adapterName, filename)
+	if err != nil {
+		return err
+	}
+	conf, err := LoadConfig(configor)
+	if err != nil {
+		return err
+	}
+	return Configure(conf)
+}
+
+func buildAppenders(confs []AppenderConfig) (map[string]IAppender, error) {
+	appenders := make(map[string]IAppender, len(confs))
+	for _, ac := range confs {
+		if ac.Name == "" {
+			return nil, fmt.Errorf("log4go: appender name is required")
+		}
+		if _, ok := appenders[ac.Name]; ok {
+			return nil, fmt.Errorf("log4go: duplicate appender name %q", ac.Name)
+		}
+		layout, err := buildLayout(ac.Layout)
+		if err != nil {
+			return nil, fmt.Errorf("log4go: appender %q, %v", ac.Name, err)
+		}
+		threshold := Level(LevelTrace)
+		if ac.Threshold != "" {
+			if threshold, err = ParseLevel(ac.Threshold); err != nil {
+				return nil, err
+			}
+		}
+
+		var appender IAppender
+		switch ac.Type {
+		case AppenderConsole, "":
+			ca := NewConsoleAppender(ac.Name, layout)
+			ca.SetThreshold(threshold)
+			appender = ca
+		case AppenderStderr:
+			ca := NewStderrAppender(ac.Name, layout)
+			ca.SetThreshold(threshold)
+			appender = ca
+		case AppenderFile:
+			if ac.Filename == "" {
+				return nil, fmt.Errorf("log4go: appender %q requires filename", ac.Name)
+			}
+			fa := NewRollingFileAppender(ac.Name, layout, ac.Filename)
+			fa.SetThreshold(threshold)
+			if ac.MaxSize != 0 {
+				fa.MaxSize = ac.MaxSize
+			}
+			if ac.MaxBackups != nil {
+				fa.MaxBackups = *ac.MaxBackups
+			}
+			if ac.Daily != nil {
+				fa.Daily = *ac.Daily
+			}
+			if ac.Perm != "" {
+				perm, err := strconv.ParseUint(ac.Perm, 8, 32)
+				if err != nil {
+					return nil, fmt.Errorf("log4go: appender %q invalid perm %q", ac.Name, ac.Perm)
+				}
+				fa.Perm = os.FileMode(perm)
+			}
+			appender = fa
+		case AppenderPBLog:
+			pa := NewPBLogAppender(ac.Name)
+			pa.SetThreshold(threshold)
+			appender = pa
+		default:
+			return nil, fmt.Errorf("log4go: appender %q has unknown type %q", ac.Name, ac.Type)
+		}
+		appenders[ac.Name] = appender
+	}
+	return appenders, nil
+}
+
+func buildLayout(lc LayoutConfig) (Layout, error) {
+	switch lc.Type {
+	case LayoutPattern, "":
+		if lc.Pattern == "" {
+			return nil, nil
+		}
+		return NewPatternLayout(lc.Pattern)
+	case LayoutJSON:
+		return &JSONLayout{TimestampFormat: lc.TimestampFormat, PrettyPrint: lc.PrettyPrint}, nil
+	case LayoutText:
+		return &TextLayout{TimestampFormat: lc.TimestampFormat}, nil
+	}
+	return nil, fmt.Errorf("unknown layout type %q", lc.Type)
+}
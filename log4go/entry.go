@@ -3,8 +3,8 @@ package log4go
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"reflect"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -19,8 +19,6 @@ var (
 
 const (
 	defaultCallDepth int = 4
-
-	_log4goPackage = "github.com/bbqbyte/go-farm/log4go"
 )
 
 func init() {
@@ -36,8 +34,13 @@ func init() {
 type Entry struct {
 	Logger *Logger
 
-	Data  Fields
-	Time  time.Time
+	Data    Fields
+	Time    time.Time
+	Level   Level
+	Message string
+	Caller  *runtime.Frame // Logger开启ReportCaller时记录
+
+	err string // WithFields时无法添加的字段
 }
 
 func NewEntry(logger *Logger) *Entry {
@@ -70,7 +73,7 @@ func (entry *Entry) WithFields(fields Fields) *Entry {
 		if isErrField {
 			tmp := fmt.Sprintf("can not add field %q", k)
 			if fieldErr != "" {
-				fieldErr = entry.err + ", " + tmp
+				fieldErr = fieldErr + ", " + tmp
 			} else {
 				fieldErr = tmp
 			}
@@ -78,52 +81,31 @@ func (entry *Entry) WithFields(fields Fields) *Entry {
 			data[k] = v
 		}
 	}
-	return &Entry{Logger: entry.Logger, Data: data, Time: entry.Time}
+	return &Entry{Logger: entry.Logger, Data: data, Time: entry.Time, err: fieldErr}
 }
 
 func (entry *Entry) WithError(err error) *Entry {
 	return entry.WithFields(Fields{ErrorKey: err})
 }
 
-func (entry Entry) log1(level Level, msg string) {
-	var buffer *bytes.Buffer
-
-	entry.Time = time.Now()
-
-	entry.Level = level
-	entry.Message = msg
-	entry.Logger.mu.Lock()
-	if entry.Logger.ReportCaller {
-		entry.Caller = getCaller()
+// 复制到池中的Entry交给loggerManager分发，Data只读共享
+func (entry *Entry) write(level Level, msg string) {
+	e := ilog.newEntry(entry.Logger)
+	e.Data = entry.Data
+	e.err = entry.err
+	e.Time = time.Now()
+	e.Level = level
+	e.Message = msg
+	if entry.Logger.IsReportCaller() {
+		e.Caller = getCaller()
 	}
-	entry.Logger.mu.Unlock()
-
-	buffer = bufferPool.Get().(*bytes.Buffer)
-	buffer.Reset()
-	defer bufferPool.Put(buffer)
-	entry.Buffer = buffer
 
-	entry.write()
-
-	entry.Buffer = nil
-}
-
-func (entry *Entry) write() {
-	entry.Logger.mu.Lock()
-	defer entry.Logger.mu.Unlock()
-	serialized, err := entry.Logger.Formatter.Format(entry)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to obtain reader, %v\n", err)
-		return
-	}
-	if _, err = entry.Logger.Out.Write(serialized); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to write to log, %v\n", err)
-	}
+	ilog.publish(e)
 }
 
 func (entry *Entry) log(level Level, args ...interface{}) {
 	if entry.Logger.IsLevelEnabled(level) {
-		//entry.log(level, fmt.Sprint(args...))
+		entry.write(level, fmt.Sprint(args...))
 	}
 }
 
@@ -154,6 +136,7 @@ func (entry *Entry) Fatal(args ...interface{}) {
 
 func (entry *Entry) Panic(args ...interface{}) {
 	entry.log(LevelPanic, args...)
+	Flush()
 	panic(fmt.Sprint(args...))
 }
 
@@ -161,7 +144,7 @@ func (entry *Entry) Panic(args ...interface{}) {
 
 func (entry *Entry) logf(level Level, format string, args ...interface{}) {
 	if entry.Logger.IsLevelEnabled(level) {
-		entry.log(level, fmt.Sprintf(format, args...))
+		entry.write(level, fmt.Sprintf(format, args...))
 	}
 }
 
@@ -192,13 +175,15 @@ func (entry *Entry) Fatalf(format string, args ...interface{}) {
 
 func (entry *Entry) Panicf(format string, args ...interface{}) {
 	entry.logf(LevelPanic, format, args...)
+	Flush()
+	panic(fmt.Sprintf(format, args...))
 }
 
 // Entry Println family functions
 
 func (entry *Entry) logln(level Level, args ...interface{}) {
 	if entry.Logger.IsLevelEnabled(level) {
-		entry.log(level, entry.sprintlnn(args...))
+		entry.write(level, entry.sprintlnn(args...))
 	}
 }
 
@@ -229,6 +214,8 @@ func (entry *Entry) Fatalln(args ...interface{}) {
 
 func (entry *Entry) Panicln(args ...interface{}) {
 	entry.logln(LevelPanic, args...)
+	Flush()
+	panic(entry.sprintlnn(args...))
 }
 
 func (entry *Entry) sprintlnn(args ...interface{}) string {
@@ -1,6 +1,11 @@
 package log4go
 
-import "time"
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
 
 const (
 	defaultTimestampFormat = time.RFC3339
@@ -10,8 +15,37 @@ const (
 	FieldKeyError          = "err"
 	FieldKeyFunc           = "func"
 	FieldKeyFile           = "file"
+	FieldKeyLogger         = "logger"
 )
 
 type Layout interface {
 	Format(*Entry) ([]byte, error)
 }
+
+var defaultLayout Layout = simpleLayout{}
+
+// time level [logger] msg key=value ...
+type simpleLayout struct{}
+
+func (simpleLayout) Format(entry *Entry) ([]byte, error) {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufferPool.Put(buffer)
+
+	buffer.WriteString(entry.Time.Format(defaultTimestampFormat))
+	fmt.Fprintf(buffer, " %-5s [%s] %s", entry.Level, entry.Logger.Name, entry.Message)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buffer, " %s=%v", k, entry.Data[k])
+	}
+	if entry.err != "" {
+		fmt.Fprintf(buffer, " %s=%q", FieldKeyError, entry.err)
+	}
+	buffer.WriteByte('\n')
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
@@ -0,0 +1,60 @@
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSONLayout 每条日志输出一行JSON
+// 字段与time、level等固定键冲突时加"fields."前缀
+type JSONLayout struct {
+	TimestampFormat string
+	PrettyPrint     bool
+}
+
+func (jl *JSONLayout) Format(entry *Entry) ([]byte, error) {
+	data := make(Fields, len(entry.Data)+6)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case error:
+			// error默认序列化为{}
+			data[k] = v.Error()
+		default:
+			data[k] = v
+		}
+	}
+	for _, key := range []string{FieldKeyTime, FieldKeyLevel, FieldKeyMsg, FieldKeyLogger, FieldKeyFunc, FieldKeyFile} {
+		if v, ok := data[key]; ok {
+			data["fields."+key] = v
+			delete(data, key)
+		}
+	}
+
+	timestampFormat := jl.TimestampFormat
+	if timestampFormat == "" {
+		timestampFormat = defaultTimestampFormat
+	}
+	data[FieldKeyTime] = entry.Time.Format(timestampFormat)
+	data[FieldKeyLevel] = entry.Level.String()
+	data[FieldKeyMsg] = entry.Message
+	data[FieldKeyLogger] = entry.Logger.Name
+	if entry.err != "" {
+		data[FieldKeyError] = entry.err
+	}
+	if entry.Caller != nil {
+		data[FieldKeyFunc] = entry.Caller.Function
+		data[FieldKeyFile] = fmt.Sprintf("%s:%d", entry.Caller.File, entry.Caller.Line)
+	}
+
+	var serialized []byte
+	var err error
+	if jl.PrettyPrint {
+		serialized, err = json.MarshalIndent(data, "", "  ")
+	} else {
+		serialized, err = json.Marshal(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields to JSON, %v", err)
+	}
+	return append(serialized, '\n'), nil
+}
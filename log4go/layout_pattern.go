@@ -0,0 +1,309 @@
+package log4go
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultConversionPattern = "%d{2006-01-02 15:04:05.000} %-5p [%c] %m%n"
+
+	defaultDateLayout = "2006-01-02 15:04:05.000"
+)
+
+// log4j风格的日期名称
+var namedDateLayouts = map[string]string{
+	"ISO8601":        "2006-01-02T15:04:05.000",
+	"ISO8601_OFFSET": "2006-01-02T15:04:05.000Z07:00",
+	"ABSOLUTE":       "15:04:05.000",
+	"DATE":           "02 Jan 2006 15:04:05.000",
+	"COMPACT":        "20060102150405.000",
+	"RFC3339":        "2006-01-02T15:04:05Z07:00",
+}
+
+// %d{UNIX_MILLIS} 输出毫秒时间戳
+const dateUnixMillis = "UNIX_MILLIS"
+
+// PatternLayout 按log4j转换格式输出
+//
+//	%d{layout}  时间，layout为Go时间格式或ISO8601、ABSOLUTE等名称，默认 2006-01-02 15:04:05.000
+//	%p          级别
+//	%c{n}       Logger名称，n为保留的最后几段
+//	%F %L %M %l 文件名、行号、函数名、完整位置，需要Logger开启ReportCaller
+//	%m          消息
+//	%X{key}     字段，不带key时输出全部字段 key=value
+//	%e          WithFields时无法添加的字段
+//	%n          换行
+//	%%          %
+//
+// 修饰符与log4j一致：%-5p 左对齐最小宽度5，%.20c 超过20时截掉左侧，%-10.20m
+type PatternLayout struct {
+	pattern    string
+	converters []patternConverter
+}
+
+type formattingInfo struct {
+	leftAlign bool
+	min       int
+	max       int // 0不限制
+}
+
+type patternConverter struct {
+	formattingInfo
+	literal   string
+	char      byte
+	convert   func(buf *bytes.Buffer, entry *Entry, c *patternConverter)
+	option    string
+	precision int // %c{n}
+}
+
+func NewPatternLayout(pattern string) (*PatternLayout, error) {
+	if pattern == "" {
+		pattern = DefaultConversionPattern
+	}
+	converters, err := parsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &PatternLayout{pattern: pattern, converters: converters}, nil
+}
+
+// 格式错误时panic，用于包级变量初始化
+func MustPatternLayout(pattern string) *PatternLayout {
+	layout, err := NewPatternLayout(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+func (pl *PatternLayout) Pattern() string {
+	return pl.pattern
+}
+
+func (pl *PatternLayout) Format(entry *Entry) ([]byte, error) {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufferPool.Put(buffer)
+
+	var field bytes.Buffer
+	for i := range pl.converters {
+		c := &pl.converters[i]
+		if c.convert == nil {
+			buffer.WriteString(c.literal)
+			continue
+		}
+		if c.min == 0 && c.max == 0 {
+			c.convert(buffer, entry, c)
+			continue
+		}
+		field.Reset()
+		c.convert(&field, entry, c)
+		c.pad(buffer, field.String())
+	}
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
+
+func (fi formattingInfo) pad(buf *bytes.Buffer, s string) {
+	n := utf8.RuneCountInString(s)
+	if fi.max > 0 && n > fi.max {
+		// 与log4j一致，截掉左侧
+		r := []rune(s)
+		s = string(r[n-fi.max:])
+		n = fi.max
+	}
+	if n >= fi.min {
+		buf.WriteString(s)
+		return
+	}
+	spaces := strings.Repeat(" ", fi.min-n)
+	if fi.leftAlign {
+		buf.WriteString(s)
+		buf.WriteString(spaces)
+	} else {
+		buf.WriteString(spaces)
+		buf.WriteString(s)
+	}
+}
+
+var patternConverters = map[byte]func(buf *bytes.Buffer, entry *Entry, c *patternConverter){
+	'd': convertDate,
+	'p': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		buf.WriteString(entry.Level.String())
+	},
+	'c': convertLogger,
+	'F': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		if entry.Caller != nil {
+			buf.WriteString(filepath.Base(entry.Caller.File))
+		}
+	},
+	'L': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		if entry.Caller != nil {
+			buf.WriteString(strconv.Itoa(entry.Caller.Line))
+		}
+	},
+	'M': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		if entry.Caller != nil {
+			buf.WriteString(funcName(entry.Caller.Function))
+		}
+	},
+	'l': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		if entry.Caller != nil {
+			fmt.Fprintf(buf, "%s(%s:%d)", entry.Caller.Function, filepath.Base(entry.Caller.File), entry.Caller.Line)
+		}
+	},
+	'm': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		buf.WriteString(entry.Message)
+	},
+	'X': convertFields,
+	'e': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		buf.WriteString(entry.err)
+	},
+	'n': func(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+		buf.WriteByte('\n')
+	},
+}
+
+func parsePattern(pattern string) ([]patternConverter, error) {
+	var converters []patternConverter
+	var literal strings.Builder
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			converters = append(converters, patternConverter{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			literal.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		if i >= len(pattern) {
+			return nil, fmt.Errorf("log4go: pattern %q ends with %%", pattern)
+		}
+		if pattern[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+
+		var c patternConverter
+		if pattern[i] == '-' {
+			c.leftAlign = true
+			i++
+		}
+		i, c.min = parseNumber(pattern, i)
+		if i < len(pattern) && pattern[i] == '.' {
+			i, c.max = parseNumber(pattern, i+1)
+			if c.max == 0 {
+				return nil, fmt.Errorf("log4go: pattern %q has invalid max width", pattern)
+			}
+		}
+		if i >= len(pattern) {
+			return nil, fmt.Errorf("log4go: pattern %q ends without conversion character", pattern)
+		}
+		convert, ok := patternConverters[pattern[i]]
+		if !ok {
+			return nil, fmt.Errorf("log4go: pattern %q has unknown conversion character %q", pattern, pattern[i])
+		}
+		c.char = pattern[i]
+		c.convert = convert
+		if i+1 < len(pattern) && pattern[i+1] == '{' {
+			end := strings.IndexByte(pattern[i+1:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("log4go: pattern %q has unclosed option", pattern)
+			}
+			c.option = pattern[i+2 : i+1+end]
+			i += 1 + end
+		}
+		if err := c.prepareOption(); err != nil {
+			return nil, fmt.Errorf("log4go: pattern %q: %v", pattern, err)
+		}
+
+		flushLiteral()
+		converters = append(converters, c)
+	}
+	flushLiteral()
+	return converters, nil
+}
+
+func parseNumber(pattern string, i int) (int, int) {
+	n := 0
+	for ; i < len(pattern) && pattern[i] >= '0' && pattern[i] <= '9'; i++ {
+		n = n*10 + int(pattern[i]-'0')
+	}
+	return i, n
+}
+
+func (c *patternConverter) prepareOption() error {
+	switch c.char {
+	case 'd':
+		if c.option == "" {
+			c.option = defaultDateLayout
+		} else if layout, ok := namedDateLayouts[c.option]; ok {
+			c.option = layout
+		}
+	case 'c':
+		if c.option != "" {
+			n, err := strconv.Atoi(c.option)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid logger precision %q", c.option)
+			}
+			c.precision = n
+		}
+	}
+	return nil
+}
+
+func convertDate(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+	if c.option == dateUnixMillis {
+		buf.WriteString(strconv.FormatInt(entry.Time.UnixNano()/1e6, 10))
+		return
+	}
+	var b [64]byte
+	buf.Write(entry.Time.AppendFormat(b[:0], c.option))
+}
+
+// a.b.c.d 在 %c{2} 时输出 c.d
+func convertLogger(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+	name := entry.Logger.Name
+	if c.precision > 0 {
+		end := len(name)
+		for n := c.precision; n > 0; n-- {
+			idx := strings.LastIndexByte(name[:end], '.')
+			if idx < 0 {
+				end = -1
+				break
+			}
+			end = idx
+		}
+		name = name[end+1:]
+	}
+	buf.WriteString(name)
+}
+
+func convertFields(buf *bytes.Buffer, entry *Entry, c *patternConverter) {
+	if c.option != "" {
+		if v, ok := entry.Data[c.option]; ok {
+			fmt.Fprint(buf, v)
+		}
+		return
+	}
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%s=%v", k, entry.Data[k])
+	}
+}
@@ -0,0 +1,84 @@
+package log4go
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// TextLayout 输出 key=value 格式，需要时对值加引号
+//
+//	time=2006-01-02T15:04:05Z level=INFO logger=a.b msg="hello world" user=bbq
+type TextLayout struct {
+	TimestampFormat string
+	DisableSorting  bool
+}
+
+func (tl *TextLayout) Format(entry *Entry) ([]byte, error) {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufferPool.Put(buffer)
+
+	timestampFormat := tl.TimestampFormat
+	if timestampFormat == "" {
+		timestampFormat = defaultTimestampFormat
+	}
+	tl.appendKeyValue(buffer, FieldKeyTime, entry.Time.Format(timestampFormat))
+	tl.appendKeyValue(buffer, FieldKeyLevel, entry.Level.String())
+	tl.appendKeyValue(buffer, FieldKeyLogger, entry.Logger.Name)
+	if entry.Caller != nil {
+		tl.appendKeyValue(buffer, FieldKeyFunc, entry.Caller.Function)
+		tl.appendKeyValue(buffer, FieldKeyFile, fmt.Sprintf("%s:%d", entry.Caller.File, entry.Caller.Line))
+	}
+	tl.appendKeyValue(buffer, FieldKeyMsg, entry.Message)
+	if entry.err != "" {
+		tl.appendKeyValue(buffer, FieldKeyError, entry.err)
+	}
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	if !tl.DisableSorting {
+		sort.Strings(keys)
+	}
+	for _, k := range keys {
+		tl.appendKeyValue(buffer, k, entry.Data[k])
+	}
+	buffer.WriteByte('\n')
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
+
+func (tl *TextLayout) appendKeyValue(b *bytes.Buffer, key string, value interface{}) {
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+
+	stringVal, ok := value.(string)
+	if !ok {
+		stringVal = fmt.Sprint(value)
+	}
+	if needsQuoting(stringVal) {
+		b.WriteString(strconv.Quote(stringVal))
+	} else {
+		b.WriteString(stringVal)
+	}
+}
+
+func needsQuoting(text string) bool {
+	if len(text) == 0 {
+		return true
+	}
+	for _, ch := range text {
+		if !((ch >= 'a' && ch <= 'z') ||
+			(ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '.' || ch == '_' || ch == '/' || ch == '@' || ch == '^' || ch == '+' || ch == ':') {
+			return true
+		}
+	}
+	return false
+}
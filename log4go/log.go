@@ -1,5 +1,10 @@
 package log4go
 
+import (
+	"fmt"
+	"strings"
+)
+
 const (
 	LevelTrace = iota
 	LevelDebug
@@ -17,6 +22,25 @@ type (
 	Fields map[string]interface{}
 )
 
+var levelNames = [LevelOff + 1]string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL", "PANIC", "OFF"}
+
+// 不区分大小写，如 "debug"、"WARN"
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelOff, fmt.Errorf("log4go: unknown level %q", name)
+}
+
+func (level Level) String() string {
+	if level <= LevelOff {
+		return levelNames[level]
+	}
+	return "UNKNOWN"
+}
+
 type ILogBase interface {
 	Printf(format string, args ...interface{})
 	Print(args ...interface{})
@@ -0,0 +1,331 @@
+package log4go
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+// 测试使用独立的loggerManager，避免重复运行时appender、Logger与上次冲突
+// 返回的函数关闭该manager并恢复原来的ilog
+func useNewManager() func() {
+	saved := ilog
+	ilog = newLoggerManager()
+	return func() {
+		ilog.stop()
+		ilog = saved
+	}
+}
+
+func TestAsyncAppender(t *testing.T) {
+	defer useNewManager()()
+	var buf bytes.Buffer
+	appender := NewWriterAppender("buffer", nil, &buf)
+	appender.SetThreshold(LevelInfo)
+	if err := AddAppender(appender); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := GetLogger("test.async", WithAppenders("buffer"), WithoutAddtivity())
+	StartLogger()
+	logger.Debug("hidden")
+	logger.WithFields(Fields{"user": "bbq"}).Info("hello")
+	logger.Errorf("code %d", 500)
+	Flush()
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Fatalf("entry below threshold was written: %q", out)
+	}
+	if !strings.Contains(out, "INFO  [test.async] hello user=bbq") || !strings.Contains(out, "code 500") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestRollingFileAppender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appender := NewRollingFileAppender("file", nil, filepath.Join(dir, "app.log"))
+	appender.MaxSize = 64
+	appender.MaxBackups = 2
+
+	logger := newLogger("test.file", defaultOption)
+	for i := 0; i < 10; i++ {
+		entry := &Entry{Logger: logger, Time: time.Now(), Level: LevelInfo, Message: "rolling file appender"}
+		if err := appender.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "app*.log"))
+	if len(files) != 3 {
+		t.Fatalf("got %d files, want current file and 2 backups: %v", len(files), files)
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	defer useNewManager()()
+	var parentBuf, childBuf bytes.Buffer
+	AddAppender(NewWriterAppender("h.parent", nil, &parentBuf))
+	AddAppender(NewWriterAppender("h.child", nil, &childBuf))
+
+	child := GetLogger("h.a.b.c", WithAppenders("h.child")).(*Logger)
+	parent := GetLogger("h.a", WithLevel(LevelWarn), WithAppenders("h.parent")).(*Logger)
+	if child.Parent() != parent {
+		t.Fatalf("parent of h.a.b.c is %q, want h.a", child.Parent().Name)
+	}
+	if child.IsLevelEnabled(LevelInfo) {
+		t.Fatal("child must inherit WARN from h.a")
+	}
+
+	parent.SetLevel(LevelDebug)
+	child.Info("to both")
+	// appender在输出时按当前层级解析
+	Flush()
+	child.ClearAddtivity()
+	child.Info("child only")
+	Flush()
+
+	if !strings.Contains(parentBuf.String(), "to both") || strings.Contains(parentBuf.String(), "child only") {
+		t.Fatalf("unexpected parent output %q", parentBuf.String())
+	}
+	if !strings.Contains(childBuf.String(), "to both") || !strings.Contains(childBuf.String(), "child only") {
+		t.Fatalf("unexpected child output %q", childBuf.String())
+	}
+
+	middle := GetLogger("h.a.b").(*Logger)
+	if child.Parent() != middle || middle.Parent() != parent {
+		t.Fatal("h.a.b must be linked between h.a and h.a.b.c")
+	}
+}
+
+func TestPatternLayout(t *testing.T) {
+	layout, err := NewPatternLayout("%d{ISO8601} %-5p %c{2} %.4m|%6X{user}|%F %M%n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &Entry{
+		Logger:  newLogger("a.b.c.d", defaultOption),
+		Data:    Fields{"user": "bbq"},
+		Time:    time.Date(2019, 5, 1, 8, 30, 0, 123e6, time.UTC),
+		Level:   LevelWarn,
+		Message: "truncated",
+	}
+	out, _ := layout.Format(entry)
+	if want := "2019-05-01T08:30:00.123 WARN  c.d ated|   bbq| \n"; string(out) != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+
+	for _, bad := range []string{"%q", "%d{", "%c{x}", "%-"} {
+		if _, err := NewPatternLayout(bad); err == nil {
+			t.Fatalf("pattern %q must be rejected", bad)
+		}
+	}
+}
+
+func TestPanic(t *testing.T) {
+	defer useNewManager()()
+	var buf bytes.Buffer
+	logger := GetLogger("test.panic", WithoutAddtivity()).(*Logger)
+	logger.SetAppenders(NewWriterAppender("panic", MustPatternLayout("%m%n"), &buf))
+
+	cases := []struct {
+		name string
+		fn   func()
+		want string
+	}{
+		{"Panic", func() { logger.Panic("a", 1) }, "a1"},
+		{"Panicf", func() { logger.Panicf("b%d", 2) }, "b2"},
+		{"Panicln", func() { logger.Panicln("c", 3) }, "c 3"},
+		{"Entry.Panic", func() { logger.WithFields(Fields{"k": "v"}).Panic("d") }, "d"},
+		{"Entry.Panicf", func() { logger.WithFields(Fields{"k": "v"}).Panicf("e%d", 5) }, "e5"},
+		{"Entry.Panicln", func() { logger.WithFields(Fields{"k": "v"}).Panicln("f", 6) }, "f 6"},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		func() {
+			defer func() {
+				if r := recover(); r != c.want {
+					t.Errorf("%s: recovered %v, want %q", c.name, r, c.want)
+				}
+			}()
+			c.fn()
+		}()
+		if buf.String() != c.want+"\n" {
+			t.Errorf("%s: logged %q before panicking, want %q", c.name, buf.String(), c.want)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer useNewManager()()
+	filename := filepath.Join(dir, "conf.log")
+
+	data := `{
+		"appenders": [
+			{"name": "conf.file", "type": "file", "filename": "` + filename + `", "threshold": "info",
+			 "layout": {"type": "pattern", "pattern": "%p %c %m%n"}}
+		],
+		"loggers": [
+			{"name": "conf.a", "level": "debug", "appenders": ["conf.file"], "addtivity": false}
+		],
+		"root": {"level": "error"}
+	}`
+	configor, err := pbconfig.NewConfigData("json", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StartLoggerWithConfig(configor); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := GetLogger("conf.a.b")
+	logger.Debug("below threshold")
+	logger.Info("configured")
+	if GetLogger("other").(*Logger).IsLevelEnabled(LevelWarn) {
+		t.Fatal("root level must be ERROR")
+	}
+
+	// 重新配置，conf.a恢复继承root
+	if err := Configure(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("after reload")
+	Flush()
+
+	content, _ := ioutil.ReadFile(filename)
+	if string(content) != "INFO conf.a.b configured\n" {
+		t.Fatalf("unexpected file content %q", content)
+	}
+	if GetAppender("conf.file") != nil {
+		t.Fatal("appender of previous config must be removed")
+	}
+}
+
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+// logChan写满时并发创建Logger、替换appender，不应死锁
+func TestPublishContention(t *testing.T) {
+	defer useNewManager()()
+	ilog.start(1)
+
+	logger := GetLogger("contention", WithoutAddtivity()).(*Logger)
+	logger.SetAppenders(NewWriterAppender("slow", nil, slowWriter{50 * time.Microsecond}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					logger.Info("contention")
+				}
+			}()
+		}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					GetLogger("contention.x" + strconv.Itoa(i) + "." + strconv.Itoa(j))
+					if j%50 == 0 {
+						Flush()
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		StopLogger()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("publish deadlocked with logger registration")
+	}
+}
+
+// logChan写满时运行期重新配置，不应死锁
+func TestConfigureUnderLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer useNewManager()()
+	ilog.start(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				logger := GetLogger("reload.a.b")
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						logger.Info("reload")
+					}
+				}
+			}()
+		}
+		addtivity := false
+		for i := 0; i < 50; i++ {
+			conf := &Config{
+				Appenders: []AppenderConfig{{Name: "reload.file", Type: AppenderFile,
+					Filename: filepath.Join(dir, strconv.Itoa(i%2)+".log")}},
+				Loggers: []LoggerConfig{{Name: "reload.a", Appenders: []string{"reload.file"}, Addtivity: &addtivity}},
+			}
+			if err := Configure(conf); err != nil {
+				t.Error(err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+		Configure(&Config{})
+		StopLogger()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reload deadlocked with blocked producers")
+	}
+}
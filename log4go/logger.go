@@ -5,50 +5,60 @@ import (
 	"sync/atomic"
 )
 
+// level未设置，使用上级Logger的level
+const levelInherit = ^uint32(0)
+
+// Logger按名称中的"."组成层级，a.b.c的上级依次为a.b、a、root
 type Logger struct {
 	Name string
 
-	option Op
+	level     uint32
+	addtivity uint32
+	caller    uint32
+	parent    atomic.Value // *Logger，root为nil
+	appenders atomic.Value // []IAppender，整体替换，输出goroutine无锁读取
 }
 
-func (logger *Logger) newEntry() *Entry {
-	entry, ok := ilog.entryPool.Get().(*Entry)
-	if ok {
-		entry.setLogger(logger)
-		return entry
+func newLogger(name string, op Op) *Logger {
+	logger := &Logger{
+		Name:  name,
+		level: levelInherit,
+	}
+	if op.levelSet {
+		logger.level = uint32(op.level)
+	}
+	if op.addtivity {
+		logger.addtivity = 1
 	}
-	return NewEntry(logger)
+	if op.reportCaller {
+		logger.caller = 1
+	}
+	logger.parent.Store((*Logger)(nil))
+	logger.appenders.Store([]IAppender(nil))
+	return logger
 }
 
-func (logger *Logger) releaseEntry(entry *Entry) {
-	entry.Data = map[string]interface{}{}
-	ilog.entryPool.Put(entry)
+// 不带字段的Entry，Data为nil
+func (logger *Logger) newEntry() *Entry {
+	return &Entry{Logger: logger}
 }
 
 func (logger *Logger) WithFields(fields Fields) *Entry {
-	entry := logger.newEntry()
-	defer logger.releaseEntry(entry)
-	return entry.WithFields(fields)
+	return logger.newEntry().WithFields(fields)
 }
 
 func (logger *Logger) WithError(err error) *Entry {
-	entry := logger.newEntry()
-	defer logger.releaseEntry(entry)
-	return entry.WithError(err)
+	return logger.newEntry().WithError(err)
 }
 
 func (logger *Logger) log(level Level, args ...interface{}) {
 	if logger.IsLevelEnabled(level) {
-		entry := logger.newEntry()
-		entry.log(level, args...)
-		logger.releaseEntry(entry)
+		logger.newEntry().log(level, args...)
 	}
 }
 
 func (logger *Logger) Print(args ...interface{}) {
-	entry := logger.newEntry()
-	entry.Print(args...)
-	logger.releaseEntry(entry)
+	logger.newEntry().Print(args...)
 }
 
 func (logger *Logger) Debug(args ...interface{}) {
@@ -72,22 +82,19 @@ func (logger *Logger) Fatal(args ...interface{}) {
 	logger.Exit(1)
 }
 
+// 输出日志后panic，与pb/log一致
 func (logger *Logger) Panic(args ...interface{}) {
-	logger.log(LevelPanic, args...)
+	logger.newEntry().Panic(args...)
 }
 
 func (logger *Logger) logf(level Level, format string, args ...interface{}) {
 	if logger.IsLevelEnabled(level) {
-		entry := logger.newEntry()
-		entry.logf(level, format, args...)
-		logger.releaseEntry(entry)
+		logger.newEntry().logf(level, format, args...)
 	}
 }
 
 func (logger *Logger) Printf(format string, args ...interface{}) {
-	entry := logger.newEntry()
-	entry.Printf(format, args...)
-	logger.releaseEntry(entry)
+	logger.newEntry().Printf(format, args...)
 }
 
 func (logger *Logger) Debugf(format string, args ...interface{}) {
@@ -112,21 +119,17 @@ func (logger *Logger) Fatalf(format string, args ...interface{}) {
 }
 
 func (logger *Logger) Panicf(format string, args ...interface{}) {
-	logger.logf(LevelPanic, format, args...)
+	logger.newEntry().Panicf(format, args...)
 }
 
 func (logger *Logger) logln(level Level, args ...interface{}) {
 	if logger.IsLevelEnabled(level) {
-		entry := logger.newEntry()
-		entry.logln(level, args...)
-		logger.releaseEntry(entry)
+		logger.newEntry().logln(level, args...)
 	}
 }
 
 func (logger *Logger) Println(args ...interface{}) {
-	entry := logger.newEntry()
-	entry.Println(args...)
-	logger.releaseEntry(entry)
+	logger.newEntry().Println(args...)
 }
 
 func (logger *Logger) Debugln(args ...interface{}) {
@@ -151,7 +154,7 @@ func (logger *Logger) Fatalln(args ...interface{}) {
 }
 
 func (logger *Logger) Panicln(args ...interface{}) {
-	logger.logln(LevelPanic, args...)
+	logger.newEntry().Panicln(args...)
 }
 
 // operation
@@ -160,26 +163,82 @@ func (logger *Logger) Exit(code int) {
 	events.Exit(code)
 }
 
-func (logger *Logger) level() Level {
-	return Level(atomic.LoadUint32((*uint32)(&logger.Level)))
+// 沿层级向上查找第一个设置了level的Logger，root总是设置了level
+func (logger *Logger) getLevel() Level {
+	for l := logger; ; {
+		level := atomic.LoadUint32(&l.level)
+		parent := l.Parent()
+		if level != levelInherit || parent == nil {
+			return Level(level)
+		}
+		l = parent
+	}
 }
 
+// 未单独设置level的下级Logger随之生效
 func (logger *Logger) SetLevel(level Level) {
-	atomic.StoreUint32((*uint32)(&logger.Level), uint32(level))
+	atomic.StoreUint32(&logger.level, uint32(level))
+}
+
+// 清除Logger自身的level，改为继承上级，对root无效
+func (logger *Logger) ResetLevel() {
+	if logger.Parent() != nil {
+		atomic.StoreUint32(&logger.level, levelInherit)
+	}
+}
+
+func (logger *Logger) Parent() *Logger {
+	return logger.parent.Load().(*Logger)
 }
 
 func (logger *Logger) GetLevel() Level {
-	return logger.level()
+	return logger.getLevel()
 }
 
 func (logger *Logger) IsLevelEnabled(level Level) bool {
-	return logger.level() <= level
+	return logger.getLevel() <= level
 }
 
 func (logger *Logger) SetAddtivity() {
-	atomic.StoreUint32(&logger.Addtivity, 1)
+	atomic.StoreUint32(&logger.addtivity, 1)
+}
+
+// 记录调用位置，供Layout输出文件、行号及函数名，对下级Logger同样生效
+func (logger *Logger) SetReportCaller(report bool) {
+	var v uint32
+	if report {
+		v = 1
+	}
+	atomic.StoreUint32(&logger.caller, v)
+}
+
+func (logger *Logger) IsReportCaller() bool {
+	for l := logger; l != nil; l = l.Parent() {
+		if atomic.LoadUint32(&l.caller) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (logger *Logger) ClearAddtivity() {
+	atomic.StoreUint32(&logger.addtivity, 0)
 }
 
 func (logger *Logger) IsAddtivity() bool {
-	return atomic.LoadUint32(&logger.Addtivity) == 1
+	return atomic.LoadUint32(&logger.addtivity) == 1
+}
+
+// 设置Logger的appender，替换已有的appender
+func (logger *Logger) SetAppenders(appenders ...IAppender) {
+	logger.appenders.Store(append([]IAppender(nil), appenders...))
+}
+
+func (logger *Logger) Appenders() []IAppender {
+	return append([]IAppender(nil), logger.loadAppenders()...)
+}
+
+// 当前appender的快照，不可修改
+func (logger *Logger) loadAppenders() []IAppender {
+	return logger.appenders.Load().([]IAppender)
 }
@@ -5,12 +5,16 @@ type LoggerOption func(*Op)
 type Op struct {
 	addtivity bool
 	level     Level
+	levelSet  bool // 未设置时继承上级Logger的level
 	appenders []string
+
+	reportCaller bool
 }
 
+// 与log4j一致，默认向上级Logger的appender输出
 var defaultOption = Op{
 	level:     LevelTrace,
-	addtivity: false,
+	addtivity: true,
 }
 
 func (op *Op) applyOpts(opts []LoggerOption) {
@@ -20,9 +24,26 @@ func (op *Op) applyOpts(opts []LoggerOption) {
 }
 
 func WithLevel(level Level) LoggerOption {
-	return func(op *Op) { op.level = level }
+	return func(op *Op) {
+		op.level = level
+		op.levelSet = true
+	}
 }
 
 func WithAddtivity() LoggerOption {
 	return func(op *Op) { op.addtivity = true }
-}
\ No newline at end of file
+}
+
+// 日志只输出到Logger自身的appender
+func WithoutAddtivity() LoggerOption {
+	return func(op *Op) { op.addtivity = false }
+}
+
+// 按名称引用已通过AddAppender注册的appender
+func WithAppenders(names ...string) LoggerOption {
+	return func(op *Op) { op.appenders = append(op.appenders, names...) }
+}
+
+func WithReportCaller() LoggerOption {
+	return func(op *Op) { op.reportCaller = true }
+}
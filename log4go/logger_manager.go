@@ -1,46 +1,115 @@
 package log4go
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
+
+	"github.com/bbqbyte/go-farm/events"
 )
 
 var (
 	ilog  *loggerManager
 	ionce sync.Once
+
+	// 未配置时根Logger输出到标准输出
+	defaultRootAppender IAppender = NewConsoleAppender("console", nil)
+)
+
+const (
+	defaultLogChanLen = 1024
+
+	rootLoggerName = "root"
+)
+
+const (
+	stateSync    int32 = iota // StartLogger前同步写入appender
+	stateRunning              // 异步写入
+	stateClosed               // 已关闭，丢弃日志
 )
 
 type exitFunc func(int)
 
 func init() {
-	ilog = &loggerManager{
-		closed:    true,
+	ilog = newLoggerManager()
+}
+
+func newLoggerManager() *loggerManager {
+	m := &loggerManager{
 		logIdSeed: 1000,
 		appenders: make(map[string]IAppender),
-		rootLogger: &Logger{
-		},
-		logIds: make(map[string]uint32),
-		loggs:  make(map[uint32]ILogger),
+		logIds:    make(map[string]uint32),
+		loggs:     make(map[uint32]ILogger),
+		exitFn:    os.Exit,
+	}
+	m.entryPool.New = func() interface{} {
+		return &Entry{}
 	}
+	m.rootLogger = newLogger(rootLoggerName, Op{level: defaultOption.level, levelSet: true})
+	m.rootLogger.appenders.Store([]IAppender{defaultRootAppender})
+	m.logIds[rootLoggerName] = atomic.AddUint32(&m.logIdSeed, 1)
+	m.loggs[m.logIds[rootLoggerName]] = m.rootLogger
+	return m
 }
 
+// name为""或"root"时返回根Logger
 func GetLogger(name string, opts ...LoggerOption) ILogger {
 	return ilog.getLogger(name, opts...)
 }
 
+// 根Logger，未指定appender的Logger输出到根Logger的appender
+func RootLogger() *Logger {
+	return ilog.rootLogger
+}
+
+// 注册appender，供WithAppenders按名称引用
+func AddAppender(appender IAppender) error {
+	return ilog.addAppender(appender)
+}
+
+func GetAppender(name string) IAppender {
+	ilog.lock.RLock()
+	defer ilog.lock.RUnlock()
+	return ilog.appenders[name]
+}
+
+// 启动异步输出，进程退出时flush并关闭所有appender
 func StartLogger() {
+	startLogger(defaultLogChanLen)
+}
+
+func startLogger(chanLen int64) {
 	ionce.Do(func() {
+		ilog.start(chanLen)
+		events.RegisterExitHandlerTail(StopLogger)
 	})
 }
 
+// 将已提交的日志写入appender并flush
+func Flush() {
+	ilog.flush()
+}
+
+// flush并关闭所有appender，之后的日志被丢弃
+func StopLogger() {
+	ilog.stop()
+}
+
+// lock保护logIds、loggs、appenders及状态切换
+// 发送日志和输出goroutine不持有lock，避免logChan写满时与写锁互相等待
 type loggerManager struct {
-	lock   sync.RWMutex
-	closed bool
+	lock  sync.RWMutex
+	state int32 // 原子读写
+	done  chan struct{}
+	wg    sync.WaitGroup
 
 	logChanLen int64
 	logChan    chan *Entry
 	signalChan chan string
+	flushAck   chan struct{}
+	applyChan  chan func()
 
 	entryPool  sync.Pool
 	logIdSeed  uint32
@@ -53,30 +122,282 @@ type loggerManager struct {
 }
 
 func (a *loggerManager) getLogger(name string, opts ...LoggerOption) ILogger {
+	if name == "" {
+		name = rootLoggerName
+	}
 	a.lock.RLock()
 	l, ok := a.logIds[name]
 	if ok {
+		logger := a.loggs[l]
 		a.lock.RUnlock()
-		return a.loggs[l]
+		return logger
 	} else {
 		a.lock.RUnlock()
 		a.lock.Lock()
 		if _, ok := a.logIds[name]; !ok {
-			a.logIds[name] = atomic.AddUint32(&a.logIdSeed, 1)
-			a.loggs[a.logIds[name]] = &Logger{
-				Name:  name,
+			op := defaultOption
+			op.applyOpts(opts)
+			logger := newLogger(name, op)
+			var appenders []IAppender
+			for _, appenderName := range op.appenders {
+				if appender, ok := a.appenders[appenderName]; ok {
+					appenders = append(appenders, appender)
+				} else {
+					fmt.Fprintf(os.Stderr, "log4go: logger %q refers to unknown appender %q\n", name, appenderName)
+				}
 			}
-			l = a.logIds[name]
+			logger.appenders.Store(appenders)
+			a.logIds[name] = atomic.AddUint32(&a.logIdSeed, 1)
+			a.loggs[a.logIds[name]] = logger
+			a.linkLogger(logger)
 		}
+		l = a.logIds[name]
+		logger := a.loggs[l]
 		a.lock.Unlock()
-		return a.loggs[l]
+		return logger
 	}
 }
 
-type logEvent struct {
-	Logger  *Logger
-	Data    Fields
-	Time    time.Time
-	Level   Level
-	Message string
+// 设置新Logger的上级，并将原先挂在更高层级上的下级Logger改挂到新Logger
+// 调用方持有写锁
+func (a *loggerManager) linkLogger(logger *Logger) {
+	logger.parent.Store(a.ancestorOf(logger.Name))
+
+	prefix := logger.Name + "."
+	for _, l := range a.loggs {
+		child, ok := l.(*Logger)
+		if !ok || !strings.HasPrefix(child.Name, prefix) {
+			continue
+		}
+		parent := child.Parent()
+		if parent == a.rootLogger || len(parent.Name) < len(logger.Name) {
+			child.parent.Store(logger)
+		}
+	}
+}
+
+// 最近的已存在的上级Logger，调用方持有锁
+func (a *loggerManager) ancestorOf(name string) *Logger {
+	for {
+		idx := strings.LastIndexByte(name, '.')
+		if idx <= 0 {
+			return a.rootLogger
+		}
+		name = name[:idx]
+		if id, ok := a.logIds[name]; ok {
+			return a.loggs[id].(*Logger)
+		}
+	}
+}
+
+func (a *loggerManager) addAppender(appender IAppender) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.appenders[appender.Name()]; ok {
+		return fmt.Errorf("log4go: duplicate appender name %q", appender.Name())
+	}
+	a.appenders[appender.Name()] = appender
+	return nil
+}
+
+func (a *loggerManager) newEntry(logger *Logger) *Entry {
+	entry := a.entryPool.Get().(*Entry)
+	entry.setLogger(logger)
+	return entry
+}
+
+func (a *loggerManager) releaseEntry(entry *Entry) {
+	*entry = Entry{}
+	a.entryPool.Put(entry)
+}
+
+func (a *loggerManager) start(chanLen int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if atomic.LoadInt32(&a.state) != stateSync {
+		return
+	}
+	a.logChanLen = chanLen
+	a.logChan = make(chan *Entry, chanLen)
+	a.signalChan = make(chan string, 1)
+	a.flushAck = make(chan struct{})
+	a.applyChan = make(chan func())
+	a.done = make(chan struct{})
+	atomic.StoreInt32(&a.state, stateRunning)
+
+	a.wg.Add(1)
+	go a.run()
+}
+
+// logChan写满时阻塞，stop后放弃发送并丢弃日志
+func (a *loggerManager) publish(entry *Entry) {
+	switch atomic.LoadInt32(&a.state) {
+	case stateRunning:
+		select {
+		case a.logChan <- entry:
+		case <-a.done:
+			a.releaseEntry(entry)
+		}
+	case stateSync:
+		a.dispatch(entry)
+	default:
+		a.releaseEntry(entry)
+	}
+}
+
+func (a *loggerManager) run() {
+	defer a.wg.Done()
+	for {
+		select {
+		case entry := <-a.logChan:
+			a.dispatch(entry)
+		case fn := <-a.applyChan:
+			// 先输出已入队的日志，保证其使用变更前的配置
+			a.drain()
+			fn()
+		case sig := <-a.signalChan:
+			a.drain()
+			a.flushAppenders()
+			if sig == "close" {
+				a.closeAppenders()
+				return
+			}
+			select {
+			case a.flushAck <- struct{}{}:
+			case <-a.done:
+			}
+		}
+	}
+}
+
+func (a *loggerManager) drain() {
+	for {
+		select {
+		case entry := <-a.logChan:
+			a.dispatch(entry)
+		default:
+			return
+		}
+	}
+}
+
+func (a *loggerManager) dispatch(entry *Entry) {
+	for _, appender := range a.appendersOf(entry.Logger) {
+		if err := appender.Append(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "log4go: appender %q write error, %v\n", appender.Name(), err)
+		}
+	}
+	a.releaseEntry(entry)
+}
+
+// Logger自身的appender，addtivity时再加上上级Logger的appender，直到addtivity为false的Logger
+// 只读取各Logger的appender快照，不获取lock
+func (a *loggerManager) appendersOf(logger *Logger) []IAppender {
+	var appenders []IAppender
+	for l := logger; l != nil; l = l.Parent() {
+		if appenders == nil && !l.IsAddtivity() {
+			return l.loadAppenders()
+		}
+		appenders = append(appenders, l.loadAppenders()...)
+		if !l.IsAddtivity() {
+			break
+		}
+	}
+	return appenders
+}
+
+// 所有Logger引用的及已注册的appender，去重
+func (a *loggerManager) allAppenders() []IAppender {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	seen := make(map[IAppender]bool)
+	var all []IAppender
+	add := func(appenders []IAppender) {
+		for _, appender := range appenders {
+			if !seen[appender] {
+				seen[appender] = true
+				all = append(all, appender)
+			}
+		}
+	}
+	add(a.rootLogger.loadAppenders())
+	for _, l := range a.loggs {
+		if logger, ok := l.(*Logger); ok {
+			add(logger.loadAppenders())
+		}
+	}
+	for _, appender := range a.appenders {
+		add([]IAppender{appender})
+	}
+	return all
+}
+
+func (a *loggerManager) flushAppenders() {
+	for _, appender := range a.allAppenders() {
+		if err := appender.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "log4go: appender %q flush error, %v\n", appender.Name(), err)
+		}
+	}
+}
+
+func (a *loggerManager) closeAppenders() {
+	for _, appender := range a.allAppenders() {
+		if err := appender.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "log4go: appender %q close error, %v\n", appender.Name(), err)
+		}
+	}
+}
+
+// 在输出goroutine中执行fn，与appender写入串行，返回时fn已执行完成
+// 输出goroutine已停止时在当前goroutine执行
+func (a *loggerManager) apply(fn func()) {
+	if atomic.LoadInt32(&a.state) == stateRunning {
+		done := make(chan struct{})
+		select {
+		case a.applyChan <- func() {
+			fn()
+			close(done)
+		}:
+			<-done
+			return
+		case <-a.done:
+		}
+	}
+	fn()
+}
+
+func (a *loggerManager) flush() {
+	switch atomic.LoadInt32(&a.state) {
+	case stateRunning:
+		select {
+		case a.signalChan <- "flush":
+		case <-a.done:
+			return
+		}
+		select {
+		case <-a.flushAck:
+		case <-a.done:
+		}
+	case stateSync:
+		a.flushAppenders()
+	}
+}
+
+func (a *loggerManager) stop() {
+	a.lock.Lock()
+	state := atomic.SwapInt32(&a.state, stateClosed)
+	if state == stateRunning {
+		close(a.done)
+	}
+	a.lock.Unlock()
+
+	switch state {
+	case stateRunning:
+		// signalChan容量为1，flush占用时等待输出goroutine取走
+		a.signalChan <- "close"
+		a.wg.Wait()
+	case stateSync:
+		a.flushAppenders()
+		a.closeAppenders()
+	}
 }
@@ -1,2 +1,57 @@
 package log4go
 
+import (
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+const maximumCallerDepth = 25
+
+var log4goPackage string
+
+func init() {
+	log4goPackage = packageName(runtime.FuncForPC(reflect.ValueOf(getCaller).Pointer()).Name())
+}
+
+// 跳过log4go包内的调用，返回第一个外部调用位置
+func getCaller() *runtime.Frame {
+	pcs := make([]uintptr, maximumCallerDepth)
+	depth := runtime.Callers(callDepth, pcs)
+	frames := runtime.CallersFrames(pcs[:depth])
+
+	for {
+		frame, more := frames.Next()
+		if packageName(frame.Function) != log4goPackage {
+			return &frame
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// github.com/a/b.(*T).M -> github.com/a/b
+func packageName(f string) string {
+	for {
+		lastPeriod := strings.LastIndex(f, ".")
+		lastSlash := strings.LastIndex(f, "/")
+		if lastPeriod > lastSlash {
+			f = f[:lastPeriod]
+		} else {
+			break
+		}
+	}
+	return f
+}
+
+// github.com/a/b.(*T).M -> (*T).M
+func funcName(f string) string {
+	if idx := strings.LastIndex(f, "/"); idx >= 0 {
+		f = f[idx+1:]
+	}
+	if idx := strings.Index(f, "."); idx >= 0 {
+		f = f[idx+1:]
+	}
+	return f
+}
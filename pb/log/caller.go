@@ -0,0 +1,140 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Panic/Fatal输出后调用，确保日志已写入writer
+	flushFunc = func() {}
+	exitFunc  = os.Exit
+)
+
+func SetFlushFunc(f func()) {
+	if f == nil {
+		f = func() {}
+	}
+	flushFunc = f
+}
+
+func GetFlushFunc() func() {
+	return flushFunc
+}
+
+// Caller constructs a Field that stores "file:line" of the caller under the key "caller".
+// skip 0 identifies the frame of Caller itself, as with runtime.Caller.
+func Caller(skip int) Field {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return Field{fieldType: skipType}
+	}
+	return String("caller", trimFilePath(file)+":"+strconv.Itoa(line))
+}
+
+const callerSkipKey = "callerskip"
+
+// CallerSkip 由转发日志的入口(stdlog、Recover、log4go等)附加，给出比直接调用Logger方法多出的调用栈层数，
+// writer据此定位caller和stacktrace，本身不输出。skip小于0表示当前调用栈与日志来源无关，不记录调用位置
+func CallerSkip(skip int) Field {
+	return Field{key: callerSkipKey, fieldType: skipType, val: int64(skip)}
+}
+
+// fields中CallerSkip给出的层数，没有时为0
+func CallerSkipOf(fields []Field) int {
+	for _, f := range fields {
+		if f.fieldType == skipType && f.key == callerSkipKey {
+			return int(f.val)
+		}
+	}
+	return 0
+}
+
+// 调用方之上连续的函数名以prefix开头的栈帧数，skip 0为调用framesWithPrefix的函数的调用方
+func framesWithPrefix(skip int, prefix string) int {
+	var pcs [32]uintptr
+	n := runtime.Callers(skip+3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	count := 0
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, prefix) {
+			return count
+		}
+		count++
+		if !more {
+			return count
+		}
+	}
+}
+
+// StackTrace constructs a Field that stores the full stacktrace under the key "stacktrace".
+// skip 0 identifies the frame of StackTrace itself.
+//
+// This is eager and therefore an expensive operation.
+func StackTrace(skip int) Field {
+	var pcs [64]uintptr
+	n := runtime.Callers(skip+1, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var buf bytes.Buffer
+	for {
+		frame, more := frames.Next()
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(frame.Function)
+		buf.WriteString("\n\t")
+		buf.WriteString(frame.File)
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(frame.Line))
+		if !more {
+			break
+		}
+	}
+	return String("stacktrace", buf.String())
+}
+
+// 保留最后一级目录，如 log/caller.go
+func trimFilePath(file string) string {
+	idx := strings.LastIndexByte(file, '/')
+	if idx == -1 {
+		return file
+	}
+	idx = strings.LastIndexByte(file[:idx], '/')
+	if idx == -1 {
+		return file
+	}
+	return file[idx+1:]
+}
+
+// 用于defer，捕获panic并以Error级别输出panic原因及堆栈，panic不再向上传递
+//
+//	defer plog.Recover()
+func (l *Logger) Recover(fields ...Field) {
+	if r := recover(); r != nil {
+		// 跳过Recover及runtime处理panic的栈帧，定位到panic的位置
+		l.logPanic(r, 1+framesWithPrefix(0, "runtime."), fields)
+	}
+}
+
+// 输出已recover的panic及当前堆栈
+func (l *Logger) LogPanic(r interface{}, fields ...Field) {
+	l.logPanic(r, 1, fields)
+}
+
+// skip为logPanic之上到日志来源的额外层数
+func (l *Logger) logPanic(r interface{}, skip int, fields []Field) {
+	if logSwitch == 0 || l.Level() > LevelError {
+		return
+	}
+	all := make([]Field, 0, len(fields)+3)
+	all = append(all, Object("panic", fmt.Sprint(r)))
+	all = append(all, fields...)
+	all = append(all, StackTrace(2+skip), CallerSkip(skip))
+	logFunc(l, LevelError, "recovered from panic", all)
+}
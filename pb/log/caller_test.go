@@ -0,0 +1,37 @@
+package log
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPanicRecover(t *testing.T) {
+	var got []Field
+	SetLogFunc(func(l *Logger, level Level, msg string, fields []Field) {
+		got = fields
+	})
+	defer SetLogFunc(func(l *Logger, level Level, msg string, fields []Field) {})
+
+	l := New("[test]")
+	func() {
+		defer l.Recover()
+		l.Panic("boom")
+	}()
+
+	var stack string
+	for _, f := range got {
+		if f.Key() == "stacktrace" {
+			stack = f.str
+		}
+	}
+	if !strings.Contains(stack, "TestPanicRecover") {
+		t.Fatalf("stacktrace does not contain the panicking function: %q", stack)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	f := Caller(0)
+	if !strings.HasPrefix(f.str, "log/caller.go:") {
+		t.Fatalf("unexpected caller %q", f.str)
+	}
+}
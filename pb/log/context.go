@@ -0,0 +1,87 @@
+package log
+
+import "context"
+
+type contextKey int
+
+const (
+	fieldsContextKey contextKey = iota
+	loggerContextKey
+	traceIDContextKey
+)
+
+var (
+	// trace id 在日志中的字段名
+	TraceIDKey = "trace_id"
+
+	ctxLogger = New("[CTX]")
+)
+
+// 在ctx上附加日志fields，与ctx中已有的fields合并
+func NewContext(ctx context.Context, fields ...Field) context.Context {
+	if len(fields) == 0 {
+		return ctx
+	}
+	prev := ContextFields(ctx)
+	merged := make([]Field, 0, len(prev)+len(fields))
+	merged = append(merged, prev...)
+	merged = append(merged, fields...)
+	return context.WithValue(ctx, fieldsContextKey, merged)
+}
+
+// 在ctx上绑定Logger，FromContext时以此Logger为基础
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, l)
+}
+
+// 在ctx上设置trace id
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDContextKey, traceID)
+}
+
+// 获取ctx中的trace id
+func TraceID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(traceIDContextKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// 获取ctx中附加的fields
+func ContextFields(ctx context.Context) []Field {
+	if ctx == nil {
+		return nil
+	}
+	if fields, ok := ctx.Value(fieldsContextKey).([]Field); ok {
+		return fields
+	}
+	return nil
+}
+
+// 从ctx获取Logger，自动附加trace id与ctx中的fields
+// ctx未绑定Logger时使用默认的[CTX] Logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx == nil {
+		return ctxLogger
+	}
+	l, ok := ctx.Value(loggerContextKey).(*Logger)
+	if !ok || l == nil {
+		l = ctxLogger
+	}
+	return l.WithContext(ctx)
+}
+
+// 派生子Logger，附加ctx中的trace id与fields
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if ctx == nil {
+		return l
+	}
+	fields := ContextFields(ctx)
+	if id := TraceID(ctx); id != "" {
+		fields = append([]Field{String(TraceIDKey, id)}, fields...)
+	}
+	return l.With(fields...)
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// 按顺序输出字符串字段的 key=value
+func fieldPairs(fields []Field) []string {
+	var pairs []string
+	for _, f := range fields {
+		pairs = append(pairs, f.key+"="+f.str)
+	}
+	return pairs
+}
+
+func TestWith(t *testing.T) {
+	root := New("[with]", String("app", "farm"))
+	child := root.With(String("a", "1"))
+	grandchild := child.With(String("b", "2"))
+
+	cases := []struct {
+		name   string
+		logger *Logger
+		want   []string
+	}{
+		{"root", root, []string{"app=farm"}},
+		{"child", child, []string{"app=farm", "a=1"}},
+		{"grandchild", grandchild, []string{"app=farm", "a=1", "b=2"}},
+		{"no fields", grandchild.With(), []string{"app=farm", "a=1", "b=2"}},
+	}
+	for _, c := range cases {
+		if got := fieldPairs(c.logger.Context()); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+		if c.logger.Name() != "[with]" {
+			t.Errorf("%s: name %q must be inherited", c.name, c.logger.Name())
+		}
+	}
+	if grandchild.With() != grandchild || grandchild.parent != root {
+		t.Fatal("With without fields must return the logger itself, and children must hang off the root")
+	}
+
+	grandchild.SetLevel(LevelError)
+	if root.Level() != LevelError || child.Level() != LevelError {
+		t.Fatal("level set on a child must apply to its root")
+	}
+	if child.Context()[0].str != "farm" || len(root.Context()) != 1 {
+		t.Fatal("With must not modify the parent context")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	bound := New("[bound]")
+	base := NewContext(context.Background(), String("a", "1"))
+
+	cases := []struct {
+		name       string
+		ctx        context.Context
+		wantName   string
+		wantFields []string
+		wantTrace  string
+	}{
+		{"nil ctx", nil, "[CTX]", nil, ""},
+		{"empty ctx", context.Background(), "[CTX]", nil, ""},
+		{"fields", base, "[CTX]", []string{"a=1"}, ""},
+		{"merged fields", NewContext(base, String("b", "2")), "[CTX]", []string{"a=1", "b=2"}, ""},
+		{"no new fields", NewContext(base), "[CTX]", []string{"a=1"}, ""},
+		{"trace id", WithTraceID(context.Background(), "t1"), "[CTX]", []string{"trace_id=t1"}, "t1"},
+		{"trace id first", WithTraceID(base, "t2"), "[CTX]", []string{"trace_id=t2", "a=1"}, "t2"},
+		{"bound logger", WithLogger(WithTraceID(base, "t3"), bound), "[bound]", []string{"trace_id=t3", "a=1"}, "t3"},
+		{"nil bound logger", WithLogger(base, nil), "[CTX]", []string{"a=1"}, ""},
+	}
+	for _, c := range cases {
+		l := FromContext(c.ctx)
+		if l.Name() != c.wantName {
+			t.Errorf("%s: name %q, want %q", c.name, l.Name(), c.wantName)
+		}
+		if got := fieldPairs(l.Context()); !reflect.DeepEqual(got, c.wantFields) {
+			t.Errorf("%s: fields %v, want %v", c.name, got, c.wantFields)
+		}
+		if got := TraceID(c.ctx); got != c.wantTrace {
+			t.Errorf("%s: trace id %q, want %q", c.name, got, c.wantTrace)
+		}
+	}
+
+	if fieldPairs(ContextFields(base))[0] != "a=1" || len(ContextFields(base)) != 1 {
+		t.Fatal("deriving a context must not modify the parent fields")
+	}
+	bound.SetLevel(LevelWarn)
+	if FromContext(WithLogger(base, bound)).Level() != LevelWarn {
+		t.Fatal("context logger must follow the level of the bound logger")
+	}
+}
@@ -153,6 +153,11 @@ func Message(val interface{}) Field {
 	return Field{key: "message", fieldType: objectType, obj: val}
 }
 
+// Key returns the field key
+func (f Field) Key() string {
+	return f.key
+}
+
 // Encode encodes a field to a type safe val via the encoder.
 func (f Field) Encode(enc Encoder) {
 	switch f.fieldType {
@@ -32,6 +32,8 @@ type Logger struct {
 	outWriter string // 指定输出
 	level Level
 	context  []Field
+	parent *Logger // With派生的子Logger，level跟随parent
+	sampler *Sampler
 }
 
 
@@ -58,13 +60,37 @@ func (l *Logger) SetOutWriter(writername string) {
 }
 
 func (l *Logger) Level() Level {
+	if l.parent != nil {
+		return l.parent.Level()
+	}
 	return l.level
 }
 
+// 子Logger设置level时会设置到其根Logger
 func (l *Logger) SetLevel(level Level) {
+	if l.parent != nil {
+		l.parent.SetLevel(level)
+		return
+	}
 	l.level = level
 }
 
+// 派生子Logger，附加fields到context，子Logger不加入全局loggers
+func (l *Logger) With(fields ...Field) *Logger {
+	if len(fields) == 0 {
+		return l
+	}
+	context := make([]Field, 0, len(l.context)+len(fields))
+	context = append(context, l.context...)
+	context = append(context, fields...)
+
+	root := l
+	if l.parent != nil {
+		root = l.parent
+	}
+	return &Logger{name: l.name, outWriter: l.outWriter, level: l.level, context: context, parent: root}
+}
+
 // 设置所有Logger的level
 func SetLevel(level Level) {
 	for _, logger := range loggers {
@@ -72,6 +98,23 @@ func SetLevel(level Level) {
 	}
 }
 
+// 设置Logger的采样策略，nil表示不采样
+func (l *Logger) SetSampler(s *Sampler) {
+	if l.parent != nil {
+		l.parent.SetSampler(s)
+		return
+	}
+	l.sampler = s
+}
+
+func (l *Logger) Sampler() *Sampler {
+	if l.parent != nil {
+		return l.parent.Sampler()
+	}
+	return l.sampler
+}
+
+// 调用栈深度，writer开启caller时用于定位调用Logger的代码
 func SetCallDepth(depth int) {
 	DefaultCallDepth = depth
 }
@@ -85,16 +128,27 @@ func SetLogFunc(f writeLogFunc) {
 	logFunc = f
 }
 
+// 当前的输出函数，临时替换后用于恢复
+func GetLogFunc() func(l *Logger, level Level, msg string, fields []Field) {
+	return logFunc
+}
+
+// 输出日志后退出进程
 func (l *Logger) Fatal(msg string, fields ...Field) {
 	if l.Level() <= LevelFatal && logSwitch != 0 {
 		logFunc(l, LevelFatal, msg, fields)
 	}
+	flushFunc()
+	exitFunc(1)
 }
 
+// 输出日志后panic(msg)
 func (l *Logger) Panic(msg string, fields ...Field) {
 	if l.Level() <= LevelPanic && logSwitch != 0  {
 		logFunc(l, LevelPanic, msg, fields)
 	}
+	flushFunc()
+	panic(msg)
 }
 
 func (l *Logger) Error(msg string, fields ...Field) {
@@ -120,3 +174,13 @@ func (l *Logger) Debug(msg string, fields ...Field) {
 		logFunc(l, LevelDebug,  msg, fields)
 	}
 }
+
+// 按指定level输出日志，LevelPanic/LevelFatal不会panic或退出进程，供桥接其他日志库使用
+func (l *Logger) Log(level Level, msg string, fields ...Field) {
+	if level >= LevelOff {
+		return
+	}
+	if l.Level() <= level && logSwitch != 0 {
+		logFunc(l, level, msg, fields)
+	}
+}
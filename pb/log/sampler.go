@@ -0,0 +1,91 @@
+package log
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+const sampleBuckets = 1024
+
+// 日志采样：每个 level+msg 在每个 tick 周期(按tick对齐)内先记录前 first 条，之后每 thereafter 条记录一条
+// msg按hash分桶计数，不同msg可能落入同一桶
+type Sampler struct {
+	counts     [LevelOff][sampleBuckets]sampleCounter
+	suppressed uint64
+	tick       time.Duration
+	first      uint64
+	thereafter uint64
+}
+
+// state高32位为周期序号，低32位为周期内计数，一次CAS同时完成换周期和计数
+type sampleCounter struct {
+	state   uint64
+	dropped uint64
+}
+
+// thereafter为0时，超过first后的日志全部丢弃直到下一个周期
+func NewSampler(tick time.Duration, first, thereafter int) *Sampler {
+	if tick <= 0 {
+		tick = time.Second
+	}
+	if first < 0 {
+		first = 0
+	}
+	if thereafter < 0 {
+		thereafter = 0
+	}
+	return &Sampler{
+		tick:       tick,
+		first:      uint64(first),
+		thereafter: uint64(thereafter),
+	}
+}
+
+// 判断该条日志是否输出；新周期的第一条日志同时返回上一周期被丢弃的数量
+func (s *Sampler) Check(level Level, msg string) (bool, uint64) {
+	if s == nil || level < LevelDebug || level >= LevelOff {
+		return true, 0
+	}
+	c := &s.counts[level][hashMsg(msg)%sampleBuckets]
+	n, dropped := c.incCheckReset(time.Now(), s.tick)
+	if n <= s.first || (s.thereafter > 0 && (n-s.first)%s.thereafter == 0) {
+		return true, dropped
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	atomic.AddUint64(&s.suppressed, 1)
+	return false, 0
+}
+
+// 累计丢弃的日志数量
+func (s *Sampler) Suppressed() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.suppressed)
+}
+
+// 周期按tick对齐，进入新周期的第一条日志取走上一周期的丢弃数量
+func (c *sampleCounter) incCheckReset(t time.Time, tick time.Duration) (uint64, uint64) {
+	period := uint64(t.UnixNano()/tick.Nanoseconds()) & 0xffffffff
+	for {
+		old := atomic.LoadUint64(&c.state)
+		n := uint64(1)
+		if old>>32 == period {
+			n = old&0xffffffff + 1
+		}
+		if !atomic.CompareAndSwapUint64(&c.state, old, period<<32|n) {
+			continue
+		}
+		if n == 1 {
+			return 1, atomic.SwapUint64(&c.dropped, 0)
+		}
+		return n, 0
+	}
+}
+
+func hashMsg(msg string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(msg))
+	return h.Sum32()
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(time.Hour, 2, 3)
+	var logged int
+	for i := 0; i < 11; i++ {
+		if ok, _ := s.Check(LevelError, "dead letter"); ok {
+			logged++
+		}
+	}
+	// 1,2 then 5,8,11
+	if logged != 5 {
+		t.Fatalf("logged %d entries, want 5", logged)
+	}
+	if s.Suppressed() != 6 {
+		t.Fatalf("suppressed %d entries, want 6", s.Suppressed())
+	}
+	if ok, _ := s.Check(LevelWarn, "dead letter"); !ok {
+		t.Fatal("levels must be sampled separately")
+	}
+}
+
+func TestSamplerTickBoundary(t *testing.T) {
+	const (
+		goroutines = 8
+		calls      = 2000
+	)
+	tick := 5 * time.Millisecond
+	s := NewSampler(tick, 10, 0)
+
+	// 同一时刻进入新周期，计数不能丢失或重复
+	var c sampleCounter
+	t0 := time.Unix(0, 0)
+	for i := 0; i < 5; i++ {
+		c.incCheckReset(t0, tick)
+	}
+	atomic.StoreUint64(&c.dropped, 3)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		seen    = make(map[uint64]bool)
+		dropped uint64
+	)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, d := c.incCheckReset(t0.Add(tick), tick)
+			mu.Lock()
+			seen[n] = true
+			dropped += d
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for n := uint64(1); n <= goroutines; n++ {
+		if !seen[n] {
+			t.Fatalf("counts in the new tick must be 1..%d, got %v", goroutines, seen)
+		}
+	}
+	if dropped != 3 {
+		t.Fatalf("dropped of the previous tick must be reported once, got %d", dropped)
+	}
+
+	// 并发跨越多个周期，丢弃数量全部被上报或留在计数器中
+	var logged, reported uint64
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				if ok, d := s.Check(LevelInfo, "boundary"); ok {
+					atomic.AddUint64(&logged, 1)
+					atomic.AddUint64(&reported, d)
+				}
+				if j%100 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if logged+s.Suppressed() != goroutines*calls {
+		t.Fatalf("logged %d + suppressed %d must equal %d", logged, s.Suppressed(), goroutines*calls)
+	}
+	remain := atomic.LoadUint64(&s.counts[LevelInfo][hashMsg("boundary")%sampleBuckets].dropped)
+	if reported+remain != s.Suppressed() {
+		t.Fatalf("reported %d + remaining %d dropped must equal suppressed %d", reported, remain, s.Suppressed())
+	}
+}
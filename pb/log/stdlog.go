@@ -0,0 +1,54 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	stdlog "log"
+	"os"
+	"sync"
+)
+
+var stdmu sync.Mutex
+
+type logWriter struct {
+	l     *Logger
+	level Level
+}
+
+// 每次Write输出一条日志，去掉末尾换行
+func (w *logWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimRight(p, "\r\n")
+	// 跳过Write及标准库log包的栈帧，caller定位到调用log.Printf等的代码
+	w.l.Log(w.level, string(msg), CallerSkip(1+framesWithPrefix(0, "log.")))
+	return len(p), nil
+}
+
+// 返回以l按level输出的io.Writer，用于接入只接受io.Writer的第三方库
+func NewWriter(l *Logger, level Level) io.Writer {
+	return &logWriter{l: l, level: level}
+}
+
+// 返回输出到l的标准库*log.Logger，如redigo.NewLoggingConn、mysql.SetLogger
+func NewStdLogger(l *Logger, level Level) *stdlog.Logger {
+	return stdlog.New(NewWriter(l, level), "", 0)
+}
+
+// 将标准库全局logger重定向到l，返回恢复原flags、prefix并输出到os.Stderr的函数
+func RedirectStdLog(l *Logger, level Level) func() {
+	stdmu.Lock()
+	defer stdmu.Unlock()
+
+	flags := stdlog.Flags()
+	prefix := stdlog.Prefix()
+	stdlog.SetFlags(0)
+	stdlog.SetPrefix("")
+	stdlog.SetOutput(NewWriter(l, level))
+
+	return func() {
+		stdmu.Lock()
+		defer stdmu.Unlock()
+		stdlog.SetFlags(flags)
+		stdlog.SetPrefix(prefix)
+		stdlog.SetOutput(os.Stderr)
+	}
+}
@@ -0,0 +1,35 @@
+package log
+
+import (
+	stdlog "log"
+	"testing"
+)
+
+func TestStdLogBridge(t *testing.T) {
+	type record struct {
+		name  string
+		level Level
+		msg   string
+	}
+	var got []record
+	SetLogFunc(func(l *Logger, level Level, msg string, fields []Field) {
+		got = append(got, record{l.Name(), level, msg})
+	})
+	defer SetLogFunc(func(l *Logger, level Level, msg string, fields []Field) {})
+
+	NewStdLogger(New("[std]"), LevelWarn).Println("hello")
+
+	restore := RedirectStdLog(New("[global]"), LevelInfo)
+	stdlog.Printf("redirected %d", 1)
+	restore()
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 records, got %v", got)
+	}
+	if got[0] != (record{"[std]", LevelWarn, "hello"}) {
+		t.Fatalf("unexpected record %v", got[0])
+	}
+	if got[1] != (record{"[global]", LevelInfo, "redirected 1"}) {
+		t.Fatalf("unexpected record %v", got[1])
+	}
+}
@@ -263,6 +263,10 @@ func (ctx *actorContext) MessageHeader() ReadonlyMessageHeader {
 	return UnwrapEnvelopeHeader(ctx.messageOrEnvelope)
 }
 
+func (ctx *actorContext) Logger() *log.Logger {
+	return headerLogger(plog.With(log.Stringer("pid", ctx.self)), ctx.MessageHeader())
+}
+
 func (ctx *actorContext) Send(pid *PID, message interface{}) {
 	ctx.sendUserMessage(pid, message)
 }
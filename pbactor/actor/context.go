@@ -1,6 +1,10 @@
 package actor
 
-import "time"
+import (
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
 
 // Context contains contextual information for actors
 type Context interface {
@@ -82,6 +86,9 @@ type messagePart interface {
 
 	// MessageHeader returns the meta information for the currently processed message
 	MessageHeader() ReadonlyMessageHeader
+
+	// Logger returns a logger annotated with the current actor PID and message header
+	Logger() *log.Logger
 }
 
 type senderPart interface {
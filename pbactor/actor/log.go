@@ -1,6 +1,10 @@
 package actor
 
-import "keywea.com/cloud/pblib/pb/log"
+import (
+	"sort"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
 
 var (
 	plog = log.New("[ACTOR].pbactor")
@@ -9,3 +13,21 @@ var (
 func SetLogLevel(level log.Level) {
 	plog.SetLevel(level)
 }
+
+func SetLogSampler(sampler *log.Sampler) {
+	plog.SetSampler(sampler)
+}
+
+// headerLogger attaches every message header entry as a field
+func headerLogger(l *log.Logger, header ReadonlyMessageHeader) *log.Logger {
+	if header == nil || header.Length() == 0 {
+		return l
+	}
+	keys := header.Keys()
+	sort.Strings(keys)
+	fields := make([]log.Field, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, log.String(k, header.Get(k)))
+	}
+	return l.With(fields...)
+}
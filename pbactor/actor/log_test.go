@@ -0,0 +1,68 @@
+package actor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+// 只记录字符串字段
+type stringEncoder struct {
+	log.Encoder
+	pairs []string
+}
+
+func (e *stringEncoder) EncodeString(key string, val string) {
+	e.pairs = append(e.pairs, key+"="+val)
+}
+
+func loggerFields(l *log.Logger) []string {
+	enc := &stringEncoder{}
+	for _, f := range l.Context() {
+		f.Encode(enc)
+	}
+	return enc.pairs
+}
+
+func TestContextLogger(t *testing.T) {
+	got := make(chan []string, 1)
+	pid := Spawn(FromFunc(func(ctx Context) {
+		if _, ok := ctx.Message().(string); ok {
+			got <- loggerFields(ctx.Logger())
+		}
+	}))
+	defer pid.Stop()
+
+	cases := []struct {
+		name    string
+		message interface{}
+		want    []string
+	}{
+		{"no header", "plain", []string{"pid=" + pid.String()}},
+		{"header", &MessageEnvelope{
+			Header:  messageHeader{"trace_id": "t1", "a": "1"},
+			Message: "with header",
+		}, []string{"pid=" + pid.String(), "a=1", "trace_id=t1"}},
+	}
+	for _, c := range cases {
+		EmptyRootContext.Send(pid, c.message)
+		select {
+		case fields := <-got:
+			if !reflect.DeepEqual(fields, c.want) {
+				t.Errorf("%s: got %v, want %v", c.name, fields, c.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: message not received", c.name)
+		}
+	}
+
+	root := NewRootContext(map[string]string{"trace_id": "t2"})
+	if fields := loggerFields(root.Logger()); !reflect.DeepEqual(fields, []string{"trace_id=t2"}) {
+		t.Fatalf("root context logger must carry its headers, got %v", fields)
+	}
+	if fields := loggerFields(EmptyRootContext.Logger()); len(fields) != 0 {
+		t.Fatalf("empty root context logger must not add fields, got %v", fields)
+	}
+}
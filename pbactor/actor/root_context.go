@@ -1,6 +1,10 @@
 package actor
 
-import "time"
+import (
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
 
 type RootContext struct {
 	senderMiddleware SenderFunc
@@ -91,6 +95,10 @@ func (rc *RootContext) MessageHeader() ReadonlyMessageHeader {
 	return rc.headers
 }
 
+func (rc *RootContext) Logger() *log.Logger {
+	return headerLogger(plog, rc.headers)
+}
+
 func (rc *RootContext) Send(pid *PID, message interface{}) {
 	rc.sendUserMessage(pid, message)
 }
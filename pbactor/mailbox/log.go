@@ -9,3 +9,7 @@ var (
 func SetLogLevel(level log.Level) {
 	plog.SetLevel(level)
 }
+
+func SetLogSampler(sampler *log.Sampler) {
+	plog.SetSampler(sampler)
+}
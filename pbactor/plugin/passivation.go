@@ -20,7 +20,8 @@ type PassivationHolder struct {
 
 func (state *PassivationHolder) Reset(duration time.Duration) {
 	if state.timer == nil {
-		plog.Fatal("Cannot reset passivation of a non-started actor")
+		plog.Error("Cannot reset passivation of a non-started actor")
+		return
 	}
 	if atomic.LoadInt32(&state.done) == 0 {
 		state.timer.Reset(duration)
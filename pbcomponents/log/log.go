@@ -10,6 +10,7 @@ const (
 	AdapterConsole   = "console"
 	AdapterFile      = "file"
 	AdapterRemote    = "remote"
+	AdapterMemory    = "memory"
 )
 
 type newLoggerFunc func() ILogger
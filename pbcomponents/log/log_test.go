@@ -1,28 +1,39 @@
 package log
 
 import (
-	"fmt"
-	"keywea.com/cloud/pblib/pbapp"
-	"keywea.com/cloud/pblib/pbconfig"
-	"keywea.com/cloud/pblib/pb/log"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"keywea.com/cloud/pblib/pb/log"
+	"keywea.com/cloud/pblib/pbconfig"
 )
 
 func TestLog(t *testing.T) {
-	s := "{\"level\": 0, \"default\":true, \"adapter\":\"file\", \"filename\":\"/volumes/D/x.log\"}"
-	c, err := pbconfig.NewConfigData("json", []byte(s))
+	dir, err := ioutil.TempDir("", "pblog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := json.Marshal(map[string]interface{}{
+		"level": 0, "default": true, "adapter": "file", "filename": filepath.Join(dir, "x.log"),
+	})
+	c, err := pbconfig.NewConfigData("json", s)
 	if err != nil {
 		t.Fatal("parse json error")
-	} else {
-		l, e := NewLogWriter("default", c)
-		if e != nil {
-			fmt.Sprint(e)
-		}
-		logf := log.New("[testlog]")
-		logf.Info("show me the money", log.String("x", "aa"), log.Stack())
-		logf.Error("I'm dying", log.String("x", "bb"), log.Stack())
-		logf.Fatal("I'm died", log.String("x", "cc"), log.Stack())
-		pbapp.Wait()
-		l.Destroy()
 	}
+	l, err := NewLogWriter("default", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logf := log.New("[testlog]")
+	logf.Info("show me the money", log.String("x", "aa"), log.Stack())
+	logf.Error("I'm dying", log.String("x", "bb"), log.Stack())
+	func() {
+		defer logf.Recover()
+		logf.Panic("I'm died", log.String("x", "cc"), log.Stack())
+	}()
+	l.Destroy()
 }
@@ -1,16 +1,25 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
 	"keywea.com/cloud/pblib/pbconfig"
 	"keywea.com/cloud/pblib/pb/events"
 	"keywea.com/cloud/pblib/pb/log"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	msgObjPool *sync.Pool
+	// 各logPane共用
+	msgObjPool = &sync.Pool{
+		New: func() interface{} {
+			return &LogWrap{}
+		},
+	}
 
 	ilog *logPane
 	ionce sync.Once
@@ -19,13 +28,16 @@ var (
 type logPane struct {
 	lock           sync.Mutex
 	inited         bool
-	closed 		   bool
+	done           chan struct{} // Close时关闭，之后的Publish、Flush直接返回
+	loopID         uint64 // 输出goroutine的id
 	logChanLen     int64
 	logChan        chan *LogWrap
 	signalChan     chan string
 	wg             sync.WaitGroup
 	defaultWriter  string // 默认log writer
 	writers    	   map[string]*PBLogWriter // logname : writer
+	policies       atomic.Value // map[string]*writerPolicy, ""为默认writer
+	flushAck       chan struct{}
 }
 
 type PBLogWriter struct {
@@ -33,6 +45,7 @@ type PBLogWriter struct {
 	adapter string
 	level log.Level
 	writer ILogger
+	policy *writerPolicy
 
 	wmu sync.Mutex
 	closed bool
@@ -48,6 +61,7 @@ func NewLogWriter(logWriterName string, configor pbconfig.Configor) (*PBLogWrite
 				return nil
 			}, events.SHUTDOWN_INDEX_LOG)
 			log.SetLogFunc(ilog.Publish)
+			log.SetFlushFunc(ilog.Flush)
 		}
 	})
 
@@ -60,18 +74,15 @@ func (sl *logPane) InitLog(configor pbconfig.Configor) {
 	if sl.inited {
 		return
 	}
-	sl.closed = false
+	sl.done = make(chan struct{})
 
 	sl.logChanLen, _ = configor.GetInt64("chanlen", 1e3)
 	sl.logChan = make(chan *LogWrap, sl.logChanLen)
-	msgObjPool = &sync.Pool{
-		New: func() interface{} {
-			return &LogWrap{}
-		},
-	}
 	sl.writers = make(map[string]*PBLogWriter)
+	sl.policies.Store(map[string]*writerPolicy{})
 
 	sl.signalChan = make(chan string, 1)
+	sl.flushAck = make(chan struct{})
 
 	sl.wg.Add(1)
 	go sl.startLog()
@@ -81,6 +92,7 @@ func (sl *logPane) InitLog(configor pbconfig.Configor) {
 
 func (sl *logPane) startLog() {
 	closed := false
+	atomic.StoreUint64(&sl.loopID, goid())
 
 	for {
 		select {
@@ -91,6 +103,12 @@ func (sl *logPane) startLog() {
 			msgObjPool.Put(log)
 		case sig := <-sl.signalChan:
 			sl.flush()
+			if sig == "flush" {
+				select {
+				case sl.flushAck <- struct{}{}:
+				case <-sl.done:
+				}
+			}
 			if sig == "close" {
 				for _, l := range sl.writers {
 					l.Destroy()
@@ -140,18 +158,128 @@ func (sl *logPane) SetLogWriter(logWriterName string, configor pbconfig.Configor
 		adapter: adapterName,
 		level: log.Level(level),
 		writer: logInst,
+		policy: newWriterPolicy(configor),
 	}
 
 	if isDefaultWriter {
 		sl.defaultWriter = logWriterName
 	}
+	sl.refreshPolicies()
 	return sl.writers[logWriterName], nil
 }
 
+// 在日志进入logChan前按writer处理
+type writerPolicy struct {
+	sampler    *log.Sampler
+	caller     bool      // 附加调用位置
+	stackLevel log.Level // 不低于该级别时附加堆栈
+}
+
+//	{
+//	"caller":true,
+//	"stacklevel":3, // 默认Error，6(LevelOff)关闭
+//	"sampletick":1000, // 采样周期，毫秒
+//	"samplefirst":100, // 未配置时不采样
+//	"samplethereafter":100
+//	}
+func newWriterPolicy(configor pbconfig.Configor) *writerPolicy {
+	p := &writerPolicy{}
+	p.caller, _ = configor.GetBool("caller")
+	stackLevel, _ := configor.GetInt("stacklevel", log.LevelError)
+	p.stackLevel = log.Level(stackLevel)
+	if first, err := configor.GetInt("samplefirst"); err == nil {
+		tick, _ := configor.GetInt64("sampletick", 1000)
+		thereafter, _ := configor.GetInt("samplethereafter", 0)
+		p.sampler = log.NewSampler(time.Duration(tick)*time.Millisecond, first, thereafter)
+	}
+	return p
+}
+
+// copy-on-write，Publish无锁读取
+func (sl *logPane) refreshPolicies() {
+	policies := make(map[string]*writerPolicy)
+	for name, w := range sl.writers {
+		policies[name] = w.policy
+		if name == sl.defaultWriter {
+			policies[""] = w.policy
+		}
+	}
+	sl.policies.Store(policies)
+}
+
+func (sl *logPane) writerPolicy(outWriter string) *writerPolicy {
+	policies, _ := sl.policies.Load().(map[string]*writerPolicy)
+	return policies[outWriter]
+}
+
+// 先按Logger再按writer采样，被丢弃的日志不进入logChan
+func (sl *logPane) sample(l *log.Logger, p *writerPolicy, level log.Level, msg string, fields []log.Field) ([]log.Field, bool) {
+	var dropped uint64
+	if s := l.Sampler(); s != nil {
+		ok, n := s.Check(level, msg)
+		if !ok {
+			return fields, false
+		}
+		dropped += n
+	}
+	if p != nil && p.sampler != nil {
+		ok, n := p.sampler.Check(level, msg)
+		if !ok {
+			return fields, false
+		}
+		dropped += n
+	}
+	if dropped > 0 {
+		// 上一周期被丢弃的数量附加在新周期的第一条日志上
+		fields = appendField(fields, log.Uint64("sampled_out", dropped))
+	}
+	return fields, true
+}
+
+// 必须由Publish直接调用，调用栈深度依赖于此
+// DefaultCallDepth对应直接调用Logger方法，其他入口以log.CallerSkip给出额外层数；已有caller、stacktrace时不重复添加
+func (sl *logPane) annotate(p *writerPolicy, level log.Level, fields []log.Field) []log.Field {
+	if p == nil {
+		return fields
+	}
+	skip := log.CallerSkipOf(fields)
+	if skip < 0 {
+		return fields
+	}
+	depth := log.DefaultCallDepth + skip
+	if p.caller && !hasField(fields, "caller") {
+		fields = appendField(fields, log.Caller(depth))
+	}
+	if level >= p.stackLevel && !hasField(fields, "stacktrace") {
+		fields = appendField(fields, log.StackTrace(depth))
+	}
+	return fields
+}
+
+// 不修改调用方的fields
+func appendField(fields []log.Field, f log.Field) []log.Field {
+	return append(fields[:len(fields):len(fields)], f)
+}
+
+func hasField(fields []log.Field, key string) bool {
+	for _, f := range fields {
+		if f.Key() == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (sl *logPane) Publish(l *log.Logger, level log.Level, msg string, fields []log.Field) {
-	if !sl.inited || sl.closed {
+	if !sl.inited || sl.isClosed() {
+		return
+	}
+	p := sl.writerPolicy(l.OutWriter())
+	fields, ok := sl.sample(l, p, level, msg, fields)
+	if !ok {
 		return
 	}
+	fields = sl.annotate(p, level, fields)
 	log := msgObjPool.Get().(*LogWrap)
 	log.When=  time.Now()
 	log.Level = level
@@ -160,7 +288,11 @@ func (sl *logPane) Publish(l *log.Logger, level log.Level, msg string, fields []
 	log.Msg = msg
 	log.Context = l.Context()
 	log.Fields = fields
-	sl.logChan <- log
+	select {
+	case sl.logChan <- log:
+	case <-sl.done:
+		msgObjPool.Put(log)
+	}
 }
 
 func (sl *logPane) pushToWriters(logname, outWriter, msg string, level log.Level, when time.Time, context, fields []log.Field) {
@@ -184,16 +316,60 @@ func (sl *logPane) flush() {
 	}
 }
 
+// 同步将logChan中的日志写入writer
+// 在输出goroutine中调用时(如writer内部的日志触发Panic)无法等待自身，直接返回
+func (sl *logPane) Flush() {
+	if !sl.inited || sl.isClosed() {
+		return
+	}
+	if goid() == atomic.LoadUint64(&sl.loopID) {
+		return
+	}
+	select {
+	case sl.signalChan <- "flush":
+	case <-sl.done:
+		return
+	}
+	select {
+	case <-sl.flushAck:
+	case <-sl.done:
+	}
+}
+
+// 输出剩余日志并关闭所有writer，logChan、signalChan不关闭，避免并发的Publish、Flush向已关闭的channel发送
 func (sl *logPane) Close() {
-	if !sl.inited || sl.closed {
+	sl.lock.Lock()
+	if !sl.inited || sl.isClosed() {
+		sl.lock.Unlock()
 		return
 	}
-	sl.closed = true
+	close(sl.done)
+	sl.lock.Unlock()
+
+	// signalChan容量为1，被flush占用时等待输出goroutine取走
 	sl.signalChan <- "close"
 	sl.wg.Wait()
-	close(sl.logChan)
+}
+
+func (sl *logPane) isClosed() bool {
+	select {
+	case <-sl.done:
+		return true
+	default:
+		return false
+	}
+}
 
-	close(sl.signalChan)
+// 当前goroutine的id，取自runtime.Stack的首行"goroutine 18 [running]:"
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
 }
 
 // log writer
@@ -215,6 +391,11 @@ func (lw *PBLogWriter) LogLevel() log.Level {
 	return lw.level
 }
 
+// 因采样被丢弃的日志数量
+func (lw *PBLogWriter) Suppressed() uint64 {
+	return lw.policy.sampler.Suppressed()
+}
+
 func (lw *PBLogWriter) Destroy() {
 	lw.wmu.Lock()
 	defer lw.wmu.Unlock()
@@ -0,0 +1,148 @@
+package log
+
+import (
+	stdlog "log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+func TestAnnotateCaller(t *testing.T) {
+	sl := &logPane{}
+	p := &writerPolicy{caller: true, stackLevel: log.LevelOff}
+	var got []log.Field
+	// 与Publish处于相同的调用栈深度
+	log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {
+		got = sl.annotate(p, level, fields)
+	})
+	defer log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {})
+
+	callers := func() []string {
+		var callers []string
+		for _, f := range got {
+			if f.Key() == "caller" {
+				enc := mapEncoder{}
+				f.Encode(enc)
+				callers = append(callers, enc["caller"].(string))
+			}
+		}
+		return callers
+	}
+
+	logf := log.New("[testcaller]")
+	restore := log.RedirectStdLog(logf, log.LevelInfo)
+	defer restore()
+	cases := []struct {
+		name string
+		fn   func()
+	}{
+		{"direct", func() { logf.Info("direct") }},
+		{"with", func() { logf.With(log.String("k", "v")).Warn("with") }},
+		{"stdlog", func() { log.NewStdLogger(logf, log.LevelInfo).Printf("stdlog") }},
+		{"redirect", func() { stdlog.Println("redirect") }},
+		{"logpanic", func() { logf.LogPanic("boom") }},
+		{"recover", func() {
+			defer logf.Recover()
+			panic("boom")
+		}},
+	}
+	for _, c := range cases {
+		got = nil
+		c.fn()
+		if cs := callers(); len(cs) != 1 || !strings.HasPrefix(cs[0], "log/logmgr_test.go:") {
+			t.Errorf("%s: caller must point at the test, got %v", c.name, cs)
+		}
+	}
+
+	// 转发的日志已带caller时不重复添加，CallerSkip(-1)时不从调用栈取
+	got = nil
+	logf.Log(log.LevelInfo, "forwarded", log.CallerSkip(-1))
+	if cs := callers(); len(cs) != 0 {
+		t.Errorf("forwarded entry must not get a caller from the stack, got %v", cs)
+	}
+	got = nil
+	logf.Log(log.LevelInfo, "forwarded", log.CallerSkip(-1), log.String("caller", "app.go:1"))
+	if cs := callers(); len(cs) != 1 || cs[0] != "app.go:1" {
+		t.Errorf("forwarded caller must be kept once, got %v", cs)
+	}
+}
+
+// writer输出时调用flush，模拟writer内部的日志触发Panic
+type flushingWriter struct {
+	flush func()
+	n     int
+}
+
+func (w *flushingWriter) Init(configor pbconfig.Configor) error { return nil }
+func (w *flushingWriter) SetLogLevel(level log.Level)           {}
+func (w *flushingWriter) Destroy()                              {}
+func (w *flushingWriter) WriteLog(logname, msg string, level log.Level, when time.Time, context, fields []log.Field) {
+	w.n++
+	w.flush()
+}
+
+func TestFlushClose(t *testing.T) {
+	configor, err := pbconfig.NewConfigData("json", []byte(`{"chanlen": 16, "adapter": "memory", "default": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := &logPane{}
+	sl.InitLog(configor)
+	w, err := sl.SetLogWriter("flushclose", configor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logf := log.New("[testflushclose]")
+
+	// 输出goroutine中的Flush不能等待自身
+	fw := &flushingWriter{flush: sl.Flush}
+	w.writer = fw
+	sl.Publish(logf, log.LevelInfo, "reentrant", nil)
+	done := make(chan struct{})
+	go func() {
+		sl.Flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush from the writer goroutine deadlocked")
+	}
+	if fw.n != 1 {
+		t.Fatalf("entry must be written once, got %d", fw.n)
+	}
+	w.writer = NewMemoryWriter(10)
+
+	// 与Close并发的Publish、Flush不能panic或阻塞
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				sl.Publish(logf, log.LevelInfo, "concurrent", nil)
+				if j%10 == 0 {
+					sl.Flush()
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	sl.Close()
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		sl.Flush()
+		sl.Close()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush or publish blocked after close")
+	}
+}
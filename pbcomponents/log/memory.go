@@ -0,0 +1,309 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"keywea.com/cloud/pblib/pb"
+	"keywea.com/cloud/pblib/pb/log"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+const defaultMemoryCapacity = 1000
+
+// MemoryEntry 内存中保存的一条日志
+type MemoryEntry struct {
+	Logger string                 `json:"logger"`
+	Level  log.Level              `json:"level"`
+	Msg    string                 `json:"msg"`
+	When   time.Time              `json:"time"`
+	Fields map[string]interface{} `json:"fields,omitempty"` // context与fields
+	Line   string                 `json:"line"`             // 与file writer相同格式的文本
+}
+
+// MemoryFilter 查询条件，零值字段不参与过滤
+type MemoryFilter struct {
+	Level  log.Level         // 最低级别
+	Logger string            // logger名称
+	Fields map[string]string // 字段值，按fmt.Sprint比较
+	Limit  int               // 最多返回最近的Limit条
+}
+
+// MemoryWriter implements ILogger and keeps the last N entries in a ring buffer.
+type MemoryWriter struct {
+	mu      sync.RWMutex
+	level   log.Level
+	entries []MemoryEntry
+	next    int
+	full    bool
+}
+
+func newMemoryWriter() ILogger {
+	return NewMemoryWriter(defaultMemoryCapacity)
+}
+
+func NewMemoryWriter(capacity int) *MemoryWriter {
+	if capacity <= 0 {
+		capacity = defaultMemoryCapacity
+	}
+	return &MemoryWriter{
+		level:   log.LevelDebug,
+		entries: make([]MemoryEntry, capacity),
+	}
+}
+
+// Init memory logger.
+//
+//	{
+//	"capacity":1000,
+//	"level":3
+//	}
+func (m *MemoryWriter) Init(configor pbconfig.Configor) error {
+	if configor == nil {
+		return nil
+	}
+	level, _ := configor.GetInt("level", log.LevelDebug)
+	capacity, _ := configor.GetInt("capacity", defaultMemoryCapacity)
+	if capacity <= 0 {
+		return fmt.Errorf("pblog: invalid memory capacity %d", capacity)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.level = log.Level(level)
+	m.entries = make([]MemoryEntry, capacity)
+	m.next = 0
+	m.full = false
+	return nil
+}
+
+func (m *MemoryWriter) SetLogLevel(level log.Level) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.level = level
+}
+
+func (m *MemoryWriter) WriteLog(logname, msg string, level log.Level, when time.Time, context, fields []log.Field) {
+	m.mu.RLock()
+	skip := level < m.level
+	m.mu.RUnlock()
+	if skip {
+		return
+	}
+
+	entry := MemoryEntry{
+		Logger: logname,
+		Level:  level,
+		Msg:    msg,
+		When:   when,
+		Fields: make(map[string]interface{}, len(context)+len(fields)),
+	}
+	var buf bytes.Buffer
+	FormatHeader(&buf, logname, when)
+	buf.WriteString(pb.SYMBOL_BLANK)
+	buf.WriteString(LevelPrefix[level])
+	if len(msg) > 0 {
+		buf.WriteString(pb.SYMBOL_BLANK)
+		buf.WriteString(msg)
+	}
+	enc := mapEncoder(entry.Fields)
+	wr := StrEncoder{&buf}
+	for _, fs := range [][]log.Field{context, fields} {
+		for _, f := range fs {
+			f.Encode(enc)
+			buf.WriteString(pb.SYMBOL_BLANK)
+			f.Encode(wr)
+		}
+	}
+	entry.Line = buf.String()
+
+	m.mu.Lock()
+	m.entries[m.next] = entry
+	m.next++
+	if m.next == len(m.entries) {
+		m.next = 0
+		m.full = true
+	}
+	m.mu.Unlock()
+}
+
+// Entries 按时间顺序返回满足条件的日志
+func (m *MemoryWriter) Entries(filter MemoryFilter) []MemoryEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ordered []MemoryEntry
+	if m.full {
+		ordered = append(ordered, m.entries[m.next:]...)
+	}
+	ordered = append(ordered, m.entries[:m.next]...)
+
+	result := make([]MemoryEntry, 0, len(ordered))
+	for _, e := range ordered {
+		if filter.match(e) {
+			result = append(result, e)
+		}
+	}
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result
+}
+
+// Len 当前保存的日志数量
+func (m *MemoryWriter) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.full {
+		return len(m.entries)
+	}
+	return m.next
+}
+
+// Reset 清空已保存的日志
+func (m *MemoryWriter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.entries {
+		m.entries[i] = MemoryEntry{}
+	}
+	m.next = 0
+	m.full = false
+}
+
+func (m *MemoryWriter) Destroy() {
+	m.Reset()
+}
+
+// ServeHTTP 以JSON输出日志，参数 level、logger、limit、field=key:value(可多个)
+//
+//	http.Handle("/debug/logs", memWriter)
+//	GET /debug/logs?level=3&limit=1000
+func (m *MemoryWriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := MemoryFilter{Logger: q.Get("logger")}
+	if v := q.Get("level"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+		filter.Level = log.Level(level)
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+	for _, kv := range q["field"] {
+		idx := strings.Index(kv, pb.SYMBOL_COLON)
+		if idx <= 0 {
+			http.Error(w, "invalid field "+kv, http.StatusBadRequest)
+			return
+		}
+		if filter.Fields == nil {
+			filter.Fields = make(map[string]string)
+		}
+		filter.Fields[kv[:idx]] = kv[idx+1:]
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(m.Entries(filter))
+}
+
+func (f MemoryFilter) match(e MemoryEntry) bool {
+	if e.Level < f.Level {
+		return false
+	}
+	if f.Logger != "" && e.Logger != f.Logger {
+		return false
+	}
+	for k, v := range f.Fields {
+		val, ok := e.Fields[k]
+		if !ok || fmt.Sprint(val) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 获取memory adapter的MemoryWriter，其他adapter返回nil
+func (lw *PBLogWriter) Memory() *MemoryWriter {
+	m, _ := lw.writer.(*MemoryWriter)
+	return m
+}
+
+// Capture 测试辅助：替换log.SetLogFunc，日志同步写入返回的MemoryWriter
+// 调用restore恢复为Capture前的输出
+//
+//	mem, restore := Capture(100)
+//	defer restore()
+func Capture(capacity int) (*MemoryWriter, func()) {
+	m := NewMemoryWriter(capacity)
+	prevLog, prevFlush := log.GetLogFunc(), log.GetFlushFunc()
+	log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {
+		m.WriteLog(l.Name(), msg, level, time.Now(), l.Context(), fields)
+	})
+	log.SetFlushFunc(nil)
+	return m, func() {
+		log.SetLogFunc(prevLog)
+		log.SetFlushFunc(prevFlush)
+	}
+}
+
+// 按字段保存原始值
+type mapEncoder map[string]interface{}
+
+func (e mapEncoder) EncodeBool(key string, val bool) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeFloat64(key string, val float64) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeInt(key string, val int) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeInt64(key string, val int64) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeDuration(key string, val time.Duration) {
+	e[key] = val.String()
+}
+
+func (e mapEncoder) EncodeUint(key string, val uint) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeUint64(key string, val uint64) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeString(key string, val string) {
+	e[key] = val
+}
+
+func (e mapEncoder) EncodeObject(key string, val interface{}) {
+	e[key] = fmt.Sprint(val)
+}
+
+func (e mapEncoder) EncodeType(key string, val reflect.Type) {
+	e[key] = fmt.Sprint(val)
+}
+
+func init() {
+	Register(AdapterMemory, newMemoryWriter)
+}
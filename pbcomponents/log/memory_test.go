@@ -0,0 +1,59 @@
+package log
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+func TestMemoryWriter(t *testing.T) {
+	mem, restore := Capture(3)
+	defer restore()
+
+	logf := log.New("[testmem]", log.String("app", "farm"))
+	logf.Info("one")
+	logf.Error("two", log.Int("code", 500))
+	logf.Warn("three")
+	logf.Error("four", log.Int("code", 404))
+
+	if mem.Len() != 3 {
+		t.Fatalf("kept %d entries, want 3", mem.Len())
+	}
+	errs := mem.Entries(MemoryFilter{Level: log.LevelError})
+	if len(errs) != 2 || errs[0].Msg != "two" || errs[1].Msg != "four" {
+		t.Fatalf("unexpected error entries %+v", errs)
+	}
+	byField := mem.Entries(MemoryFilter{Fields: map[string]string{"code": "404", "app": "farm"}})
+	if len(byField) != 1 || byField[0].Msg != "four" {
+		t.Fatalf("unexpected field query result %+v", byField)
+	}
+	if last := mem.Entries(MemoryFilter{Limit: 1}); len(last) != 1 || last[0].Msg != "four" {
+		t.Fatalf("unexpected limited result %+v", last)
+	}
+
+	rec := httptest.NewRecorder()
+	mem.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/logs?level=3&field=code:500", nil))
+	if !strings.Contains(rec.Body.String(), `"msg":"two"`) || strings.Contains(rec.Body.String(), `"msg":"four"`) {
+		t.Fatalf("unexpected http response %s", rec.Body.String())
+	}
+}
+
+func TestCaptureRestore(t *testing.T) {
+	var got []string
+	log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {
+		got = append(got, msg)
+	})
+	defer log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {})
+
+	logf := log.New("[testcapture]")
+	mem, restore := Capture(10)
+	logf.Info("captured")
+	restore()
+	logf.Info("restored")
+
+	if mem.Len() != 1 || len(got) != 1 || got[0] != "restored" {
+		t.Fatalf("restore must reinstall the previous log func, captured %d, got %v", mem.Len(), got)
+	}
+}
@@ -0,0 +1,495 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Dialect int
+
+const (
+	DialectMySQL Dialect = iota
+	DialectPostgres
+	DialectSQLite
+)
+
+var errEmptyInsert = errors.New("insert without values")
+
+// 按sqlx的驱动名识别方言，未知驱动按MySQL处理
+func DialectOf(driverName string) Dialect {
+	switch driverName {
+	case "postgres", "pgx", "pq-timeouts", "cloudsqlpostgres":
+		return DialectPostgres
+	case "sqlite3", "sqlite":
+		return DialectSQLite
+	}
+	return DialectMySQL
+}
+
+func (db *DS) Dialect() Dialect {
+	return DialectOf(db.Ds().DriverName())
+}
+
+// 引用标识符，a.b按两段分别引用，只有*不引用；表达式(如COUNT(*))使用Raw
+func (d Dialect) Quote(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, p := range parts {
+		if p == "*" {
+			continue
+		}
+		if d == DialectMySQL {
+			parts[i] = "`" + strings.Replace(p, "`", "``", -1) + "`"
+		} else {
+			parts[i] = `"` + strings.Replace(p, `"`, `""`, -1) + `"`
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// 将?占位符转换为方言的占位符
+func (d Dialect) Rebind(query string) string {
+	if d == DialectPostgres {
+		return sqlx.Rebind(sqlx.DOLLAR, query)
+	}
+	return query
+}
+
+// 可生成SQL的构造器
+type Sqlizer interface {
+	ToSQL(d Dialect) (string, []interface{}, error)
+}
+
+// 条件，以?作为占位符
+type Cond interface {
+	appendCond(buf *strings.Builder, d Dialect, args []interface{}) []interface{}
+}
+
+// 列等值条件，值为nil生成IS NULL，为slice生成IN，多列按列名排序后AND
+type Eq map[string]interface{}
+
+func (eq Eq) appendCond(buf *strings.Builder, d Dialect, args []interface{}) []interface{} {
+	cols := make([]string, 0, len(eq))
+	for c := range eq {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	for i, c := range cols {
+		if i > 0 {
+			buf.WriteString(" AND ")
+		}
+		buf.WriteString(d.Quote(c))
+		v := eq[c]
+		rv := reflect.ValueOf(v)
+		switch {
+		case v == nil:
+			buf.WriteString(" IS NULL")
+		case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8:
+			if rv.Len() == 0 {
+				// 空IN恒为假
+				buf.WriteString(" IN (NULL)")
+				continue
+			}
+			buf.WriteString(" IN (")
+			for j := 0; j < rv.Len(); j++ {
+				if j > 0 {
+					buf.WriteString(", ")
+				}
+				buf.WriteString("?")
+				args = append(args, rv.Index(j).Interface())
+			}
+			buf.WriteString(")")
+		default:
+			buf.WriteString(" = ?")
+			args = append(args, v)
+		}
+	}
+	return args
+}
+
+// 原样输出、不引用的SQL表达式，如 Select("id").Expr(Raw("COUNT(*)"))
+// 不得包含外部输入
+type Raw string
+
+type expr struct {
+	sql  string
+	args []interface{}
+}
+
+// 原始条件，如 Expr("age > ? OR vip = ?", 18, true)
+func Expr(sql string, args ...interface{}) Cond {
+	return expr{sql: sql, args: args}
+}
+
+func (e expr) appendCond(buf *strings.Builder, d Dialect, args []interface{}) []interface{} {
+	buf.WriteString(e.sql)
+	return append(args, e.args...)
+}
+
+type whereClause []Cond
+
+func (w whereClause) appendTo(buf *strings.Builder, d Dialect, args []interface{}) []interface{} {
+	if len(w) == 0 {
+		return args
+	}
+	buf.WriteString(" WHERE ")
+	for i, c := range w {
+		if i > 0 {
+			buf.WriteString(" AND ")
+		}
+		if len(w) > 1 {
+			buf.WriteString("(")
+		}
+		args = c.appendCond(buf, d, args)
+		if len(w) > 1 {
+			buf.WriteString(")")
+		}
+	}
+	return args
+}
+
+func quoteList(d Dialect, cols []string) string {
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = d.Quote(c)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// SelectBuilder
+type SelectBuilder struct {
+	columns []string
+	exprs   []Raw
+	table   string
+	where   whereClause
+	orderBy []string
+	limit   int64
+	offset  int64
+}
+
+// 不指定列时为*
+func Select(columns ...string) *SelectBuilder {
+	return &SelectBuilder{columns: columns, limit: -1}
+}
+
+// 在列之后追加原样输出的表达式
+func (b *SelectBuilder) Expr(exprs ...Raw) *SelectBuilder {
+	b.exprs = append(b.exprs, exprs...)
+	return b
+}
+
+func (b *SelectBuilder) From(table string) *SelectBuilder {
+	b.table = table
+	return b
+}
+
+// 多次调用以AND连接
+func (b *SelectBuilder) Where(cond Cond) *SelectBuilder {
+	b.where = append(b.where, cond)
+	return b
+}
+
+// 列名，只解析末尾的" ASC"、" DESC"，其余部分整体作为列名引用，如 OrderBy("created_at DESC", "id")
+func (b *SelectBuilder) OrderBy(columns ...string) *SelectBuilder {
+	b.orderBy = append(b.orderBy, columns...)
+	return b
+}
+
+func (b *SelectBuilder) Limit(limit int64) *SelectBuilder {
+	b.limit = limit
+	return b
+}
+
+func (b *SelectBuilder) Offset(offset int64) *SelectBuilder {
+	b.offset = offset
+	return b
+}
+
+func (b *SelectBuilder) ToSQL(d Dialect) (string, []interface{}, error) {
+	if b.table == "" {
+		return "", nil, errors.New("select without table")
+	}
+	var buf strings.Builder
+	buf.WriteString("SELECT ")
+	if len(b.columns) == 0 && len(b.exprs) == 0 {
+		buf.WriteString("*")
+	} else {
+		buf.WriteString(quoteList(d, b.columns))
+		for i, e := range b.exprs {
+			if i > 0 || len(b.columns) > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(string(e))
+		}
+	}
+	buf.WriteString(" FROM ")
+	buf.WriteString(d.Quote(b.table))
+	args := b.where.appendTo(&buf, d, nil)
+	if len(b.orderBy) > 0 {
+		buf.WriteString(" ORDER BY ")
+		for i, o := range b.orderBy {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			col, dir := o, ""
+			if idx := strings.LastIndex(o, " "); idx > 0 {
+				switch strings.ToUpper(o[idx+1:]) {
+				case "ASC", "DESC":
+					col, dir = o[:idx], " "+strings.ToUpper(o[idx+1:])
+				}
+			}
+			buf.WriteString(d.Quote(col))
+			buf.WriteString(dir)
+		}
+	}
+	if b.limit >= 0 {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.FormatInt(b.limit, 10))
+	} else if b.offset > 0 && d != DialectPostgres {
+		// MySQL、SQLite的OFFSET必须跟在LIMIT之后
+		if d == DialectMySQL {
+			buf.WriteString(" LIMIT 18446744073709551615")
+		} else {
+			buf.WriteString(" LIMIT -1")
+		}
+	}
+	if b.offset > 0 {
+		buf.WriteString(" OFFSET ")
+		buf.WriteString(strconv.FormatInt(b.offset, 10))
+	}
+	return d.Rebind(buf.String()), args, nil
+}
+
+func (b *SelectBuilder) Get(ctx context.Context, ds *DS, dest interface{}) error {
+	query, args, err := b.ToSQL(ds.Dialect())
+	if err != nil {
+		return err
+	}
+	return ds.GetContext(ctx, dest, query, args...)
+}
+
+func (b *SelectBuilder) Select(ctx context.Context, ds *DS, dest interface{}) error {
+	query, args, err := b.ToSQL(ds.Dialect())
+	if err != nil {
+		return err
+	}
+	return ds.SelectContext(ctx, dest, query, args...)
+}
+
+// InsertBuilder，多次Values为批量插入
+type InsertBuilder struct {
+	table     string
+	columns   []string
+	values    [][]interface{}
+	conflict  []string // 冲突判断的列，PostgreSQL、SQLite需要
+	update    []string // 冲突时更新的列
+	ignore    bool     // 冲突时忽略
+	returning []string // PostgreSQL、SQLite返回的列
+}
+
+func Insert(table string) *InsertBuilder {
+	return &InsertBuilder{table: table}
+}
+
+func (b *InsertBuilder) Columns(columns ...string) *InsertBuilder {
+	b.columns = columns
+	return b
+}
+
+func (b *InsertBuilder) Values(values ...interface{}) *InsertBuilder {
+	b.values = append(b.values, values)
+	return b
+}
+
+// 冲突时更新updateColumns为插入的值，即upsert
+// MySQL按主键或唯一索引判断冲突，忽略conflictColumns
+func (b *InsertBuilder) OnConflictUpdate(conflictColumns []string, updateColumns ...string) *InsertBuilder {
+	b.conflict = conflictColumns
+	b.update = updateColumns
+	return b
+}
+
+// 冲突时忽略
+func (b *InsertBuilder) OnConflictIgnore(conflictColumns ...string) *InsertBuilder {
+	b.conflict = conflictColumns
+	b.ignore = true
+	return b
+}
+
+// MySQL不支持
+func (b *InsertBuilder) Returning(columns ...string) *InsertBuilder {
+	b.returning = columns
+	return b
+}
+
+func (b *InsertBuilder) ToSQL(d Dialect) (string, []interface{}, error) {
+	if b.table == "" || len(b.columns) == 0 || len(b.values) == 0 {
+		return "", nil, errEmptyInsert
+	}
+	if len(b.returning) > 0 && d == DialectMySQL {
+		return "", nil, errors.New("mysql does not support RETURNING")
+	}
+	var buf strings.Builder
+	if b.ignore && d == DialectMySQL {
+		buf.WriteString("INSERT IGNORE INTO ")
+	} else {
+		buf.WriteString("INSERT INTO ")
+	}
+	buf.WriteString(d.Quote(b.table))
+	buf.WriteString(" (")
+	buf.WriteString(quoteList(d, b.columns))
+	buf.WriteString(") VALUES ")
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(b.columns)), ", ") + ")"
+	args := make([]interface{}, 0, len(b.columns)*len(b.values))
+	for i, row := range b.values {
+		if len(row) != len(b.columns) {
+			return "", nil, fmt.Errorf("insert row %d has %d values, want %d", i, len(row), len(b.columns))
+		}
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(placeholders)
+		args = append(args, row...)
+	}
+
+	switch {
+	case len(b.update) > 0 && d == DialectMySQL:
+		buf.WriteString(" ON DUPLICATE KEY UPDATE ")
+		for i, c := range b.update {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(d.Quote(c) + " = VALUES(" + d.Quote(c) + ")")
+		}
+	case len(b.update) > 0:
+		if len(b.conflict) == 0 {
+			return "", nil, errors.New("upsert requires conflict columns")
+		}
+		buf.WriteString(" ON CONFLICT (" + quoteList(d, b.conflict) + ") DO UPDATE SET ")
+		for i, c := range b.update {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(d.Quote(c) + " = EXCLUDED." + d.Quote(c))
+		}
+	case b.ignore && d != DialectMySQL:
+		buf.WriteString(" ON CONFLICT")
+		if len(b.conflict) > 0 {
+			buf.WriteString(" (" + quoteList(d, b.conflict) + ")")
+		}
+		buf.WriteString(" DO NOTHING")
+	}
+	if len(b.returning) > 0 {
+		buf.WriteString(" RETURNING " + quoteList(d, b.returning))
+	}
+	return d.Rebind(buf.String()), args, nil
+}
+
+func (b *InsertBuilder) Exec(ctx context.Context, ds *DS) (sql.Result, error) {
+	return execBuilder(ctx, ds, b)
+}
+
+// UpdateBuilder
+type UpdateBuilder struct {
+	table   string
+	columns []string
+	values  []interface{}
+	where   whereClause
+}
+
+func Update(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+func (b *UpdateBuilder) Set(column string, value interface{}) *UpdateBuilder {
+	b.columns = append(b.columns, column)
+	b.values = append(b.values, value)
+	return b
+}
+
+// 按列名排序后Set
+func (b *UpdateBuilder) SetMap(values map[string]interface{}) *UpdateBuilder {
+	cols := make([]string, 0, len(values))
+	for c := range values {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	for _, c := range cols {
+		b.Set(c, values[c])
+	}
+	return b
+}
+
+func (b *UpdateBuilder) Where(cond Cond) *UpdateBuilder {
+	b.where = append(b.where, cond)
+	return b
+}
+
+func (b *UpdateBuilder) ToSQL(d Dialect) (string, []interface{}, error) {
+	if b.table == "" || len(b.columns) == 0 {
+		return "", nil, errors.New("update without table or columns")
+	}
+	var buf strings.Builder
+	buf.WriteString("UPDATE ")
+	buf.WriteString(d.Quote(b.table))
+	buf.WriteString(" SET ")
+	for i, c := range b.columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(d.Quote(c) + " = ?")
+	}
+	args := append([]interface{}{}, b.values...)
+	args = b.where.appendTo(&buf, d, args)
+	return d.Rebind(buf.String()), args, nil
+}
+
+func (b *UpdateBuilder) Exec(ctx context.Context, ds *DS) (sql.Result, error) {
+	return execBuilder(ctx, ds, b)
+}
+
+// DeleteBuilder
+type DeleteBuilder struct {
+	table string
+	where whereClause
+}
+
+func Delete(table string) *DeleteBuilder {
+	return &DeleteBuilder{table: table}
+}
+
+func (b *DeleteBuilder) Where(cond Cond) *DeleteBuilder {
+	b.where = append(b.where, cond)
+	return b
+}
+
+func (b *DeleteBuilder) ToSQL(d Dialect) (string, []interface{}, error) {
+	if b.table == "" {
+		return "", nil, errors.New("delete without table")
+	}
+	var buf strings.Builder
+	buf.WriteString("DELETE FROM ")
+	buf.WriteString(d.Quote(b.table))
+	args := b.where.appendTo(&buf, d, nil)
+	return d.Rebind(buf.String()), args, nil
+}
+
+func (b *DeleteBuilder) Exec(ctx context.Context, ds *DS) (sql.Result, error) {
+	return execBuilder(ctx, ds, b)
+}
+
+func execBuilder(ctx context.Context, ds *DS, b Sqlizer) (sql.Result, error) {
+	query, args, err := b.ToSQL(ds.Dialect())
+	if err != nil {
+		return nil, err
+	}
+	return ds.ExecContext(ctx, query, args...)
+}
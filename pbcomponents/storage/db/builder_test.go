@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBuilderDialects(t *testing.T) {
+	cases := []struct {
+		b    Sqlizer
+		want [3]string // mysql, postgres, sqlite
+		args []interface{}
+	}{
+		{
+			b: Select("id", "name").From("users").Where(Eq{"status": 1, "role": []string{"a", "b"}}).
+				Where(Expr("age > ? OR vip = ?", 18, true)).OrderBy("created_at DESC", "id").Limit(10).Offset(20),
+			want: [3]string{
+				"SELECT `id`, `name` FROM `users` WHERE (`role` IN (?, ?) AND `status` = ?) AND (age > ? OR vip = ?) ORDER BY `created_at` DESC, `id` LIMIT 10 OFFSET 20",
+				`SELECT "id", "name" FROM "users" WHERE ("role" IN ($1, $2) AND "status" = $3) AND (age > $4 OR vip = $5) ORDER BY "created_at" DESC, "id" LIMIT 10 OFFSET 20`,
+				`SELECT "id", "name" FROM "users" WHERE ("role" IN (?, ?) AND "status" = ?) AND (age > ? OR vip = ?) ORDER BY "created_at" DESC, "id" LIMIT 10 OFFSET 20`,
+			},
+			args: []interface{}{"a", "b", 1, 18, true},
+		},
+		{
+			b: Select().Expr(Raw("COUNT(*)")).From("users").Where(Eq{"deleted_at": nil}).Offset(5),
+			want: [3]string{
+				"SELECT COUNT(*) FROM `users` WHERE `deleted_at` IS NULL LIMIT 18446744073709551615 OFFSET 5",
+				`SELECT COUNT(*) FROM "users" WHERE "deleted_at" IS NULL OFFSET 5`,
+				`SELECT COUNT(*) FROM "users" WHERE "deleted_at" IS NULL LIMIT -1 OFFSET 5`,
+			},
+		},
+		{
+			b: Insert("users").Columns("id", "name").Values(1, "a").Values(2, "b").
+				OnConflictUpdate([]string{"id"}, "name"),
+			want: [3]string{
+				"INSERT INTO `users` (`id`, `name`) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE `name` = VALUES(`name`)",
+				`INSERT INTO "users" ("id", "name") VALUES ($1, $2), ($3, $4) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name"`,
+				`INSERT INTO "users" ("id", "name") VALUES (?, ?), (?, ?) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name"`,
+			},
+			args: []interface{}{1, "a", 2, "b"},
+		},
+		{
+			b: Insert("users").Columns("id").Values(1).OnConflictIgnore("id"),
+			want: [3]string{
+				"INSERT IGNORE INTO `users` (`id`) VALUES (?)",
+				`INSERT INTO "users" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING`,
+				`INSERT INTO "users" ("id") VALUES (?) ON CONFLICT ("id") DO NOTHING`,
+			},
+			args: []interface{}{1},
+		},
+		{
+			b: Update("users").SetMap(map[string]interface{}{"name": "x", "age": 3}).Where(Eq{"id": 7}),
+			want: [3]string{
+				"UPDATE `users` SET `age` = ?, `name` = ? WHERE `id` = ?",
+				`UPDATE "users" SET "age" = $1, "name" = $2 WHERE "id" = $3`,
+				`UPDATE "users" SET "age" = ?, "name" = ? WHERE "id" = ?`,
+			},
+			args: []interface{}{3, "x", 7},
+		},
+		{
+			b: Delete("users").Where(Eq{"id": 7}),
+			want: [3]string{
+				"DELETE FROM `users` WHERE `id` = ?",
+				`DELETE FROM "users" WHERE "id" = $1`,
+				`DELETE FROM "users" WHERE "id" = ?`,
+			},
+			args: []interface{}{7},
+		},
+		{
+			// 标识符始终引用，只有Raw原样输出
+			b: Select("a.*", "b c").Expr(Raw("COUNT(*)")).From("users").Where(Eq{"1=1) OR (1": 1}).
+				OrderBy("weird name desc", "x) OR (1 ASC"),
+			want: [3]string{
+				"SELECT `a`.*, `b c`, COUNT(*) FROM `users` WHERE `1=1) OR (1` = ? ORDER BY `weird name` DESC, `x) OR (1` ASC",
+				`SELECT "a".*, "b c", COUNT(*) FROM "users" WHERE "1=1) OR (1" = $1 ORDER BY "weird name" DESC, "x) OR (1" ASC`,
+				`SELECT "a".*, "b c", COUNT(*) FROM "users" WHERE "1=1) OR (1" = ? ORDER BY "weird name" DESC, "x) OR (1" ASC`,
+			},
+			args: []interface{}{1},
+		},
+	}
+	for i, c := range cases {
+		for d, want := range c.want {
+			query, args, err := c.b.ToSQL(Dialect(d))
+			if err != nil {
+				t.Fatalf("case %d dialect %d: %v", i, d, err)
+			}
+			if query != want {
+				t.Fatalf("case %d dialect %d:\n got %s\nwant %s", i, d, query, want)
+			}
+			if len(args) != 0 || len(c.args) != 0 {
+				if !reflect.DeepEqual(args, c.args) {
+					t.Fatalf("case %d dialect %d: args %v, want %v", i, d, args, c.args)
+				}
+			}
+		}
+	}
+
+	if _, _, err := Insert("users").Columns("id").Values(1).Returning("id").ToSQL(DialectMySQL); err == nil {
+		t.Fatal("mysql must reject RETURNING")
+	}
+	if _, _, err := Insert("users").Columns("id", "name").Values(1).ToSQL(DialectSQLite); err == nil {
+		t.Fatal("row with missing values must be rejected")
+	}
+}
+
+type testUser struct {
+	ID    int64          `db:"id,pk,auto"`
+	Name  string         `db:"name"`
+	Email sql.NullString `db:"email"`
+}
+
+func TestRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := newTestDS(t, "repository", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": filepath.Join(dir, "repo.db"),
+	})
+	defer ds.Destroy()
+	ds.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, email TEXT)")
+
+	repo, err := NewRepository(ds, "users", testUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	u := &testUser{Name: "a"}
+	if err := repo.Insert(ctx, u); err != nil || u.ID != 1 {
+		t.Fatalf("insert must fill auto id: %+v, %v", u, err)
+	}
+	if err := repo.Insert(ctx, &testUser{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	u.Email = sql.NullString{String: "a@b.c", Valid: true}
+	if n, err := repo.Update(ctx, u); err != nil || n != 1 {
+		t.Fatalf("update: %d, %v", n, err)
+	}
+	var got testUser
+	if err := repo.Get(ctx, &got, 1); err != nil || got != *u {
+		t.Fatalf("get: %+v, %v", got, err)
+	}
+
+	// upsert
+	_, err = Insert("users").Columns("id", "name").Values(2, "b2").Values(3, "c").
+		OnConflictUpdate([]string{"id"}, "name").Exec(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := Select("name").From("users").OrderBy("id").Select(ctx, ds, &names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b2", "c"}) {
+		t.Fatalf("unexpected names after upsert %v", names)
+	}
+
+	if n, err := repo.Delete(ctx, 1); err != nil || n != 1 {
+		t.Fatalf("delete: %d, %v", n, err)
+	}
+	if err := repo.Get(ctx, &got, 1); err != sql.ErrNoRows {
+		t.Fatalf("deleted row must be gone, got %v", err)
+	}
+	if _, err := NewRepository(ds, "x", struct {
+		Name string `db:"name"`
+	}{}); err == nil {
+		t.Fatal("model without primary key must be rejected")
+	}
+}
+
+// 以postgres方言注册的假驱动，记录每条语句在哪个dsn上执行，查询返回一行id=42
+type recordDriver struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+var testRecordDriver = &recordDriver{}
+
+func init() {
+	sql.Register("cloudsqlpostgres", testRecordDriver)
+}
+
+func (d *recordDriver) Open(dsn string) (driver.Conn, error) {
+	return &recordConn{d: d, dsn: dsn}, nil
+}
+
+func (d *recordDriver) record(dsn, query string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logs = append(d.logs, dsn+": "+query)
+}
+
+func (d *recordDriver) reset() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	logs := d.logs
+	d.logs = nil
+	return logs
+}
+
+type recordConn struct {
+	d   *recordDriver
+	dsn string
+}
+
+func (c *recordConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordStmt{c: c, query: query}, nil
+}
+
+func (c *recordConn) Close() error { return nil }
+
+func (c *recordConn) Begin() (driver.Tx, error) { return c, nil }
+
+func (c *recordConn) Commit() error { return nil }
+
+func (c *recordConn) Rollback() error { return nil }
+
+type recordStmt struct {
+	c     *recordConn
+	query string
+}
+
+func (s *recordStmt) Close() error { return nil }
+
+func (s *recordStmt) NumInput() int { return -1 }
+
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.d.record(s.c.dsn, s.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.d.record(s.c.dsn, s.query)
+	return &recordRows{}, nil
+}
+
+type recordRows struct {
+	done bool
+}
+
+func (r *recordRows) Columns() []string { return []string{"id"} }
+
+func (r *recordRows) Close() error { return nil }
+
+func (r *recordRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(42)
+	return nil
+}
+
+func TestRepositoryInsertReturningOnPrimary(t *testing.T) {
+	ds := newTestDS(t, "repository_returning", map[string]interface{}{
+		"driverName":           "cloudsqlpostgres",
+		"dataSourceName":       "primary",
+		"replicas":             []string{"replica"},
+		"replicaCheckInterval": 3600,
+	})
+	defer ds.Destroy()
+	repo, err := NewRepository(ds, "users", testUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordDriver.reset()
+
+	u := &testUser{Name: "a"}
+	if err := repo.Insert(context.Background(), u); err != nil || u.ID != 42 {
+		t.Fatalf("insert must fill id from RETURNING: %+v, %v", u, err)
+	}
+	want := []string{`primary: INSERT INTO "users" ("name", "email") VALUES ($1, $2) RETURNING "id"`}
+	if logs := testRecordDriver.reset(); !reflect.DeepEqual(logs, want) {
+		t.Fatalf("INSERT ... RETURNING must run on primary, got %q", logs)
+	}
+}
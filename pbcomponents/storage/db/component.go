@@ -1,19 +1,57 @@
 package db
 
 import (
+	"sync"
+
 	"keywea.com/cloud/pblib/pb/component"
+	"keywea.com/cloud/pblib/pb/events"
 )
 
+// 实例为*DS，数据源由组件持有的Registry管理
 type Component struct {
 	component.DefaultComponent
+
+	once     sync.Once
+	registry *Registry
+}
+
+func (dbc *Component) Registry() *Registry {
+	dbc.once.Do(func() {
+		dbc.registry = NewRegistry()
+		events.AddShutdownHook(func() error {
+			dbc.registry.Destroy()
+			return nil
+		}, events.SHUTDOWN_INDEX_DB)
+	})
+	return dbc.registry
 }
 
 func (dbc *Component) Create(instConfig *component.ComponentInstConfig) (interface{}, error) {
-	return NewDB(instConfig.Name, *instConfig.Config)
+	conf, err := ParseConfig(*instConfig.Config)
+	if err != nil {
+		return nil, err
+	}
+	return dbc.Registry().Open(instConfig.Name, conf)
+}
+
+// 配置migrateOnStart为true时执行migrationsDir中未执行的迁移
+func (dbc *Component) Start(inst interface{}, instConfig *component.ComponentInstConfig) error {
+	configor := *instConfig.Config
+	if migrate, _ := configor.GetBool("migrateOnStart"); !migrate {
+		return nil
+	}
+	return migrateOnStart(inst.(*DS), configor.GetString("migrationsDir", "migrations"),
+		configor.GetString("migrationsTable", DefaultMigrationsTable))
 }
 
 func (dbc *Component) Update(inst interface{}, instConfig *component.ComponentInstConfig) error {
-	r := inst.(*DS)
-	_, err := r.UpdatePool(instConfig.Name, r.ParseConfig(instConfig.Config))
-	return err
+	conf, err := ParseConfig(*instConfig.Config)
+	if err != nil {
+		return err
+	}
+	return inst.(*DS).UpdatePool(conf)
+}
+
+func (dbc *Component) Destroy(inst interface{}, instConfig *component.ComponentInstConfig) error {
+	return dbc.Registry().Close(inst.(*DS).Name())
 }
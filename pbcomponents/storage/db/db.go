@@ -1,165 +1,330 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/jmoiron/sqlx"
-	"keywea.com/cloud/pblib/pbconfig"
-	"keywea.com/cloud/pblib/pb/events"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/jmoiron/sqlx"
+	"keywea.com/cloud/pblib/pb/log"
+	"keywea.com/cloud/pblib/pbconfig"
 )
 
 var (
 	errNotFoundDatabaseSource = errors.New("database source Not Found")
-
-	pbdb *dss
-	dbmu sync.RWMutex
+	errDatabaseSourceClosed   = errors.New("database source closed")
+	errEmptyDataSourceName    = errors.New("database conf requires driverName and dataSourceName")
 )
 
+const defaultSwapGracePeriod = time.Minute
+
 type DsConf struct {
-	DriverName     	  string
-	DataSourceName 	  string
-	MaxOpenConns      int
-	MaxIdleConns      int
-	ConnMaxLifetime	  time.Duration // idletimeout
-}
+	DriverName      string
+	DataSourceName  string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration // idletimeout
 
-type dss struct {
-	datasources map[string]*DS
-	dsConfs map[string]DsConf
+	Replicas             []string      // 只读从库DSN，读操作按ReplicaPolicy分发
+	ReplicaPolicy        string        // roundrobin、leastconn，默认roundrobin
+	ReplicaCheckInterval time.Duration // 从库健康检查间隔
+
+	TxMaxRetries   int           // WithTx遇到死锁、序列化失败时的重试次数
+	TxRetryBackoff time.Duration // 重试初始退避，每次翻倍
+
+	SlowQueryThreshold time.Duration // 超过该耗时的查询输出日志，0关闭
 
-	mu sync.Mutex
+	SwapGracePeriod time.Duration // 连接池切换后旧连接池延迟关闭的时间，默认1分钟
 }
 
-type DS struct {
-	dsname string
-	db *sqlx.DB
+// 连接相关配置变化时需要新建连接池
+func (conf DsConf) needsReconnect(old DsConf) bool {
+	return old.DriverName != conf.DriverName || old.DataSourceName != conf.DataSourceName || !sameReplicas(old, conf)
+}
 
-	closed bool
-	dsmu sync.Mutex
+// 一组连接池，DSN变化时整体替换
+type pool struct {
+	conf     DsConf
+	db       *sqlx.DB
+	replicas *replicaSet
 }
 
-func NewDB(name string, configor pbconfig.Configor) (*DS, error) {
-	dbmu.Lock()
-	if pbdb == nil {
-		pbdb = &dss{
-			datasources: make(map[string]*DS),
-			dsConfs: make(map[string]DsConf),
+// 主库连接并ping成功才返回
+func openPool(dsname string, conf DsConf) (*pool, error) {
+	db, err := sqlx.Connect(conf.DriverName, conf.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	p := &pool{conf: conf, db: db}
+	p.tune(conf)
+	if len(conf.Replicas) > 0 {
+		p.replicas = newReplicaSet(dsname, conf)
+	}
+	return p, nil
+}
+
+func (p *pool) tune(conf DsConf) {
+	dbs := []*sqlx.DB{p.db}
+	if p.replicas != nil {
+		for _, r := range p.replicas.replicas {
+			dbs = append(dbs, r.db)
 		}
-		events.AddShutdownHook(func() error {
-			pbdb.Destroy()
-			return nil
-		}, events.SHUTDOWN_INDEX_DB)
 	}
-	dbmu.Unlock()
-	return pbdb.createDS(name, configor)
+	for _, db := range dbs {
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+		db.SetConnMaxLifetime(conf.ConnMaxLifetime)
+	}
+}
+
+// sql.DB.Close等待执行中的查询结束
+func (p *pool) close() error {
+	if p.replicas != nil {
+		p.replicas.Close()
+	}
+	return p.db.Close()
 }
 
-func (dm *dss) createDS(name string, configor pbconfig.Configor) (*DS, error) {
-	dm.mu.Lock()
-	defer dm.mu.Unlock()
+type DS struct {
+	dsname  string
+	current atomic.Value // *pool
+	stats   *dsStats
+
+	closed   bool
+	retiring map[*pool]*time.Timer // 等待关闭的旧连接池
+	dsmu     sync.Mutex            // 串行化UpdatePool、Destroy
+}
+
+// 创建不属于任何Registry的数据源
+func NewDB(name string, configor pbconfig.Configor) (*DS, error) {
 	if configor == nil {
 		return nil, fmt.Errorf("database source=%s create Error on nil configor", name)
 	}
-	config := dm.parseConfig(configor)
-	if db, ok := dm.datasources[name]; ok { // datasource exists
-		return db.UpdatePool(name, config)
+	conf, err := ParseConfig(configor)
+	if err != nil {
+		return nil, err
 	}
-	return dm.create(name, config)
+	return Open(name, conf)
 }
 
-func (dm *dss) create(dsname string, conf DsConf) (*DS, error) {
-	db, err := sqlx.Connect(conf.DriverName, conf.DataSourceName)
+func Open(dsname string, conf DsConf) (*DS, error) {
+	p, err := openPool(dsname, conf)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(conf.MaxOpenConns)
-	db.SetMaxIdleConns(conf.MaxIdleConns)
-	if conf.ConnMaxLifetime > 0 {
-		db.SetConnMaxLifetime(conf.ConnMaxLifetime)
-	}
-	dm.datasources[dsname] = &DS{
+	ds := &DS{
 		dsname: dsname,
-		db: db,
+		stats:  newDSStats(conf.SlowQueryThreshold),
 	}
-	dm.dsConfs[dsname] = conf
-	return dm.datasources[dsname], nil
+	ds.current.Store(p)
+	return ds, nil
 }
 
-func (dm *dss) parseConfig(configor pbconfig.Configor) DsConf {
+func ParseConfig(configor pbconfig.Configor) (DsConf, error) {
 	driverName := configor.GetString("driverName", "mysql")
 	dataSourceName := configor.GetString("dataSourceName", "")
 	if driverName == "" || dataSourceName == "" {
-		panic("parse database conf fatal")
+		return DsConf{}, errEmptyDataSourceName
 	}
 	maxOpenConns, _ := configor.GetInt("maxOpenConns", 50)
 	maxIdleConns, _ := configor.GetInt("maxIdleConns", 50)
 	connMaxLifetime, _ := configor.GetInt("connMaxLifetime", 0)
+	replicaCheckInterval, _ := configor.GetInt("replicaCheckInterval", 5)
+	txMaxRetries, _ := configor.GetInt("txMaxRetries", defaultTxMaxRetries)
+	txRetryBackoff, _ := configor.GetInt("txRetryBackoff", int(defaultTxRetryBackoff/time.Millisecond))
+	slowQueryThreshold, _ := configor.GetInt("slowQueryThreshold", int(defaultSlowQueryThreshold/time.Millisecond))
+	swapGracePeriod, _ := configor.GetInt("swapGracePeriod", int(defaultSwapGracePeriod/time.Second))
+	var replicas []string
+	if raw, err := configor.GetRawValue("replicas"); err == nil {
+		if list, ok := raw.([]interface{}); ok {
+			for _, v := range list {
+				if dsn, ok := v.(string); ok && dsn != "" {
+					replicas = append(replicas, dsn)
+				}
+			}
+		}
+	}
 
 	return DsConf{
-		DriverName: driverName,
-		DataSourceName: dataSourceName,
-		MaxOpenConns: maxOpenConns,
-		MaxIdleConns: maxIdleConns,
-		ConnMaxLifetime: time.Second*time.Duration(connMaxLifetime),
+		DriverName:           driverName,
+		DataSourceName:       dataSourceName,
+		MaxOpenConns:         maxOpenConns,
+		MaxIdleConns:         maxIdleConns,
+		ConnMaxLifetime:      time.Second * time.Duration(connMaxLifetime),
+		Replicas:             replicas,
+		ReplicaPolicy:        configor.GetString("replicaPolicy", ReplicaRoundRobin),
+		ReplicaCheckInterval: time.Second * time.Duration(replicaCheckInterval),
+		TxMaxRetries:         txMaxRetries,
+		TxRetryBackoff:       time.Millisecond * time.Duration(txRetryBackoff),
+		SlowQueryThreshold:   time.Millisecond * time.Duration(slowQueryThreshold),
+		SwapGracePeriod:      time.Second * time.Duration(swapGracePeriod),
+	}, nil
+}
+
+// Registry 按名称管理数据源，由组件持有
+type Registry struct {
+	datasources map[string]*DS
+
+	mu sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		datasources: make(map[string]*DS),
+	}
+}
+
+// 名称已存在时按conf更新该数据源
+func (r *Registry) Open(name string, conf DsConf) (*DS, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ds, ok := r.datasources[name]; ok {
+		return ds, ds.UpdatePool(conf)
+	}
+	ds, err := Open(name, conf)
+	if err != nil {
+		return nil, err
+	}
+	r.datasources[name] = ds
+	return ds, nil
+}
+
+func (r *Registry) Get(name string) (*DS, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ds, ok := r.datasources[name]
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", errNotFoundDatabaseSource, name)
 	}
+	return ds, nil
 }
 
-func (dm *dss) Get(name string) *DS {
-	p, ok := dm.datasources[name]
+// 关闭并移除
+func (r *Registry) Close(name string) error {
+	r.mu.Lock()
+	ds, ok := r.datasources[name]
+	delete(r.datasources, name)
+	r.mu.Unlock()
 	if !ok {
-		panic(errNotFoundDatabaseSource)
+		return fmt.Errorf("%v: %s", errNotFoundDatabaseSource, name)
 	}
-	return p
+	return ds.Destroy()
 }
 
-func (dm *dss) Destroy() {
-	for _, v := range dm.datasources {
-		err := v.Destroy()
-		if err != nil {
+func (r *Registry) Destroy() {
+	r.mu.Lock()
+	datasources := r.datasources
+	r.datasources = make(map[string]*DS)
+	r.mu.Unlock()
+	for name, ds := range datasources {
+		if err := ds.Destroy(); err != nil {
+			plog.Error("[DB] close database source failed", log.String("ds", name), log.Error(err))
 		}
 	}
 }
 
 // db
-func (db *DS) UpdatePool(dsname string, conf DsConf) (*DS, error) {
+func (db *DS) pool() *pool {
+	return db.current.Load().(*pool)
+}
+
+func (db *DS) Name() string {
+	return db.dsname
+}
+
+func (db *DS) Conf() DsConf {
+	return db.pool().conf
+}
+
+// DSN或从库变化时先建立并验证新连接池，新连接池失败时保留旧连接池
+// 切换后旧连接池在SwapGracePeriod后关闭，切换前取得的*sqlx.DB、事务在此期间仍可使用
+func (db *DS) UpdatePool(conf DsConf) error {
 	db.dsmu.Lock()
 	defer db.dsmu.Unlock()
+	if db.closed {
+		return errDatabaseSourceClosed
+	}
 
-	oldConfig := pbdb.dsConfs[dsname]
+	old := db.pool()
+	db.SetSlowQueryThreshold(conf.SlowQueryThreshold)
+	if !conf.needsReconnect(old.conf) {
+		next := *old
+		next.conf = conf
+		next.tune(conf)
+		db.current.Store(&next)
+		return nil
+	}
 
-	if oldConfig.DriverName != conf.DriverName || oldConfig.DataSourceName != conf.DataSourceName {
-		err := db.Destroy()
-		if err != nil {
-		}
-		delete(pbdb.datasources, dsname)
-		delete(pbdb.dsConfs, dsname)
-		return pbdb.create(dsname, conf)
+	p, err := openPool(db.dsname, conf)
+	if err != nil {
+		return err
 	}
+	db.current.Store(p)
+	plog.Info("[DB] database source switched", log.String("ds", db.dsname))
+	db.retire(old, conf.SwapGracePeriod)
+	return nil
+}
 
-	if conf.MaxOpenConns > 0 && oldConfig.MaxOpenConns != conf.MaxOpenConns {
-		db.db.SetMaxOpenConns(conf.MaxOpenConns)
+// 延迟关闭旧连接池，调用方持有dsmu
+func (db *DS) retire(old *pool, grace time.Duration) {
+	if grace <= 0 {
+		grace = defaultSwapGracePeriod
 	}
-	if conf.MaxIdleConns > 0 && oldConfig.MaxIdleConns != conf.MaxIdleConns {
-		db.db.SetMaxIdleConns(conf.MaxIdleConns)
+	if db.retiring == nil {
+		db.retiring = make(map[*pool]*time.Timer)
 	}
-	if conf.ConnMaxLifetime > 0 && oldConfig.ConnMaxLifetime != conf.ConnMaxLifetime {
-		db.db.SetConnMaxLifetime(conf.ConnMaxLifetime)
+	db.retiring[old] = time.AfterFunc(grace, func() {
+		db.dsmu.Lock()
+		_, ok := db.retiring[old]
+		delete(db.retiring, old)
+		db.dsmu.Unlock()
+		if ok {
+			db.closeRetired(old)
+		}
+	})
+}
+
+func (db *DS) closeRetired(old *pool) {
+	if err := old.close(); err != nil {
+		plog.Warn("[DB] close old pool failed", log.String("ds", db.dsname), log.Error(err))
 	}
+}
 
-	delete(pbdb.dsConfs, dsname)
-	pbdb.dsConfs[dsname] = conf
+// 主库
+func (db *DS) Ds() *sqlx.DB {
+	return db.pool().db
+}
 
-	return db, nil
+// 选择一个可用从库，没有配置或全部不可用时返回主库
+func (db *DS) Replica() *sqlx.DB {
+	p := db.pool()
+	if p.replicas != nil {
+		if r := p.replicas.pick(); r != nil {
+			return r
+		}
+	}
+	return p.db
 }
 
-func (db *DS) ParseConfig(configor *pbconfig.Configor) DsConf {
-	return pbdb.parseConfig(*configor)
+// ctx中有事务时在事务内执行
+func (db *DS) reader(ctx context.Context) sqlx.QueryerContext {
+	if tx, ok := TxFromContext(ctx, db); ok {
+		return tx.Tx
+	}
+	if usePrimary(ctx) {
+		return db.Ds()
+	}
+	return db.Replica()
 }
 
-func (db *DS) Ds() *sqlx.DB {
-	return db.db
+func (db *DS) writer(ctx context.Context) sqlx.ExtContext {
+	if tx, ok := TxFromContext(ctx, db); ok {
+		return tx.Tx
+	}
+	return db.Ds()
 }
 
 func (db *DS) Destroy() error {
@@ -170,5 +335,23 @@ func (db *DS) Destroy() error {
 		return nil
 	}
 	db.closed = true
-	return db.db.Close()
-}
\ No newline at end of file
+	for old, timer := range db.retiring {
+		timer.Stop()
+		db.closeRetired(old)
+	}
+	db.retiring = nil
+	return db.pool().close()
+}
+
+func sameReplicas(a, b DsConf) bool {
+	if a.ReplicaPolicy != b.ReplicaPolicy || a.ReplicaCheckInterval != b.ReplicaCheckInterval ||
+		len(a.Replicas) != len(b.Replicas) {
+		return false
+	}
+	for i := range a.Replicas {
+		if a.Replicas[i] != b.Replicas[i] {
+			return false
+		}
+	}
+	return true
+}
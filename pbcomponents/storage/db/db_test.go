@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+// 每个sqlite文件建表t并写入一行name
+func newSQLiteFile(t *testing.T, dir, name string) string {
+	dsn := filepath.Join(dir, name+".db")
+	db, err := sqlx.Connect("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.MustExec("CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)")
+	db.MustExec("INSERT INTO t (name) VALUES (?)", name)
+	return dsn
+}
+
+func newTestDS(t *testing.T, name string, conf map[string]interface{}) *DS {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configor, err := pbconfig.NewConfigData("json", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := NewDB(name, configor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func readName(t *testing.T, ctx context.Context, ds *DS) string {
+	var name string
+	if err := ds.GetContext(ctx, &name, "SELECT name FROM t WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReplicaRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := newSQLiteFile(t, dir, "primary")
+	r1 := newSQLiteFile(t, dir, "r1")
+	r2 := newSQLiteFile(t, dir, "r2")
+
+	ds := newTestDS(t, "replica_routing", map[string]interface{}{
+		"driverName":           "sqlite3",
+		"dataSourceName":       primary,
+		"replicas":             []string{r1, r2},
+		"replicaCheckInterval": 3600,
+	})
+	defer ds.Destroy()
+
+	ctx := context.Background()
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[readName(t, ctx, ds)]++
+	}
+	if seen["r1"] != 2 || seen["r2"] != 2 {
+		t.Fatalf("reads must be spread over replicas by round-robin, got %v", seen)
+	}
+
+	if _, err := ds.Exec("UPDATE t SET name = ? WHERE id = 1", "written"); err != nil {
+		t.Fatal(err)
+	}
+	if name := readName(t, UsePrimary(ctx), ds); name != "written" {
+		t.Fatalf("writes must go to primary, got %q", name)
+	}
+
+	// 摘除r1
+	bad := ds.pool().replicas.replicas[0]
+	bad.db.Close()
+	ds.pool().replicas.check()
+	for i := 0; i < 3; i++ {
+		if name := readName(t, ctx, ds); name != "r2" {
+			t.Fatalf("ejected replica must not serve reads, got %q", name)
+		}
+	}
+
+	// r1恢复后重新加入
+	bad.db, err = sqlx.Open("sqlite3", r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.pool().replicas.check()
+	seen = map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[readName(t, ctx, ds)]++
+	}
+	if seen["r1"] != 2 {
+		t.Fatalf("recovered replica must rejoin, got %v", seen)
+	}
+
+	// 全部不可用时回退主库
+	for _, r := range ds.pool().replicas.replicas {
+		r.db.Close()
+	}
+	ds.pool().replicas.check()
+	if name := readName(t, ctx, ds); name != "written" {
+		t.Fatalf("reads must fall back to primary, got %q", name)
+	}
+}
+
+func TestReplicaLeastConn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := newTestDS(t, "replica_leastconn", map[string]interface{}{
+		"driverName":           "sqlite3",
+		"dataSourceName":       newSQLiteFile(t, dir, "primary"),
+		"replicas":             []string{newSQLiteFile(t, dir, "r1"), newSQLiteFile(t, dir, "r2")},
+		"replicaPolicy":        ReplicaLeastConn,
+		"replicaCheckInterval": 3600,
+	})
+	defer ds.Destroy()
+
+	// 占用一个连接的从库不再被选中
+	rows, err := ds.Queryx("SELECT name FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	rows.Next()
+	var busy string
+	if err := rows.Scan(&busy); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if name := readName(t, context.Background(), ds); name == busy {
+			t.Fatalf("least-connections must avoid the busy replica %q", busy)
+		}
+	}
+}
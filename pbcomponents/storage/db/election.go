@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+// 基于租约的选主，同一名称同时只有一个实例为leader，用于定时任务等只能单实例执行的场景
+//
+//	e := db.NewLeaderElector(db.NewLockManager(ds), "cron", 15*time.Second)
+//	e.OnStartedLeading = func(ctx context.Context, lease *db.Lease) { runJobs(ctx) }
+//	go e.Run(ctx)
+type LeaderElector struct {
+	m    *LockManager
+	name string
+	ttl  time.Duration
+
+	RenewInterval time.Duration // 续约间隔，默认TTL/3
+	RetryInterval time.Duration // 未当选时重试间隔，默认TTL/3
+
+	// 当选后在新goroutine中调用，失去leader时ctx被取消
+	OnStartedLeading func(ctx context.Context, lease *Lease)
+	// 失去leader(续约失败、租约过期或Run退出)时调用
+	OnStoppedLeading func()
+
+	leading int32
+}
+
+func NewLeaderElector(m *LockManager, name string, ttl time.Duration) *LeaderElector {
+	return &LeaderElector{
+		m:             m,
+		name:          name,
+		ttl:           ttl,
+		RenewInterval: ttl / 3,
+		RetryInterval: ttl / 3,
+	}
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// 循环竞选直到ctx结束，退出时释放持有的租约
+func (e *LeaderElector) Run(ctx context.Context) error {
+	for {
+		lease, err := e.m.TryAcquire(ctx, e.name, e.ttl)
+		if err == nil {
+			e.lead(ctx, lease)
+		} else if err != ErrLeaseHeld && ctx.Err() == nil {
+			plog.Warn("[DB] leader election failed", log.String("election", e.name), log.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.RetryInterval):
+		}
+	}
+}
+
+// 持有租约期间定时续约，返回时已不是leader
+// 在租约过期前一个RenewInterval仍未续约成功时放弃leader，数据库无响应时也不会与新leader同时执行
+func (e *LeaderElector) lead(ctx context.Context, lease *Lease) {
+	leaderCtx, cancel := context.WithCancel(ctx)
+	atomic.StoreInt32(&e.leading, 1)
+	plog.Info("[DB] became leader", log.String("election", e.name), log.String("owner", e.m.Owner),
+		log.Int64("token", lease.Token()))
+	expiry := time.AfterFunc(e.untilStepDown(lease), func() {
+		atomic.StoreInt32(&e.leading, 0)
+		cancel()
+	})
+	if e.OnStartedLeading != nil {
+		go e.OnStartedLeading(leaderCtx, lease)
+	}
+	defer func() {
+		expiry.Stop()
+		cancel()
+		atomic.StoreInt32(&e.leading, 0)
+		plog.Info("[DB] lost leadership", log.String("election", e.name), log.String("owner", e.m.Owner),
+			log.Int64("token", lease.Token()))
+		if e.OnStoppedLeading != nil {
+			e.OnStoppedLeading()
+		}
+	}()
+
+	ticker := time.NewTicker(e.RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-leaderCtx.Done():
+			if ctx.Err() == nil {
+				plog.Warn("[DB] leader lease not renewed before expiry", log.String("election", e.name),
+					log.Time("expires", lease.ExpiresAt()))
+				return
+			}
+			// ctx已取消，释放使用独立的ctx
+			releaseCtx, releaseCancel := context.WithTimeout(context.Background(), e.ttl)
+			if err := lease.Release(releaseCtx); err != nil && err != ErrLeaseLost {
+				plog.Warn("[DB] release leader lease failed", log.String("election", e.name), log.Error(err))
+			}
+			releaseCancel()
+			return
+		case <-ticker.C:
+		}
+		err := e.renew(leaderCtx, lease)
+		if err == nil {
+			// 定时器已触发时leaderCtx已取消，下一轮退出
+			expiry.Reset(e.untilStepDown(lease))
+			continue
+		}
+		if err == ErrLeaseLost {
+			return
+		}
+		// 数据库暂时不可用时在租约过期前继续重试
+		if leaderCtx.Err() == nil {
+			plog.Warn("[DB] renew leader lease failed", log.String("election", e.name), log.Error(err))
+		}
+	}
+}
+
+// 单次续约最长等到租约过期，驱动不响应ctx时也按时返回
+func (e *LeaderElector) renew(ctx context.Context, lease *Lease) error {
+	renewCtx, cancel := context.WithDeadline(ctx, lease.ExpiresAt())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- lease.Renew(renewCtx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-renewCtx.Done():
+		return renewCtx.Err()
+	}
+}
+
+// 距离放弃leader的时间，为租约过期前一个RenewInterval
+func (e *LeaderElector) untilStepDown(lease *Lease) time.Duration {
+	return time.Until(lease.ExpiresAt().Add(-e.RenewInterval))
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	DefaultLeasesTable = "leases"
+
+	defaultLeaseRetryInterval = time.Second
+)
+
+var (
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	ErrLeaseLost = errors.New("lease expired or taken over")
+)
+
+// 基于数据源的跨主机租约锁，每个名称在leases表中占一行
+// 过期时间使用各实例的本地时钟，时钟偏差应远小于TTL
+type LockManager struct {
+	ds *DS
+
+	Table         string        // 租约表
+	Owner         string        // 持有者标识，默认 host:pid:nanos
+	RetryInterval time.Duration // Acquire等待时的重试间隔
+
+	mu      sync.Mutex
+	ensured bool
+}
+
+func NewLockManager(ds *DS) *LockManager {
+	host, _ := os.Hostname()
+	return &LockManager{
+		ds:            ds,
+		Table:         DefaultLeasesTable,
+		Owner:         fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano()),
+		RetryInterval: defaultLeaseRetryInterval,
+	}
+}
+
+func (m *LockManager) ensureTable(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ensured {
+		return nil
+	}
+	_, err := m.ds.Ds().ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.Table+
+		" (name VARCHAR(255) PRIMARY KEY, owner VARCHAR(255) NOT NULL, token BIGINT NOT NULL, expires_at BIGINT NOT NULL)")
+	if err == nil {
+		m.ensured = true
+	}
+	return err
+}
+
+// 尝试获取租约，已被其他持有者持有且未过期时返回ErrLeaseHeld
+// 每次易主token加一，持有者写入外部资源时携带token，资源方拒绝较小的token即可防止过期持有者的写入
+func (m *LockManager) TryAcquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	db := m.ds.Ds()
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	// 释放时保留该行，token才能单调递增
+	if _, err := db.ExecContext(ctx, db.Rebind("INSERT INTO "+m.Table+" (name, owner, token, expires_at) VALUES (?, ?, 1, ?)"),
+		name, m.Owner, unixMilli(expires)); err == nil {
+		return &Lease{m: m, name: name, ttl: ttl, token: 1, expires: expires}, nil
+	}
+	result, err := db.ExecContext(ctx, db.Rebind("UPDATE "+m.Table+" SET owner = ?, token = token + 1, expires_at = ? WHERE name = ? AND expires_at < ?"),
+		m.Owner, unixMilli(expires), name, unixMilli(now))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrLeaseHeld
+	}
+	var token int64
+	if err := db.GetContext(ctx, &token, db.Rebind("SELECT token FROM "+m.Table+" WHERE name = ? AND owner = ?"), name, m.Owner); err != nil {
+		return nil, err
+	}
+	return &Lease{m: m, name: name, ttl: ttl, token: token, expires: expires}, nil
+}
+
+// 当前持有者，租约不存在或已过期时返回空串
+func (m *LockManager) Holder(ctx context.Context, name string) (string, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return "", err
+	}
+	db := m.ds.Ds()
+	var holder string
+	err := db.GetContext(ctx, &holder, db.Rebind("SELECT owner FROM "+m.Table+" WHERE name = ? AND expires_at >= ?"),
+		name, unixMilli(time.Now()))
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return holder, err
+}
+
+// 获取租约，被占用时每RetryInterval重试直到成功或ctx结束
+func (m *LockManager) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	for {
+		lease, err := m.TryAcquire(ctx, name, ttl)
+		if err != ErrLeaseHeld {
+			return lease, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(m.RetryInterval):
+		}
+	}
+}
+
+// 已持有的租约
+type Lease struct {
+	m     *LockManager
+	name  string
+	ttl   time.Duration
+	token int64
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func (l *Lease) Name() string {
+	return l.name
+}
+
+// fencing token，同一名称每次易主递增
+func (l *Lease) Token() int64 {
+	return l.token
+}
+
+// 本地记录的过期时间
+func (l *Lease) ExpiresAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.expires
+}
+
+// 按TTL延长租约，已过期或被他人接管时返回ErrLeaseLost
+func (l *Lease) Renew(ctx context.Context) error {
+	db := l.m.ds.Ds()
+	now := time.Now()
+	expires := now.Add(l.ttl)
+	result, err := db.ExecContext(ctx, db.Rebind("UPDATE "+l.m.Table+" SET expires_at = ? WHERE name = ? AND owner = ? AND token = ? AND expires_at >= ?"),
+		unixMilli(expires), l.name, l.m.Owner, l.token, unixMilli(now))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrLeaseLost
+	}
+	l.mu.Lock()
+	l.expires = expires
+	l.mu.Unlock()
+	return nil
+}
+
+// 释放租约，其他实例可立即获取
+func (l *Lease) Release(ctx context.Context) error {
+	db := l.m.ds.Ds()
+	result, err := db.ExecContext(ctx, db.Rebind("UPDATE "+l.m.Table+" SET expires_at = 0 WHERE name = ? AND owner = ? AND token = ?"),
+		l.name, l.m.Owner, l.token)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.expires = time.Time{}
+	l.mu.Unlock()
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		plog.Warn("[DB] release lease not held", log.String("ds", l.m.ds.dsname), log.String("lease", l.name),
+			log.Int64("token", l.token))
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
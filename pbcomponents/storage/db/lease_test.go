@@ -0,0 +1,278 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newLeaseDS(t *testing.T, dir string) *DS {
+	return newTestDS(t, "lease", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": filepath.Join(dir, "lease.db") + "?_busy_timeout=5000",
+		"maxOpenConns":   1,
+	})
+}
+
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := newLeaseDS(t, dir)
+	defer ds.Destroy()
+
+	ctx := context.Background()
+	a, b := NewLockManager(ds), NewLockManager(ds)
+	a.Owner, b.Owner = "a", "b"
+
+	la, err := a.TryAcquire(ctx, "job", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if la.Token() != 1 {
+		t.Fatalf("first lease must have token 1, got %d", la.Token())
+	}
+	if _, err := b.TryAcquire(ctx, "job", time.Second); err != ErrLeaseHeld {
+		t.Fatalf("held lease must not be acquired, got %v", err)
+	}
+	if holder, _ := b.Holder(ctx, "job"); holder != "a" {
+		t.Fatalf("holder must be a, got %q", holder)
+	}
+	if err := la.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 过期后被接管，token递增，旧持有者续约失败
+	time.Sleep(150 * time.Millisecond)
+	lb, err := b.TryAcquire(ctx, "job", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.Token() != 2 {
+		t.Fatalf("takeover must increase token, got %d", lb.Token())
+	}
+	if err := la.Renew(ctx); err != ErrLeaseLost {
+		t.Fatalf("expired lease must not renew, got %v", err)
+	}
+	if err := la.Release(ctx); err != ErrLeaseLost {
+		t.Fatalf("expired lease must not release others, got %v", err)
+	}
+
+	// 释放后立即可获取
+	if err := lb.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a.RetryInterval = 10 * time.Millisecond
+	la, err = a.Acquire(ctx, "job", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if la.Token() != 3 {
+		t.Fatalf("token must stay monotonic after release, got %d", la.Token())
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	b.RetryInterval = 10 * time.Millisecond
+	if _, err := b.Acquire(tctx, "job", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("acquire must wait until ctx done, got %v", err)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := newLeaseDS(t, dir)
+	defer ds.Destroy()
+
+	events := make(chan string, 10)
+	newElector := func(owner string) *LeaderElector {
+		m := NewLockManager(ds)
+		m.Owner = owner
+		e := NewLeaderElector(m, "cron", 300*time.Millisecond)
+		e.OnStartedLeading = func(ctx context.Context, lease *Lease) {
+			events <- "start " + owner
+			<-ctx.Done()
+		}
+		e.OnStoppedLeading = func() {
+			events <- "stop " + owner
+		}
+		return e
+	}
+	wait := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("want %q, got %q", want, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	ea, eb := newElector("a"), newElector("b")
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan struct{})
+	go func() {
+		ea.Run(ctxA)
+		close(doneA)
+	}()
+	wait("start a")
+	if !ea.IsLeader() {
+		t.Fatal("a must be leader")
+	}
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneB := make(chan struct{})
+	go func() {
+		eb.Run(ctxB)
+		close(doneB)
+	}()
+	defer func() {
+		cancelB()
+		<-doneB
+	}()
+	// 续约使a保持leader
+	time.Sleep(time.Second)
+	if eb.IsLeader() {
+		t.Fatal("b must not be leader while a renews")
+	}
+
+	// a退出时释放租约，b接任
+	cancelA()
+	wait("stop a")
+	<-doneA
+	wait("start b")
+	if ea.IsLeader() || !eb.IsLeader() {
+		t.Fatal("leadership must move to b")
+	}
+}
+
+// 续约语句阻塞到dsn对应的channel关闭且不响应ctx的假驱动，其他语句均影响一行
+type blockingDriver struct {
+	mu      sync.Mutex
+	unblock map[string]chan struct{}
+}
+
+var testBlockingDriver = &blockingDriver{unblock: make(map[string]chan struct{})}
+
+func init() {
+	sql.Register("blockingdb", testBlockingDriver)
+}
+
+// 返回新的dsn，调用返回的函数后阻塞的语句返回
+func (d *blockingDriver) newDSN() (string, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dsn := "blocking" + strconv.Itoa(len(d.unblock))
+	ch := make(chan struct{})
+	d.unblock[dsn] = ch
+	return dsn, func() { close(ch) }
+}
+
+func (d *blockingDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &blockingConn{unblock: d.unblock[dsn]}, nil
+}
+
+type blockingConn struct {
+	unblock chan struct{}
+}
+
+func (c *blockingConn) Prepare(query string) (driver.Stmt, error) {
+	return &blockingStmt{c: c, query: query}, nil
+}
+
+func (c *blockingConn) Close() error { return nil }
+
+func (c *blockingConn) Begin() (driver.Tx, error) { return c, nil }
+
+func (c *blockingConn) Commit() error { return nil }
+
+func (c *blockingConn) Rollback() error { return nil }
+
+type blockingStmt struct {
+	c     *blockingConn
+	query string
+}
+
+func (s *blockingStmt) Close() error { return nil }
+
+func (s *blockingStmt) NumInput() int { return -1 }
+
+func (s *blockingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.Contains(s.query, "SET expires_at = ? WHERE") {
+		<-s.c.unblock
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *blockingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+// 数据库无响应时，leader在租约过期前退出
+func TestLeaderElectionRenewBlocked(t *testing.T) {
+	dsn, unblock := testBlockingDriver.newDSN()
+	ds := newTestDS(t, "lease_blocking", map[string]interface{}{
+		"driverName":     "blockingdb",
+		"dataSourceName": dsn,
+	})
+	defer ds.Destroy()
+	defer unblock()
+
+	m := NewLockManager(ds)
+	e := NewLeaderElector(m, "cron", 300*time.Millisecond)
+	e.RetryInterval = time.Hour
+	stepped := make(chan time.Duration, 1)
+	e.OnStartedLeading = func(ctx context.Context, lease *Lease) {
+		<-ctx.Done()
+		stepped <- time.Until(lease.ExpiresAt())
+	}
+	stopped := make(chan struct{})
+	e.OnStoppedLeading = func() {
+		close(stopped)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case left := <-stepped:
+		if left <= 0 {
+			t.Fatalf("leader must step down before the lease expires, %v late", -left)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("leader kept running while renew was blocked")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("lead must return while renew is blocked")
+	}
+	if e.IsLeader() {
+		t.Fatal("elector must not report leadership after stepping down")
+	}
+}
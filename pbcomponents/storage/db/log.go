@@ -0,0 +1,13 @@
+package db
+
+import (
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+var (
+	plog = log.New("[DB].pbdb")
+)
+
+func SetLogLevel(level log.Level) {
+	plog.SetLevel(level)
+}
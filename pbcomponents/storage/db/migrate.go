@@ -0,0 +1,508 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	DefaultMigrationsTable = "schema_migrations"
+
+	defaultMigrateLockTimeout = 10 * time.Minute
+)
+
+var (
+	ErrMigrationLocked   = errors.New("migration lock is held by another instance")
+	ErrMigrationLockLost = errors.New("migration lock was taken over by another instance")
+	ErrChecksumMismatch  = errors.New("applied migration checksum mismatch")
+	ErrNoDownMigration   = errors.New("migration has no down step")
+
+	migrationFilename = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+)
+
+// 迁移失败的错误，Err为ErrMigrationLocked等哨兵错误或执行迁移时的错误
+// 调用方通过 MigrationCause(err) == ErrMigrationLocked 判断失败原因
+type MigrationError struct {
+	Op      string // up/down，校验阶段为空
+	Version int64
+	Name    string
+	Holder  string // 锁的持有者
+	Err     error
+}
+
+func (e *MigrationError) Error() string {
+	switch {
+	case e.Op != "":
+		return fmt.Sprintf("migrate %s version %d %s: %v", e.Op, e.Version, e.Name, e.Err)
+	case e.Holder != "":
+		return fmt.Sprintf("%v: %s", e.Err, e.Holder)
+	default:
+		return fmt.Sprintf("%v: version %d %s", e.Err, e.Version, e.Name)
+	}
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// err为*MigrationError时返回其Err，否则原样返回
+func MigrationCause(err error) error {
+	if e, ok := err.(*MigrationError); ok {
+		return e.Err
+	}
+	return err
+}
+
+// 一个版本的迁移，SQL与Go函数二选一，同时存在时先执行SQL
+// MySQL执行多条语句的SQL需要在DSN中开启multiStatements=true
+// MySQL的DDL会隐式提交事务，迁移失败时已执行的DDL不会回滚，每个迁移宜只包含一条DDL
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      func(tx *Tx) error
+	Down    func(tx *Tx) error
+}
+
+// Go函数迁移以Version、Name计算checksum
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", m.Version, m.Name, m.UpSQL)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *Migration) hasDown() bool {
+	return m.DownSQL != "" || m.Down != nil
+}
+
+// 迁移来源
+type Source interface {
+	Migrations() ([]*Migration, error)
+}
+
+type SourceFunc func() ([]*Migration, error)
+
+func (f SourceFunc) Migrations() ([]*Migration, error) {
+	return f()
+}
+
+// 目录中的 {version}_{name}.up.sql、{version}_{name}.down.sql
+func NewDirSource(dir string) Source {
+	return SourceFunc(func() ([]*Migration, error) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		files := make(map[string]string, len(infos))
+		for _, info := range infos {
+			if info.IsDir() || !migrationFilename.MatchString(info.Name()) {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			if err != nil {
+				return nil, err
+			}
+			files[info.Name()] = string(data)
+		}
+		return parseMigrationFiles(files)
+	})
+}
+
+// 文件名到内容，命名规则同NewDirSource，用于打包进二进制的迁移
+func NewMapSource(files map[string]string) Source {
+	return SourceFunc(func() ([]*Migration, error) {
+		return parseMigrationFiles(files)
+	})
+}
+
+// Go函数或手工构造的迁移
+func NewMigrationSource(migrations ...*Migration) Source {
+	return SourceFunc(func() ([]*Migration, error) {
+		return migrations, nil
+	})
+}
+
+func parseMigrationFiles(files map[string]string) ([]*Migration, error) {
+	byVersion := make(map[int64]*Migration)
+	for name, content := range files {
+		match := migrationFilename.FindStringSubmatch(filepath.Base(name))
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", name, err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d has different names %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.UpSQL = content
+		} else {
+			m.DownSQL = content
+		}
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.UpSQL == "" {
+			return nil, fmt.Errorf("migration version %d has no up step", m.Version)
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Dirty     bool // 已执行的迁移与来源的checksum不一致
+	Missing   bool // 已执行但来源中不存在
+}
+
+type Migrator struct {
+	ds     *DS
+	source Source
+
+	Table       string        // 记录已执行迁移的表，锁表为Table+"_lock"
+	LockTimeout time.Duration // 超过该时间未续期的锁视为失效，持有期间每LockTimeout/3续期；小于1ms时使用默认值
+	DryRun      bool          // 只输出计划执行的迁移，不执行
+}
+
+func NewMigrator(ds *DS, source Source) *Migrator {
+	return &Migrator{
+		ds:          ds,
+		source:      source,
+		Table:       DefaultMigrationsTable,
+		LockTimeout: defaultMigrateLockTimeout,
+	}
+}
+
+func (m *Migrator) lockTable() string {
+	return m.Table + "_lock"
+}
+
+// locked_at精度为毫秒，过小的LockTimeout无意义，也会使续期的ticker间隔为0
+func (m *Migrator) lockTimeout() time.Duration {
+	if m.LockTimeout < time.Millisecond {
+		return defaultMigrateLockTimeout
+	}
+	return m.LockTimeout
+}
+
+func (m *Migrator) ensureTables(ctx context.Context) error {
+	_, err := m.ds.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.Table+
+		" (version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum VARCHAR(64) NOT NULL, applied_at BIGINT NOT NULL)")
+	if err != nil {
+		return err
+	}
+	_, err = m.ds.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.lockTable()+
+		" (id INTEGER PRIMARY KEY, owner VARCHAR(255) NOT NULL, locked_at BIGINT NOT NULL)")
+	return err
+}
+
+// 持有中的迁移锁，ctx在锁被他人接管或释放时取消
+type migrationLock struct {
+	m       *Migrator
+	owner   string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	lost    int32
+	timeout time.Duration
+}
+
+type lockExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Rebind(query string) string
+}
+
+// 插入id=1的行作为跨进程锁，主键冲突表示锁已被持有；locked_at为毫秒时间戳
+// 持有期间后台续期，迁移较长时不会因超过LockTimeout被其他实例接管
+func (m *Migrator) lock(ctx context.Context) (*migrationLock, error) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	db := m.ds.Ds()
+	stale := unixMilli(time.Now().Add(-m.lockTimeout()))
+	if _, err := db.ExecContext(ctx, db.Rebind("DELETE FROM "+m.lockTable()+" WHERE id = 1 AND locked_at < ?"), stale); err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, db.Rebind("INSERT INTO "+m.lockTable()+" (id, owner, locked_at) VALUES (1, ?, ?)"),
+		owner, unixMilli(time.Now())); err != nil {
+		var holder string
+		if db.GetContext(ctx, &holder, "SELECT owner FROM "+m.lockTable()+" WHERE id = 1") == nil {
+			return nil, &MigrationError{Holder: holder, Err: ErrMigrationLocked}
+		}
+		return nil, err
+	}
+	lk := &migrationLock{m: m, owner: owner, done: make(chan struct{}), timeout: m.lockTimeout()}
+	lk.ctx, lk.cancel = context.WithCancel(ctx)
+	go lk.heartbeat()
+	return lk, nil
+}
+
+// 每LockTimeout/3刷新locked_at，锁已被接管时取消ctx，中止进行中的迁移
+func (lk *migrationLock) heartbeat() {
+	defer close(lk.done)
+	ticker := time.NewTicker(lk.timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lk.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := lk.touch(lk.ctx, lk.m.ds.Ds())
+		if err == ErrMigrationLockLost {
+			plog.Error("[DB] migration lock lost", log.String("ds", lk.m.ds.dsname), log.String("owner", lk.owner))
+			atomic.StoreInt32(&lk.lost, 1)
+			lk.cancel()
+			return
+		}
+		if err != nil && lk.ctx.Err() == nil {
+			plog.Warn("[DB] renew migration lock failed", log.String("ds", lk.m.ds.dsname), log.Error(err))
+		}
+	}
+}
+
+// 续期并确认仍持有锁，在迁移事务内调用时作为提交前的检查
+func (lk *migrationLock) touch(ctx context.Context, db lockExecer) error {
+	result, err := db.ExecContext(ctx, db.Rebind("UPDATE "+lk.m.lockTable()+" SET locked_at = ? WHERE id = 1 AND owner = ?"),
+		unixMilli(time.Now()), lk.owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMigrationLockLost
+	}
+	return nil
+}
+
+// 锁丢失时返回ErrMigrationLockLost，否则返回err
+func (lk *migrationLock) wrap(err error) error {
+	if atomic.LoadInt32(&lk.lost) == 1 {
+		return ErrMigrationLockLost
+	}
+	return err
+}
+
+func (lk *migrationLock) release() {
+	lk.cancel()
+	<-lk.done
+	db := lk.m.ds.Ds()
+	if _, err := db.Exec(db.Rebind("DELETE FROM "+lk.m.lockTable()+" WHERE id = 1 AND owner = ?"), lk.owner); err != nil {
+		plog.Error("[DB] release migration lock failed", log.String("ds", lk.m.ds.dsname), log.Error(err))
+	}
+}
+
+type appliedMigration struct {
+	Version   int64  `db:"version"`
+	Name      string `db:"name"`
+	Checksum  string `db:"checksum"`
+	AppliedAt int64  `db:"applied_at"`
+}
+
+func (m *Migrator) load(ctx context.Context) ([]*Migration, map[int64]appliedMigration, error) {
+	migrations, err := m.source.Migrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	var rows []appliedMigration
+	if err := m.ds.Ds().SelectContext(ctx, &rows, "SELECT version, name, checksum, applied_at FROM "+m.Table); err != nil {
+		return nil, nil, err
+	}
+	applied := make(map[int64]appliedMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return migrations, applied, nil
+}
+
+// 所有迁移的状态，按版本排序
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureTables(ctx); err != nil {
+		return nil, err
+	}
+	migrations, applied, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, mg := range migrations {
+		s := MigrationStatus{Version: mg.Version, Name: mg.Name}
+		if a, ok := applied[mg.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = time.Unix(a.AppliedAt, 0)
+			s.Dirty = a.Checksum != mg.Checksum()
+			delete(applied, mg.Version)
+		}
+		status = append(status, s)
+	}
+	for _, a := range applied {
+		status = append(status, MigrationStatus{Version: a.Version, Name: a.Name, Applied: true,
+			AppliedAt: time.Unix(a.AppliedAt, 0), Missing: true})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+// 执行所有未执行的迁移，返回本次执行(DryRun时为计划执行)的迁移
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	return m.UpTo(ctx, -1)
+}
+
+// 执行版本不大于version的未执行迁移，version<0表示全部
+// 每个迁移在单独的事务中执行，提交前确认仍持有迁移锁
+func (m *Migrator) UpTo(ctx context.Context, version int64) ([]*Migration, error) {
+	if err := m.ensureTables(ctx); err != nil {
+		return nil, err
+	}
+	lk, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lk.release()
+	ctx = lk.ctx
+
+	migrations, applied, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Migration
+	for _, mg := range migrations {
+		if a, ok := applied[mg.Version]; ok {
+			if a.Checksum != mg.Checksum() {
+				return nil, &MigrationError{Version: mg.Version, Name: mg.Name, Err: ErrChecksumMismatch}
+			}
+			continue
+		}
+		if version >= 0 && mg.Version > version {
+			break
+		}
+		pending = append(pending, mg)
+	}
+
+	for i, mg := range pending {
+		if m.DryRun {
+			plog.Info("[DB] migrate up (dry run)", log.String("ds", m.ds.dsname), log.Int64("version", mg.Version),
+				log.String("name", mg.Name), log.String("sql", mg.UpSQL))
+			continue
+		}
+		err := m.ds.WithTx(ctx, nil, func(tx *Tx) error {
+			if err := m.run(tx, mg.UpSQL, mg.Up); err != nil {
+				return err
+			}
+			if err := lk.touch(ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO "+m.Table+" (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)"),
+				mg.Version, mg.Name, mg.Checksum(), time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return pending[:i], &MigrationError{Op: "up", Version: mg.Version, Name: mg.Name, Err: lk.wrap(err)}
+		}
+		plog.Info("[DB] migrated up", log.String("ds", m.ds.dsname), log.Int64("version", mg.Version), log.String("name", mg.Name))
+	}
+	return pending, nil
+}
+
+// 回滚最近执行的steps个迁移
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	if err := m.ensureTables(ctx); err != nil {
+		return nil, err
+	}
+	lk, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lk.release()
+	ctx = lk.ctx
+
+	migrations, applied, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*Migration
+	for i := len(migrations) - 1; i >= 0 && len(targets) < steps; i-- {
+		if _, ok := applied[migrations[i].Version]; ok {
+			if !migrations[i].hasDown() {
+				return nil, &MigrationError{Version: migrations[i].Version, Name: migrations[i].Name, Err: ErrNoDownMigration}
+			}
+			targets = append(targets, migrations[i])
+		}
+	}
+
+	for i, mg := range targets {
+		if m.DryRun {
+			plog.Info("[DB] migrate down (dry run)", log.String("ds", m.ds.dsname), log.Int64("version", mg.Version),
+				log.String("name", mg.Name), log.String("sql", mg.DownSQL))
+			continue
+		}
+		err := m.ds.WithTx(ctx, nil, func(tx *Tx) error {
+			if err := m.run(tx, mg.DownSQL, mg.Down); err != nil {
+				return err
+			}
+			if err := lk.touch(ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM "+m.Table+" WHERE version = ?"), mg.Version)
+			return err
+		})
+		if err != nil {
+			return targets[:i], &MigrationError{Op: "down", Version: mg.Version, Name: mg.Name, Err: lk.wrap(err)}
+		}
+		plog.Info("[DB] migrated down", log.String("ds", m.ds.dsname), log.Int64("version", mg.Version), log.String("name", mg.Name))
+	}
+	return targets, nil
+}
+
+func (m *Migrator) run(tx *Tx, query string, fn func(tx *Tx) error) error {
+	if query != "" {
+		if _, err := tx.ExecContext(tx.Context(), query); err != nil {
+			return err
+		}
+	}
+	if fn != nil {
+		return fn(tx)
+	}
+	return nil
+}
+
+// 供Component在Start时迁移
+func migrateOnStart(ds *DS, dir, table string) error {
+	mg := NewMigrator(ds, NewDirSource(dir))
+	if table != "" {
+		mg.Table = table
+	}
+	_, err := mg.Up(context.Background())
+	return err
+}
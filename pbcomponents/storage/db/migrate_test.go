@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	migrations := filepath.Join(dir, "migrations")
+	os.Mkdir(migrations, 0755)
+	files := map[string]string{
+		"0001_create_users.up.sql":   "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);",
+		"0001_create_users.down.sql": "DROP TABLE users;",
+		"0002_add_email.up.sql":      "ALTER TABLE users ADD COLUMN email TEXT;",
+		"0002_add_email.down.sql":    "CREATE TABLE users_tmp (id INTEGER PRIMARY KEY, name TEXT); DROP TABLE users; ALTER TABLE users_tmp RENAME TO users;",
+		"README.md":                  "ignored",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(migrations, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds := newTestDS(t, "migrator", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": filepath.Join(dir, "migrate.db"),
+	})
+	defer ds.Destroy()
+	ctx := context.Background()
+	mg := NewMigrator(ds, NewDirSource(migrations))
+
+	mg.DryRun = true
+	planned, err := mg.Up(ctx)
+	if err != nil || len(planned) != 2 {
+		t.Fatalf("dry run must plan 2 migrations, got %d, %v", len(planned), err)
+	}
+	status, err := mg.Status(ctx)
+	if err != nil || len(status) != 2 || status[0].Applied || status[1].Applied {
+		t.Fatalf("dry run must not apply migrations: %+v, %v", status, err)
+	}
+
+	mg.DryRun = false
+	if applied, err := mg.Up(ctx); err != nil || len(applied) != 2 {
+		t.Fatalf("up must apply 2 migrations, got %d, %v", len(applied), err)
+	}
+	if _, err := ds.Exec("INSERT INTO users (name, email) VALUES ('a', 'a@b.c')"); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := mg.Up(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("up must be idempotent, got %d, %v", len(applied), err)
+	}
+
+	// 锁被其他实例持有
+	lk, err := NewMigrator(ds, NewDirSource(migrations)).lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mg.Up(ctx); MigrationCause(err) != ErrMigrationLocked {
+		t.Fatalf("expected lock error, got %v", err)
+	} else if err.(*MigrationError).Holder != lk.owner {
+		t.Fatalf("lock error must report the holder, got %v", err)
+	}
+	lk.release()
+
+	if reverted, err := mg.Down(ctx, 1); err != nil || len(reverted) != 1 || reverted[0].Version != 2 {
+		t.Fatalf("down must revert version 2, got %v, %v", reverted, err)
+	}
+	status, _ = mg.Status(ctx)
+	if !status[0].Applied || status[1].Applied {
+		t.Fatalf("unexpected status after down: %+v", status)
+	}
+
+	// 修改已执行的迁移
+	ioutil.WriteFile(filepath.Join(migrations, "0001_create_users.up.sql"), []byte("CREATE TABLE users (id INTEGER);"), 0644)
+	status, _ = mg.Status(ctx)
+	if !status[0].Dirty {
+		t.Fatalf("changed migration must be dirty: %+v", status[0])
+	}
+	if _, err := mg.Up(ctx); MigrationCause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+}
+
+func TestMigratorGoFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := newTestDS(t, "migrator_func", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": filepath.Join(dir, "migrate.db"),
+	})
+	defer ds.Destroy()
+
+	mg := NewMigrator(ds, NewMigrationSource(&Migration{
+		Version: 1,
+		Name:    "seed",
+		UpSQL:   "CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)",
+		Up: func(tx *Tx) error {
+			_, err := tx.Exec("INSERT INTO kv (k, v) VALUES ('version', '1')")
+			return err
+		},
+	}))
+	if _, err := mg.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := ds.Get(&v, "SELECT v FROM kv WHERE k = 'version'"); err != nil || v != "1" {
+		t.Fatalf("go migration not applied: %q, %v", v, err)
+	}
+	if _, err := mg.Down(context.Background(), 1); err == nil {
+		t.Fatal("migration without down step must not be reverted")
+	}
+}
+
+func TestMigratorLockHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := newTestDS(t, "migrator_lock", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": filepath.Join(dir, "migrate.db"),
+	})
+	defer ds.Destroy()
+	ctx := context.Background()
+
+	// 迁移耗时超过LockTimeout，续期使其他实例无法接管
+	other := NewMigrator(ds, NewMigrationSource())
+	other.LockTimeout = 100 * time.Millisecond
+	contended := make(chan error, 1)
+	mg := NewMigrator(ds, NewMigrationSource(&Migration{
+		Version: 1,
+		Name:    "slow",
+		Up: func(tx *Tx) error {
+			time.Sleep(250 * time.Millisecond)
+			_, err := other.Up(ctx)
+			contended <- err
+			return nil
+		},
+	}))
+	mg.LockTimeout = 100 * time.Millisecond
+	if applied, err := mg.Up(ctx); err != nil || len(applied) != 1 {
+		t.Fatalf("slow migration must be applied, got %d, %v", len(applied), err)
+	}
+	if err := <-contended; MigrationCause(err) != ErrMigrationLocked {
+		t.Fatalf("expected lock error while migrating, got %v", err)
+	}
+
+	// LockTimeout为0时使用默认值，不能使续期的ticker panic
+	zero := NewMigrator(ds, NewMigrationSource())
+	zero.LockTimeout = 0
+	if _, err := zero.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 锁被接管后不记录版本
+	mg = NewMigrator(ds, NewMigrationSource(&Migration{
+		Version: 2,
+		Name:    "stolen",
+		Up: func(tx *Tx) error {
+			_, err := ds.Exec("UPDATE " + mg.lockTable() + " SET owner = 'other'")
+			return err
+		},
+	}))
+	if _, err := mg.Up(ctx); MigrationCause(err) != ErrMigrationLockLost {
+		t.Fatalf("expected lock lost error, got %v", err)
+	}
+	status, err := mg.Status(ctx)
+	if err != nil || len(status) != 2 || status[1].Version != 2 || status[1].Applied {
+		t.Fatalf("migration must not be recorded after losing the lock: %+v, %v", status, err)
+	}
+}
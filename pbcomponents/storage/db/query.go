@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 读操作走从库(见UsePrimary)，写操作和事务走主库；ctx中有WithTx的事务时在事务内执行
+// 每次调用计入Stats、StatementStats，Queryx只统计到返回Rows为止
+
+func (db *DS) Get(dest interface{}, query string, args ...interface{}) error {
+	return db.GetContext(context.Background(), dest, query, args...)
+}
+
+func (db *DS) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	start := time.Now()
+	err := sqlx.GetContext(ctx, db.reader(ctx), dest, query, args...)
+	db.observe(ctx, false, query, len(args), start, err)
+	return err
+}
+
+func (db *DS) Select(dest interface{}, query string, args ...interface{}) error {
+	return db.SelectContext(context.Background(), dest, query, args...)
+}
+
+func (db *DS) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	start := time.Now()
+	err := sqlx.SelectContext(ctx, db.reader(ctx), dest, query, args...)
+	db.observe(ctx, false, query, len(args), start, err)
+	return err
+}
+
+func (db *DS) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return db.QueryxContext(context.Background(), query, args...)
+}
+
+func (db *DS) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	start := time.Now()
+	rows, err := db.reader(ctx).QueryxContext(ctx, query, args...)
+	db.observe(ctx, false, query, len(args), start, err)
+	return rows, err
+}
+
+func (db *DS) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return db.QueryRowxContext(context.Background(), query, args...)
+}
+
+func (db *DS) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	start := time.Now()
+	row := db.reader(ctx).QueryRowxContext(ctx, query, args...)
+	db.observe(ctx, false, query, len(args), start, row.Err())
+	return row
+}
+
+func (db *DS) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DS) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.writer(ctx).ExecContext(ctx, query, args...)
+	db.observe(ctx, true, query, len(args), start, err)
+	return result, err
+}
+
+func (db *DS) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return db.NamedExecContext(context.Background(), query, arg)
+}
+
+func (db *DS) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := sqlx.NamedExecContext(ctx, db.writer(ctx), query, arg)
+	db.observe(ctx, true, query, 1, start, err)
+	return result, err
+}
+
+func (db *DS) Beginx() (*sqlx.Tx, error) {
+	return db.Ds().Beginx()
+}
+
+func (db *DS) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error) {
+	return db.Ds().BeginTxx(ctx, opts)
+}
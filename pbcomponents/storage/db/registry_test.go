@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+func TestParseConfigErrors(t *testing.T) {
+	configor, _ := pbconfig.NewConfigData("json", []byte(`{"driverName": "sqlite3"}`))
+	if _, err := ParseConfig(configor); err == nil {
+		t.Fatal("empty dataSourceName must be rejected")
+	}
+	if _, err := NewDB("empty", configor); err == nil {
+		t.Fatal("NewDB must return the config error")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry()
+	defer r.Destroy()
+	if _, err := r.Get("missing"); err == nil {
+		t.Fatal("missing datasource must return an error")
+	}
+
+	conf := DsConf{DriverName: "sqlite3", DataSourceName: newSQLiteFile(t, dir, "a")}
+	ds, err := r.Open("main", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Get("main"); err != nil || got != ds {
+		t.Fatalf("get returned %v, %v", got, err)
+	}
+	// 同名再次Open更新已有数据源
+	if again, err := r.Open("main", conf); err != nil || again != ds {
+		t.Fatalf("reopen must return the same datasource: %v", err)
+	}
+
+	if err := r.Close("main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get("main"); err == nil {
+		t.Fatal("closed datasource must be removed")
+	}
+	if err := ds.UpdatePool(conf); err == nil {
+		t.Fatal("update after close must fail")
+	}
+}
+
+func TestZeroDowntimeSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := DsConf{DriverName: "sqlite3", DataSourceName: newSQLiteFile(t, dir, "a"), SwapGracePeriod: 100 * time.Millisecond}
+	ds, err := Open("swap", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Destroy()
+
+	var (
+		wg     sync.WaitGroup
+		stop   = make(chan struct{})
+		failed = make(chan error, 4)
+		seenB  = make(chan struct{})
+		once   sync.Once
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var name string
+				if err := ds.GetContext(context.Background(), &name, "SELECT name FROM t WHERE id = 1"); err != nil {
+					failed <- err
+					return
+				}
+				if name == "b" {
+					once.Do(func() { close(seenB) })
+				}
+			}
+		}()
+	}
+
+	// 新DSN不可用时保留旧连接池
+	bad := conf
+	bad.DataSourceName = filepath.Join(dir, "missing", "x.db")
+	if err := ds.UpdatePool(bad); err == nil {
+		t.Fatal("unreachable dsn must be rejected")
+	}
+	if ds.Conf().DataSourceName != conf.DataSourceName {
+		t.Fatal("failed update must keep the old pool")
+	}
+
+	// 切换前取得的连接池在宽限期内可用
+	held := ds.Ds()
+	next := conf
+	next.DataSourceName = newSQLiteFile(t, dir, "b")
+	if err := ds.UpdatePool(next); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := held.Get(&name, "SELECT name FROM t WHERE id = 1"); err != nil || name != "a" {
+		t.Fatalf("old pool must stay open during the grace period: %q, %v", name, err)
+	}
+
+	select {
+	case <-seenB:
+	case err := <-failed:
+		t.Fatalf("query failed during swap: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("queries never reached the new pool")
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-failed:
+		t.Fatalf("query failed during swap: %v", err)
+	default:
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if err := held.Ping(); err == nil {
+		t.Fatal("old pool must be closed after the grace period")
+	}
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	ReplicaRoundRobin = "roundrobin"
+	ReplicaLeastConn  = "leastconn"
+
+	defaultReplicaCheckInterval = 5 * time.Second
+)
+
+type primaryContextKey struct{}
+
+// 使ctx内的读操作也走主库，用于写后立即读
+func UsePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	v, _ := ctx.Value(primaryContextKey{}).(bool)
+	return v
+}
+
+type replica struct {
+	dsn     string
+	db      *sqlx.DB
+	healthy int32 // 1-可用，0-已摘除
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// 只读从库集合，定时ping检查，失败摘除，恢复后重新加入
+type replicaSet struct {
+	dsname   string
+	policy   string
+	replicas []*replica
+	next     uint32
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// 从库连接失败不影响创建，先摘除等待健康检查恢复
+func newReplicaSet(dsname string, conf DsConf) *replicaSet {
+	rs := &replicaSet{
+		dsname: dsname,
+		policy: conf.ReplicaPolicy,
+		stop:   make(chan struct{}),
+	}
+	for _, dsn := range conf.Replicas {
+		db, err := sqlx.Open(conf.DriverName, dsn)
+		if err != nil {
+			plog.Error("[DB] open replica failed", log.String("ds", dsname), log.Error(err))
+			continue
+		}
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+		if conf.ConnMaxLifetime > 0 {
+			db.SetConnMaxLifetime(conf.ConnMaxLifetime)
+		}
+		r := &replica{dsn: dsn, db: db}
+		if err := db.Ping(); err == nil {
+			r.healthy = 1
+		} else {
+			plog.Warn("[DB] replica unavailable", log.String("ds", dsname), log.Int("replica", len(rs.replicas)), log.Error(err))
+		}
+		rs.replicas = append(rs.replicas, r)
+	}
+
+	interval := conf.ReplicaCheckInterval
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	rs.wg.Add(1)
+	go rs.healthCheck(interval)
+	return rs
+}
+
+func (rs *replicaSet) healthCheck(interval time.Duration) {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			rs.check()
+		}
+	}
+}
+
+func (rs *replicaSet) check() {
+	for i, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		err := r.db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			if atomic.CompareAndSwapInt32(&r.healthy, 1, 0) {
+				plog.Warn("[DB] replica ejected", log.String("ds", rs.dsname), log.Int("replica", i), log.Error(err))
+			}
+		} else if atomic.CompareAndSwapInt32(&r.healthy, 0, 1) {
+			plog.Info("[DB] replica rejoined", log.String("ds", rs.dsname), log.Int("replica", i))
+		}
+	}
+}
+
+// 无可用从库时返回nil，由调用方回退到主库
+func (rs *replicaSet) pick() *sqlx.DB {
+	n := len(rs.replicas)
+	if n == 0 {
+		return nil
+	}
+	if rs.policy == ReplicaLeastConn {
+		var best *replica
+		bestInUse := 0
+		for _, r := range rs.replicas {
+			if !r.isHealthy() {
+				continue
+			}
+			inUse := r.db.Stats().InUse
+			if best == nil || inUse < bestInUse {
+				best, bestInUse = r, inUse
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		return best.db
+	}
+
+	start := atomic.AddUint32(&rs.next, 1)
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(int(start)+i)%n]
+		if r.isHealthy() {
+			return r.db
+		}
+	}
+	return nil
+}
+
+func (rs *replicaSet) Close() error {
+	close(rs.stop)
+	rs.wg.Wait()
+	var err error
+	for _, r := range rs.replicas {
+		if e := r.db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+var ErrNoPrimaryKey = errors.New("model has no primary key")
+
+// 按结构体db tag读写单表，tag选项pk标记主键(可多列)，auto标记自增主键
+// 未标记pk时以id列为主键，如：
+//
+//	type User struct {
+//		ID   int64  `db:"id,pk,auto"`
+//		Name string `db:"name"`
+//	}
+type Repository struct {
+	ds    *DS
+	table string
+	typ   reflect.Type
+
+	columns []*reflectx.FieldInfo
+	pks     []*reflectx.FieldInfo
+	auto    *reflectx.FieldInfo
+}
+
+// model为结构体或其指针，用于解析字段
+func NewRepository(ds *DS, table string, model interface{}) (*Repository, error) {
+	typ := reflectx.Deref(reflect.TypeOf(model))
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("repository model must be a struct, got %s", typ)
+	}
+	r := &Repository{ds: ds, table: table, typ: typ}
+	var id *reflectx.FieldInfo
+	for _, fi := range ds.Ds().Mapper.TypeMap(typ).Index {
+		// 只取顶层列，匿名嵌入结构体的字段已提升到顶层
+		if fi.Embedded || fi.Name == "" || strings.Contains(fi.Path, ".") {
+			continue
+		}
+		r.columns = append(r.columns, fi)
+		if _, ok := fi.Options["pk"]; ok {
+			r.pks = append(r.pks, fi)
+		}
+		if _, ok := fi.Options["auto"]; ok {
+			r.auto = fi
+		}
+		if fi.Name == "id" {
+			id = fi
+		}
+	}
+	if len(r.pks) == 0 && id != nil {
+		r.pks = append(r.pks, id)
+	}
+	if len(r.pks) == 0 {
+		return nil, fmt.Errorf("%v: %s", ErrNoPrimaryKey, typ)
+	}
+	return r, nil
+}
+
+func (r *Repository) Table() string {
+	return r.table
+}
+
+func (r *Repository) columnNames(fields []*reflectx.FieldInfo) []string {
+	names := make([]string, len(fields))
+	for i, fi := range fields {
+		names[i] = fi.Name
+	}
+	return names
+}
+
+func (r *Repository) value(model interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != r.typ {
+		return reflect.Value{}, fmt.Errorf("repository expects *%s, got %T", r.typ, model)
+	}
+	return v.Elem(), nil
+}
+
+func (r *Repository) pkCond(pk []interface{}) (Eq, error) {
+	if len(pk) != len(r.pks) {
+		return nil, fmt.Errorf("primary key of %s has %d columns, got %d values", r.table, len(r.pks), len(pk))
+	}
+	eq := make(Eq, len(pk))
+	for i, fi := range r.pks {
+		eq[fi.Name] = pk[i]
+	}
+	return eq, nil
+}
+
+func (r *Repository) modelPK(v reflect.Value) Eq {
+	eq := make(Eq, len(r.pks))
+	for _, fi := range r.pks {
+		eq[fi.Name] = reflectx.FieldByIndexesReadOnly(v, fi.Index).Interface()
+	}
+	return eq
+}
+
+// 按主键读取到dest，主键多列时按字段顺序传入，未找到返回sql.ErrNoRows
+func (r *Repository) Get(ctx context.Context, dest interface{}, pk ...interface{}) error {
+	cond, err := r.pkCond(pk)
+	if err != nil {
+		return err
+	}
+	return Select(r.columnNames(r.columns)...).From(r.table).Where(cond).Get(ctx, r.ds, dest)
+}
+
+// 插入model，自增主键为零值时不插入该列，插入后回填
+func (r *Repository) Insert(ctx context.Context, model interface{}) error {
+	v, err := r.value(model)
+	if err != nil {
+		return err
+	}
+	var fields []*reflectx.FieldInfo
+	var values []interface{}
+	var autoField reflect.Value
+	for _, fi := range r.columns {
+		fv := reflectx.FieldByIndexesReadOnly(v, fi.Index)
+		if fi == r.auto && isZero(fv) {
+			autoField = reflectx.FieldByIndexes(v, fi.Index)
+			continue
+		}
+		fields = append(fields, fi)
+		values = append(values, fv.Interface())
+	}
+	b := Insert(r.table).Columns(r.columnNames(fields)...).Values(values...)
+
+	if !autoField.IsValid() {
+		_, err = b.Exec(ctx, r.ds)
+		return err
+	}
+	// PostgreSQL驱动不支持LastInsertId，以INSERT ... RETURNING取回主键，须在主库执行
+	if r.ds.Dialect() == DialectPostgres {
+		query, args, err := b.Returning(r.auto.Name).ToSQL(DialectPostgres)
+		if err != nil {
+			return err
+		}
+		return r.ds.QueryRowxContext(UsePrimary(ctx), query, args...).Scan(autoField.Addr().Interface())
+	}
+	result, err := b.Exec(ctx, r.ds)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	switch autoField.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		autoField.SetInt(id)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		autoField.SetUint(uint64(id))
+	}
+	return nil
+}
+
+// 按主键更新除主键外的所有列，返回影响行数
+func (r *Repository) Update(ctx context.Context, model interface{}) (int64, error) {
+	v, err := r.value(model)
+	if err != nil {
+		return 0, err
+	}
+	b := Update(r.table)
+	for _, fi := range r.columns {
+		if r.isPK(fi) {
+			continue
+		}
+		b.Set(fi.Name, reflectx.FieldByIndexesReadOnly(v, fi.Index).Interface())
+	}
+	result, err := b.Where(r.modelPK(v)).Exec(ctx, r.ds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// 按主键删除，返回影响行数
+func (r *Repository) Delete(ctx context.Context, pk ...interface{}) (int64, error) {
+	cond, err := r.pkCond(pk)
+	if err != nil {
+		return 0, err
+	}
+	result, err := Delete(r.table).Where(cond).Exec(ctx, r.ds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *Repository) isPK(fi *reflectx.FieldInfo) bool {
+	for _, pk := range r.pks {
+		if pk == fi {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+
+	// 超过后新语句计入otherStatement，避免拼接SQL导致无限增长
+	maxStatements   = 1000
+	otherStatement  = "other"
+	maxStatementLen = 256
+)
+
+// 延迟直方图的桶上界
+var LatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+type Stats struct {
+	sql.DBStats               // 主库连接池
+	Replicas    []sql.DBStats // 从库连接池，顺序同配置
+
+	Queries     uint64 // Get、Select、Queryx、QueryRowx
+	Execs       uint64 // Exec、NamedExec
+	Errors      uint64
+	SlowQueries uint64
+}
+
+type Bucket struct {
+	UpperBound time.Duration // 最后一个桶为0，表示+Inf
+	Count      uint64        // 累计值，含所有更小的桶
+}
+
+// 单条语句的延迟直方图
+type StatementStats struct {
+	Statement string
+	Count     uint64
+	Sum       time.Duration
+	Buckets   []Bucket
+}
+
+type histogram struct {
+	count  uint64
+	sum    int64
+	counts []uint64 // len(LatencyBuckets)+1
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for ; i < len(LatencyBuckets); i++ {
+		if d <= LatencyBuckets[i] {
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) snapshot(statement string) StatementStats {
+	s := StatementStats{
+		Statement: statement,
+		Count:     atomic.LoadUint64(&h.count),
+		Sum:       time.Duration(atomic.LoadInt64(&h.sum)),
+		Buckets:   make([]Bucket, len(h.counts)),
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		if i < len(LatencyBuckets) {
+			s.Buckets[i].UpperBound = LatencyBuckets[i]
+		}
+		s.Buckets[i].Count = cumulative
+	}
+	return s
+}
+
+type dsStats struct {
+	queries     uint64
+	execs       uint64
+	errors      uint64
+	slowQueries uint64
+
+	slowThreshold int64 // time.Duration，<=0关闭慢查询日志
+
+	mu         sync.RWMutex
+	statements map[string]*histogram
+}
+
+func newDSStats(slowThreshold time.Duration) *dsStats {
+	return &dsStats{
+		slowThreshold: int64(slowThreshold),
+		statements:    make(map[string]*histogram),
+	}
+}
+
+func (s *dsStats) histogram(query string) *histogram {
+	s.mu.RLock()
+	h, ok := s.statements[query]
+	s.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok = s.statements[query]; ok {
+		return h
+	}
+	if len(s.statements) >= maxStatements {
+		query = otherStatement
+		if h, ok = s.statements[query]; ok {
+			return h
+		}
+	}
+	h = newHistogram()
+	s.statements[query] = h
+	return h
+}
+
+// 合并空白，过长截断
+func normalizeStatement(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxStatementLen {
+		query = query[:maxStatementLen]
+	}
+	return query
+}
+
+// 记录一次查询，超过慢查询阈值时输出日志
+func (db *DS) observe(ctx context.Context, exec bool, query string, nargs int, start time.Time, err error) {
+	elapsed := time.Since(start)
+	s := db.stats
+	if exec {
+		atomic.AddUint64(&s.execs, 1)
+	} else {
+		atomic.AddUint64(&s.queries, 1)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		atomic.AddUint64(&s.errors, 1)
+	}
+
+	statement := normalizeStatement(query)
+	s.histogram(statement).observe(elapsed)
+
+	if threshold := time.Duration(atomic.LoadInt64(&s.slowThreshold)); threshold > 0 && elapsed >= threshold {
+		atomic.AddUint64(&s.slowQueries, 1)
+		ctxFields := log.ContextFields(ctx)
+		fields := make([]log.Field, 0, len(ctxFields)+5)
+		fields = append(fields, ctxFields...)
+		fields = append(fields, log.String("ds", db.dsname), log.String("sql", statement),
+			log.Int("args", nargs), log.Duration("elapsed", elapsed))
+		if err != nil {
+			fields = append(fields, log.Error(err))
+		}
+		plog.Warn("[DB] slow query", fields...)
+	}
+}
+
+// 连接池状态与查询计数
+func (db *DS) Stats() Stats {
+	p := db.pool()
+	s := Stats{
+		DBStats:     p.db.Stats(),
+		Queries:     atomic.LoadUint64(&db.stats.queries),
+		Execs:       atomic.LoadUint64(&db.stats.execs),
+		Errors:      atomic.LoadUint64(&db.stats.errors),
+		SlowQueries: atomic.LoadUint64(&db.stats.slowQueries),
+	}
+	if p.replicas != nil {
+		for _, r := range p.replicas.replicas {
+			s.Replicas = append(s.Replicas, r.db.Stats())
+		}
+	}
+	return s
+}
+
+// 各语句的延迟直方图，按语句排序
+func (db *DS) StatementStats() []StatementStats {
+	db.stats.mu.RLock()
+	stats := make([]StatementStats, 0, len(db.stats.statements))
+	for statement, h := range db.stats.statements {
+		stats = append(stats, h.snapshot(statement))
+	}
+	db.stats.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Statement < stats[j].Statement })
+	return stats
+}
+
+func (db *DS) SetSlowQueryThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&db.stats.slowThreshold, int64(threshold))
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := newTestDS(t, "stats", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": newSQLiteFile(t, dir, "primary"),
+	})
+	defer ds.Destroy()
+
+	var slow []string
+	log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {
+		if msg == "[DB] slow query" {
+			slow = append(slow, msg)
+		}
+	})
+	defer log.SetLogFunc(func(l *log.Logger, level log.Level, msg string, fields []log.Field) {})
+
+	var name string
+	for i := 0; i < 3; i++ {
+		if err := ds.Get(&name, "SELECT name FROM t\n  WHERE id = ?", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ds.Exec("INSERT INTO t (name) VALUES (?)", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Exec("INSERT INTO missing (name) VALUES (?)", "x"); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(slow) != 0 {
+		t.Fatalf("fast queries must not be logged as slow: %v", slow)
+	}
+
+	ds.SetSlowQueryThreshold(time.Nanosecond)
+	ds.Get(&name, "SELECT name FROM t WHERE id = ?", 1)
+
+	s := ds.Stats()
+	if s.Queries != 4 || s.Execs != 2 || s.Errors != 1 || s.SlowQueries != 1 || len(slow) != 1 {
+		t.Fatalf("unexpected stats %+v, slow logs %d", s, len(slow))
+	}
+	if s.OpenConnections == 0 {
+		t.Fatal("pool stats must be included")
+	}
+
+	var found bool
+	for _, st := range ds.StatementStats() {
+		if st.Statement != "SELECT name FROM t WHERE id = ?" {
+			continue
+		}
+		found = true
+		last := st.Buckets[len(st.Buckets)-1]
+		if st.Count != 4 || last.Count != 4 || last.UpperBound != 0 || st.Sum <= 0 {
+			t.Fatalf("unexpected histogram %+v", st)
+		}
+	}
+	if !found {
+		t.Fatal("statement histogram missing")
+	}
+}
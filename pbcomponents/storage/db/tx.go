@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	defaultTxMaxRetries   = 3
+	defaultTxRetryBackoff = 10 * time.Millisecond
+)
+
+type txContextKey struct{}
+
+// 事务，嵌套的WithTx使用savepoint
+type Tx struct {
+	*sqlx.Tx
+
+	ds    *DS
+	ctx   context.Context
+	depth int // 0为最外层事务
+	seq   int // savepoint序号
+}
+
+// 携带该事务的ctx，传给DS的GetContext、ExecContext等方法时在事务内执行
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// 返回ctx中属于ds的事务
+func TxFromContext(ctx context.Context, ds *DS) (*Tx, bool) {
+	tx, ok := ctx.Value(txContextKey{}).(*Tx)
+	if !ok || tx.ds != ds {
+		return nil, false
+	}
+	return tx, true
+}
+
+// 在事务中执行fn，fn返回nil时提交，返回error或panic时回滚
+// ctx中已有该DS的事务时加入该事务并使用savepoint，fn失败只回滚到savepoint
+// 最外层事务遇到死锁、序列化失败时按退避重试整个fn
+func (db *DS) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	if parent, ok := TxFromContext(ctx, db); ok {
+		return parent.savepoint(fn)
+	}
+
+	conf := db.Conf()
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = db.runTx(ctx, opts, fn)
+		if err == nil || attempt >= conf.TxMaxRetries || !IsRetryable(err) {
+			return err
+		}
+		backoff := conf.TxRetryBackoff << uint(attempt)
+		backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		plog.Debug("[DB] retry transaction", log.String("ds", db.dsname), log.Int("attempt", attempt+1),
+			log.Duration("backoff", backoff), log.Error(err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (db *DS) runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (err error) {
+	stx, err := db.Ds().BeginTxx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	tx := &Tx{Tx: stx, ds: db}
+	tx.ctx = context.WithValue(ctx, txContextKey{}, tx)
+
+	defer func() {
+		if r := recover(); r != nil {
+			stx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		if rerr := stx.Rollback(); rerr != nil && rerr != sql.ErrTxDone {
+			plog.Warn("[DB] rollback failed", log.String("ds", db.dsname), log.Error(rerr))
+		}
+		return err
+	}
+	return stx.Commit()
+}
+
+func (tx *Tx) savepoint(fn func(tx *Tx) error) (err error) {
+	tx.seq++
+	name := fmt.Sprintf("sp_%d_%d", tx.depth+1, tx.seq)
+	if _, err = tx.ExecContext(tx.ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	nested := &Tx{Tx: tx.Tx, ds: tx.ds, depth: tx.depth + 1}
+	nested.ctx = context.WithValue(tx.ctx, txContextKey{}, nested)
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.ExecContext(tx.ctx, "ROLLBACK TO SAVEPOINT "+name)
+			panic(r)
+		}
+	}()
+
+	if err = fn(nested); err != nil {
+		if _, rerr := tx.ExecContext(tx.ctx, "ROLLBACK TO SAVEPOINT "+name); rerr != nil {
+			plog.Warn("[DB] rollback to savepoint failed", log.String("ds", tx.ds.dsname), log.Error(rerr))
+		}
+		return err
+	}
+	_, err = tx.ExecContext(tx.ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+// 死锁、序列化失败、锁等待超时等可重试的错误
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if me, ok := err.(*mysql.MySQLError); ok {
+		// 1213 deadlock，1205 lock wait timeout
+		return me.Number == 1213 || me.Number == 1205
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range retryableMessages {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var retryableMessages = []string{
+	"deadlock",            // mysql、postgresql 40P01
+	"could not serialize", // postgresql 40001
+	"database is locked",  // sqlite SQLITE_BUSY
+	"database table is locked",
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func countRows(t *testing.T, ds *DS) int {
+	var n int
+	if err := ds.Get(&n, "SELECT COUNT(*) FROM t"); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWithTx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := newTestDS(t, "with_tx", map[string]interface{}{
+		"driverName":     "sqlite3",
+		"dataSourceName": newSQLiteFile(t, dir, "primary"),
+		"txRetryBackoff": 1,
+	})
+	defer ds.Destroy()
+	ctx := context.Background()
+	insert := func(ctx context.Context, name string) {
+		if _, err := ds.ExecContext(ctx, "INSERT INTO t (name) VALUES (?)", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 提交，ctx中的事务被DS方法加入
+	err = ds.WithTx(ctx, nil, func(tx *Tx) error {
+		insert(tx.Context(), "committed")
+		return nil
+	})
+	if err != nil || countRows(t, ds) != 2 {
+		t.Fatalf("commit failed: %v, rows %d", err, countRows(t, ds))
+	}
+
+	// 返回error回滚
+	errBiz := errors.New("biz")
+	err = ds.WithTx(ctx, nil, func(tx *Tx) error {
+		insert(tx.Context(), "rolledback")
+		return errBiz
+	})
+	if err != errBiz || countRows(t, ds) != 2 {
+		t.Fatalf("rollback on error failed: %v, rows %d", err, countRows(t, ds))
+	}
+
+	// panic回滚并继续panic
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("panic must propagate, got %v", r)
+			}
+		}()
+		ds.WithTx(ctx, nil, func(tx *Tx) error {
+			insert(tx.Context(), "panicked")
+			panic("boom")
+		})
+	}()
+	if countRows(t, ds) != 2 {
+		t.Fatalf("rollback on panic failed, rows %d", countRows(t, ds))
+	}
+
+	// 嵌套事务失败只回滚到savepoint
+	err = ds.WithTx(ctx, nil, func(tx *Tx) error {
+		insert(tx.Context(), "outer")
+		nestedErr := ds.WithTx(tx.Context(), nil, func(inner *Tx) error {
+			insert(inner.Context(), "inner")
+			return errBiz
+		})
+		if nestedErr != errBiz {
+			t.Fatalf("nested error must be returned, got %v", nestedErr)
+		}
+		return ds.WithTx(tx.Context(), nil, func(inner *Tx) error {
+			insert(inner.Context(), "inner2")
+			return nil
+		})
+	})
+	if err != nil || countRows(t, ds) != 4 {
+		t.Fatalf("savepoint failed: %v, rows %d", err, countRows(t, ds))
+	}
+
+	// 可重试的错误重试整个事务
+	attempts := 0
+	err = ds.WithTx(ctx, nil, func(tx *Tx) error {
+		attempts++
+		insert(tx.Context(), "retried")
+		if attempts < 3 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 || countRows(t, ds) != 5 {
+		t.Fatalf("retry failed: %v, attempts %d, rows %d", err, attempts, countRows(t, ds))
+	}
+}
@@ -0,0 +1,42 @@
+package mysql
+
+import (
+	"keywea.com/cloud/pblib/pb/component"
+	"keywea.com/cloud/pblib/pbcomponents/storage/db"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+const CompID = "mysql"
+
+// 由结构化配置生成DSN，连接池及读写分离等配置同db组件，实例为*db.DS
+type Component struct {
+	db.Component
+}
+
+func Register(pbc *component.PBC) error {
+	return pbc.RegisterComponent(CompID, &Component{})
+}
+
+func (mc *Component) Create(instConfig *component.ComponentInstConfig) (interface{}, error) {
+	if err := prepare(*instConfig.Config); err != nil {
+		return nil, err
+	}
+	return mc.Component.Create(instConfig)
+}
+
+func (mc *Component) Update(inst interface{}, instConfig *component.ComponentInstConfig) error {
+	if err := prepare(*instConfig.Config); err != nil {
+		return err
+	}
+	return mc.Component.Update(inst, instConfig)
+}
+
+// 写入db组件使用的driverName、dataSourceName
+func prepare(configor pbconfig.Configor) error {
+	dsn, err := ParseConfig(configor).DSN()
+	if err != nil {
+		return err
+	}
+	configor.SetString("driverName", "mysql")
+	return configor.SetString("dataSourceName", dsn)
+}
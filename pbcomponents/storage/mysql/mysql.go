@@ -1,5 +1,159 @@
 package mysql
 
-import _ "github.com/go-sql-driver/mysql"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
 
-// https://github.com/go-sql-driver/mysql#parameters
\ No newline at end of file
+	"github.com/go-sql-driver/mysql"
+	"keywea.com/cloud/pblib/pb/log"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+// https://github.com/go-sql-driver/mysql#parameters
+
+var (
+	errEmptyHost = errors.New("mysql: host is required")
+	errEmptyUser = errors.New("mysql: user is required")
+
+	identRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+func init() {
+	// 驱动内部错误(如连接中断)输出到pb/log
+	mysql.SetLogger(log.NewStdLogger(log.New("[MYSQL]"), log.LevelError))
+}
+
+// 结构化的连接配置，超时单位为秒
+type Config struct {
+	Host              string
+	Port              int
+	User              string
+	Password          string
+	Database          string
+	Charset           string
+	Collation         string
+	Timeout           time.Duration // 建立连接超时
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	TLS               string // true、false、skip-verify或mysql.RegisterTLSConfig注册的名称
+	ParseTime         bool
+	Loc               string // 如UTC、Local、Asia/Shanghai
+	InterpolateParams bool
+
+	// 每个新连接建立后执行 SET name=value，如 time_zone: "'+08:00'"
+	Session map[string]string
+}
+
+func ParseConfig(configor pbconfig.Configor) Config {
+	port, _ := configor.GetInt("port", 3306)
+	timeout, _ := configor.GetInt("timeout", 10)
+	readTimeout, _ := configor.GetInt("readTimeout", 30)
+	writeTimeout, _ := configor.GetInt("writeTimeout", 30)
+	parseTime, _ := configor.GetBool("parseTime")
+	interpolateParams, _ := configor.GetBool("interpolateParams")
+
+	conf := Config{
+		Host:              configor.GetString("host", "127.0.0.1"),
+		Port:              port,
+		User:              configor.GetString("user", ""),
+		Password:          configor.GetString("password", ""),
+		Database:          configor.GetString("database", ""),
+		Charset:           configor.GetString("charset", "utf8mb4"),
+		Collation:         configor.GetString("collation", ""),
+		Timeout:           time.Second * time.Duration(timeout),
+		ReadTimeout:       time.Second * time.Duration(readTimeout),
+		WriteTimeout:      time.Second * time.Duration(writeTimeout),
+		TLS:               configor.GetString("tls", ""),
+		ParseTime:         parseTime,
+		Loc:               configor.GetString("loc", ""),
+		InterpolateParams: interpolateParams,
+	}
+	if raw, err := configor.GetRawValue("session"); err == nil {
+		conf.Session = make(map[string]string)
+		switch m := raw.(type) {
+		case map[string]interface{}:
+			for k, v := range m {
+				conf.Session[k] = fmt.Sprint(v)
+			}
+		case map[interface{}]interface{}:
+			for k, v := range m {
+				conf.Session[fmt.Sprint(k)] = fmt.Sprint(v)
+			}
+		}
+	}
+	return conf
+}
+
+func (c Config) Validate() error {
+	if c.Host == "" {
+		return errEmptyHost
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("mysql: invalid port %d", c.Port)
+	}
+	if c.User == "" {
+		return errEmptyUser
+	}
+	if c.Charset != "" && !identRegexp.MatchString(c.Charset) {
+		return fmt.Errorf("mysql: invalid charset %q", c.Charset)
+	}
+	if c.Collation != "" && !identRegexp.MatchString(c.Collation) {
+		return fmt.Errorf("mysql: invalid collation %q", c.Collation)
+	}
+	if c.Timeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 {
+		return errors.New("mysql: timeouts must not be negative")
+	}
+	if c.Loc != "" {
+		if _, err := time.LoadLocation(c.Loc); err != nil {
+			return fmt.Errorf("mysql: invalid loc %q: %v", c.Loc, err)
+		}
+	}
+	for name := range c.Session {
+		if !identRegexp.MatchString(name) || name == "charset" {
+			return fmt.Errorf("mysql: invalid session variable %q", name)
+		}
+	}
+	return nil
+}
+
+// 生成go-sql-driver/mysql的DSN
+func (c Config) DSN() (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+	mc := mysql.NewConfig()
+	mc.User = c.User
+	mc.Passwd = c.Password
+	mc.Net = "tcp"
+	mc.Addr = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	mc.DBName = c.Database
+	mc.Timeout = c.Timeout
+	mc.ReadTimeout = c.ReadTimeout
+	mc.WriteTimeout = c.WriteTimeout
+	mc.TLSConfig = c.TLS
+	mc.ParseTime = c.ParseTime
+	mc.InterpolateParams = c.InterpolateParams
+	if c.Collation != "" {
+		mc.Collation = c.Collation
+	}
+	if c.Loc != "" {
+		loc, _ := time.LoadLocation(c.Loc)
+		mc.Loc = loc
+	}
+	// 驱动连接后对charset执行SET NAMES，其余参数执行SET
+	mc.Params = make(map[string]string, len(c.Session)+1)
+	if c.Charset != "" {
+		mc.Params["charset"] = c.Charset
+	}
+	for k, v := range c.Session {
+		mc.Params[k] = v
+	}
+	if len(mc.Params) == 0 {
+		mc.Params = nil
+	}
+	return mc.FormatDSN(), nil
+}
@@ -0,0 +1,73 @@
+package mysql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+func TestDSN(t *testing.T) {
+	data := `{
+		"host": "db.local", "port": 3307, "user": "app", "password": "p@ss:w/rd",
+		"database": "farm", "charset": "utf8mb4", "collation": "utf8mb4_unicode_ci",
+		"timeout": 3, "readTimeout": 5, "writeTimeout": 7, "tls": "skip-verify",
+		"parseTime": true, "loc": "Asia/Shanghai", "interpolateParams": true,
+		"session": {"time_zone": "'+08:00'", "sql_mode": "'STRICT_ALL_TABLES'"}
+	}`
+	configor, err := pbconfig.NewConfigData("json", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := ParseConfig(configor).DSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "app:p@ss:w/rd@tcp(db.local:3307)/farm?collation=utf8mb4_unicode_ci&interpolateParams=true" +
+		"&loc=Asia%2FShanghai&parseTime=true&readTimeout=5s&timeout=3s&tls=skip-verify&writeTimeout=7s" +
+		"&charset=utf8mb4&sql_mode=%27STRICT_ALL_TABLES%27&time_zone=%27%2B08%3A00%27"
+	if dsn != want {
+		t.Fatalf("unexpected dsn\n got %s\nwant %s", dsn, want)
+	}
+
+	// 驱动能解析回相同的配置
+	mc, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Passwd != "p@ss:w/rd" || mc.Addr != "db.local:3307" || mc.Loc.String() != "Asia/Shanghai" ||
+		mc.ReadTimeout != 5*time.Second || mc.Params["time_zone"] != "'+08:00'" || !mc.ParseTime {
+		t.Fatalf("dsn does not round trip: %+v", mc)
+	}
+}
+
+func TestDSNDefaults(t *testing.T) {
+	dsn, err := Config{Host: "::1", Port: 3306, User: "root"}.DSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn != "root@tcp([::1]:3306)/" {
+		t.Fatalf("unexpected dsn %s", dsn)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{Host: "h", Port: 3306, User: "u"}
+	cases := []func(c *Config){
+		func(c *Config) { c.Host = "" },
+		func(c *Config) { c.Port = 70000 },
+		func(c *Config) { c.User = "" },
+		func(c *Config) { c.Charset = "utf8; DROP" },
+		func(c *Config) { c.Loc = "Nowhere/City" },
+		func(c *Config) { c.ReadTimeout = -time.Second },
+		func(c *Config) { c.Session = map[string]string{"a=b": "1"} },
+	}
+	for i, mutate := range cases {
+		c := valid
+		mutate(&c)
+		if _, err := c.DSN(); err == nil {
+			t.Fatalf("case %d must be rejected: %+v", i, c)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	defaultCacheJitter      = 0.1
+	defaultCacheNegativeTTL = 30 * time.Second
+)
+
+var (
+	ErrCacheMiss = errors.New("redis: cache miss")
+	// loader返回ErrNotFound时缓存空结果，在NegativeTTL内不再调用loader
+	ErrNotFound = errors.New("redis: not found")
+)
+
+// 缓存中的值带一个字节的类型前缀
+const (
+	cacheEntryValue    byte = 'v'
+	cacheEntryNotFound byte = '-'
+)
+
+type Loader func() (interface{}, error)
+
+// 按key批量加载，结果中缺少的key视为不存在
+type BatchLoader func(keys []string) (map[string]interface{}, error)
+
+// cache-aside缓存，值经Codec序列化后写入redis
+// 并发的未命中按key合并为一次加载，写入的TTL随机增加Jitter比例以分散过期时间
+type Cache struct {
+	rpool *RPool
+	codec Codec
+
+	Jitter      float64       // TTL随机增加的最大比例
+	NegativeTTL time.Duration // 不存在结果的缓存时间，0为不缓存
+
+	local  *localCache
+	sub    *Subscriber
+	topic  string
+	flight flightGroup
+}
+
+func (rpool *RPool) NewCache(codec Codec) *Cache {
+	return &Cache{
+		rpool:       rpool,
+		codec:       codec,
+		Jitter:      defaultCacheJitter,
+		NegativeTTL: defaultCacheNegativeTTL,
+	}
+}
+
+// 在redis前增加进程内LRU，最多size个key，本地最长保留ttl
+// Set/Delete通过channel广播失效，订阅断开期间丢失的失效消息依赖ttl兜底；须在使用Cache前调用
+func (c *Cache) EnableLocal(size int, ttl time.Duration, channel string) error {
+	if c.local != nil {
+		return errors.New("redis: local cache already enabled")
+	}
+	local := newLocalCache(size, ttl)
+	sub := c.rpool.NewSubscriber()
+	if err := sub.Subscribe(func(msg *Message) {
+		local.remove(string(msg.Data))
+	}, channel); err != nil {
+		sub.Close()
+		return err
+	}
+	c.local, c.sub, c.topic = local, sub, channel
+	return nil
+}
+
+// 停止本地缓存的失效订阅
+func (c *Cache) Close() error {
+	if c.sub != nil {
+		return c.sub.Close()
+	}
+	return nil
+}
+
+// 读取key解码到dest，不存在时返回ErrCacheMiss，缓存了空结果时返回ErrNotFound
+func (c *Cache) Get(key string, dest interface{}) error {
+	entry, err := c.get(key)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return ErrCacheMiss
+	}
+	return c.decode(entry, dest)
+}
+
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) error {
+	entry, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	conn := c.rpool.GetConn()
+	defer conn.Close()
+	if _, err := conn.Do(REDIS_CMD_SET, key, entry, "PX", durationMs(c.jitter(ttl))); err != nil {
+		return err
+	}
+	c.invalidate(conn, key)
+	return nil
+}
+
+func (c *Cache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	conn := c.rpool.GetConn()
+	defer conn.Close()
+	// cluster模式下多个key可能不在同一slot，逐个删除
+	for _, key := range keys {
+		if _, err := conn.Do(REDIS_CMD_DELETE, key); err != nil {
+			return err
+		}
+	}
+	c.invalidate(conn, keys...)
+	return nil
+}
+
+// 命中时解码到dest，未命中时调用loader并写入缓存
+// 同一进程内同一key的并发未命中只调用一次loader；redis出错时仍调用loader
+func (c *Cache) GetOrLoad(key string, ttl time.Duration, dest interface{}, loader Loader) error {
+	entry, err := c.get(key)
+	if err != nil {
+		plog.Warn("[REDIS] cache get failed", log.String("pool", c.rpool.name), log.String("key", key), log.Error(err))
+	}
+	if entry == nil {
+		entry, err = c.flight.do(key, func() ([]byte, error) {
+			return c.load(key, ttl, loader)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.decode(entry, dest)
+}
+
+// 批量读取到dest，dest须为非nil的map[string]T；不存在的key不写入dest
+// loader不为nil时对未命中的key调用一次loader并写入缓存
+func (c *Cache) MGet(keys []string, ttl time.Duration, dest interface{}, loader BatchLoader) error {
+	out := reflect.ValueOf(dest)
+	if out.Kind() != reflect.Map || out.IsNil() || out.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("redis: MGet dest must be a non-nil map[string]T, got %T", dest)
+	}
+
+	entries := make(map[string][]byte, len(keys))
+	var remote []string
+	for _, key := range keys {
+		if entry, ok := c.local.get(key); ok {
+			entries[key] = entry
+		} else {
+			remote = append(remote, key)
+		}
+	}
+	if len(remote) > 0 {
+		if err := c.mget(remote, entries); err != nil {
+			plog.Warn("[REDIS] cache mget failed", log.String("pool", c.rpool.name), log.Error(err))
+		}
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if _, ok := entries[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 && loader != nil {
+		if err := c.loadBatch(missing, ttl, loader, entries); err != nil {
+			return err
+		}
+	}
+
+	elemType := out.Type().Elem()
+	for key, entry := range entries {
+		if entry[0] == cacheEntryNotFound {
+			continue
+		}
+		var elem reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			elem = reflect.New(elemType.Elem())
+		} else {
+			elem = reflect.New(elemType)
+		}
+		if err := c.decode(entry, elem.Interface()); err != nil {
+			return err
+		}
+		if elemType.Kind() != reflect.Ptr {
+			elem = elem.Elem()
+		}
+		out.SetMapIndex(reflect.ValueOf(key).Convert(out.Type().Key()), elem)
+	}
+	return nil
+}
+
+// 未命中时返回nil
+func (c *Cache) get(key string) ([]byte, error) {
+	if entry, ok := c.local.get(key); ok {
+		return entry, nil
+	}
+	conn := c.rpool.GetReadConn()
+	defer conn.Close()
+	entry, err := redigo.Bytes(conn.Do(REDIS_CMD_GET, key))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("redis: invalid cache entry for key %s", key)
+	}
+	c.local.set(key, entry)
+	return entry, nil
+}
+
+// 以pipeline逐个GET，cluster模式下各key按slot路由
+func (c *Cache) mget(keys []string, entries map[string][]byte) error {
+	conn := c.rpool.GetReadConn()
+	defer conn.Close()
+	for _, key := range keys {
+		if err := conn.Send(REDIS_CMD_GET, key); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		entry, err := redigo.Bytes(conn.Receive())
+		if err == redigo.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(entry) > 0 {
+			entries[key] = entry
+			c.local.set(key, entry)
+		}
+	}
+	return nil
+}
+
+func (c *Cache) load(key string, ttl time.Duration, loader Loader) ([]byte, error) {
+	value, err := loader()
+	var entry []byte
+	switch {
+	case err == ErrNotFound:
+		if c.NegativeTTL <= 0 {
+			return nil, ErrNotFound
+		}
+		entry, ttl = []byte{cacheEntryNotFound}, c.NegativeTTL
+	case err != nil:
+		return nil, err
+	default:
+		if entry, err = c.encode(value); err != nil {
+			return nil, err
+		}
+	}
+
+	conn := c.rpool.GetConn()
+	defer conn.Close()
+	if _, err := conn.Do(REDIS_CMD_SET, key, entry, "PX", durationMs(c.jitter(ttl))); err != nil {
+		plog.Warn("[REDIS] cache set failed", log.String("pool", c.rpool.name), log.String("key", key), log.Error(err))
+	}
+	c.local.set(key, entry)
+	return entry, nil
+}
+
+func (c *Cache) loadBatch(keys []string, ttl time.Duration, loader BatchLoader, entries map[string][]byte) error {
+	values, err := loader(keys)
+	if err != nil {
+		return err
+	}
+	conn := c.rpool.GetConn()
+	defer conn.Close()
+	n := 0
+	for _, key := range keys {
+		var entry []byte
+		entryTTL := ttl
+		if value, ok := values[key]; ok {
+			if entry, err = c.encode(value); err != nil {
+				return err
+			}
+		} else {
+			entry = []byte{cacheEntryNotFound}
+			if entryTTL = c.NegativeTTL; entryTTL <= 0 {
+				continue
+			}
+		}
+		entries[key] = entry
+		c.local.set(key, entry)
+		if err := conn.Send(REDIS_CMD_SET, key, entry, "PX", durationMs(c.jitter(entryTTL))); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err := conn.Receive(); err != nil {
+			plog.Warn("[REDIS] cache set failed", log.String("pool", c.rpool.name), log.Error(err))
+		}
+	}
+	return nil
+}
+
+func (c *Cache) encode(value interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{cacheEntryValue}, data...), nil
+}
+
+func (c *Cache) decode(entry []byte, dest interface{}) error {
+	if entry[0] == cacheEntryNotFound {
+		return ErrNotFound
+	}
+	return c.codec.Unmarshal(entry[1:], dest)
+}
+
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.Jitter <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(int64(float64(ttl)*c.Jitter)+1))
+}
+
+// 删除本地副本并通知其他实例
+func (c *Cache) invalidate(conn redigo.Conn, keys ...string) {
+	if c.local == nil {
+		return
+	}
+	for _, key := range keys {
+		c.local.remove(key)
+		if _, err := conn.Do(REDIS_CMD_PUBLISH, c.topic, key); err != nil {
+			plog.Warn("[REDIS] cache invalidate failed", log.String("pool", c.rpool.name), log.String("key", key),
+				log.Error(err))
+		}
+	}
+}
+
+// 合并同一key的并发调用
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	entry []byte
+	err   error
+}
+
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.entry, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.entry, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return call.entry, call.err
+}
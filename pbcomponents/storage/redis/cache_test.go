@@ -0,0 +1,220 @@
+package redis
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pbactor/actor"
+)
+
+type cacheUser struct {
+	ID   int
+	Name string
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	s, rpool := newFakePool(t, "cache")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	for name, codec := range map[string]Codec{"json": JSONCodec, "gob": GobCodec} {
+		cache := rpool.NewCache(codec)
+		key := "user:" + name
+		var loads int32
+		loader := func() (interface{}, error) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(50 * time.Millisecond)
+			return &cacheUser{ID: 1, Name: "alice"}, nil
+		}
+
+		// 并发未命中只加载一次
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var u cacheUser
+				if err := cache.GetOrLoad(key, time.Minute, &u, loader); err != nil || u.Name != "alice" {
+					t.Errorf("%s: unexpected %+v %v", name, u, err)
+				}
+			}()
+		}
+		wg.Wait()
+		var u cacheUser
+		if err := cache.GetOrLoad(key, time.Minute, &u, loader); err != nil || u.ID != 1 {
+			t.Fatalf("%s: unexpected %+v %v", name, u, err)
+		}
+		if n := atomic.LoadInt32(&loads); n != 1 {
+			t.Fatalf("%s: expected 1 load, got %d", name, n)
+		}
+
+		// TTL在[ttl, ttl*(1+Jitter)]之间
+		pttl, err := rpool.Do("PTTL", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms := pttl.(int64); ms <= 0 || time.Duration(ms)*time.Millisecond > time.Minute*11/10 {
+			t.Fatalf("%s: unexpected ttl %dms", name, ms)
+		}
+	}
+
+	// proto
+	cache := rpool.NewCache(ProtoCodec)
+	if err := cache.Set("pid", &actor.PID{Address: "node1", Id: "worker"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var pid actor.PID
+	if err := cache.Get("pid", &pid); err != nil || pid.Address != "node1" || pid.Id != "worker" {
+		t.Fatalf("unexpected %+v %v", pid, err)
+	}
+	if err := cache.Get("missing", &pid); err != ErrCacheMiss {
+		t.Fatalf("expected ErrCacheMiss, got %v", err)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	s, rpool := newFakePool(t, "cache-negative")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	cache := rpool.NewCache(JSONCodec)
+	var loads int32
+	loader := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		return nil, ErrNotFound
+	}
+	var u cacheUser
+	for i := 0; i < 3; i++ {
+		if err := cache.GetOrLoad("user:404", time.Minute, &u, loader); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("expected 1 load, got %d", n)
+	}
+	if err := cache.Get("user:404", &u); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// 其他错误不缓存
+	boom := errors.New("boom")
+	for i := 0; i < 2; i++ {
+		if err := cache.GetOrLoad("user:500", time.Minute, &u, func() (interface{}, error) {
+			atomic.AddInt32(&loads, 1)
+			return nil, boom
+		}); err != boom {
+			t.Fatalf("expected boom, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 3 {
+		t.Fatalf("expected 3 loads, got %d", n)
+	}
+}
+
+func TestCacheMGet(t *testing.T) {
+	s, rpool := newFakePool(t, "cache-mget")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	cache := rpool.NewCache(JSONCodec)
+	if err := cache.Set("u:1", &cacheUser{ID: 1, Name: "a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var requested []string
+	loader := func(keys []string) (map[string]interface{}, error) {
+		requested = append(requested, keys...)
+		values := make(map[string]interface{})
+		for _, key := range keys {
+			if key == "u:2" {
+				values[key] = &cacheUser{ID: 2, Name: "b"}
+			}
+		}
+		return values, nil
+	}
+
+	users := make(map[string]*cacheUser)
+	if err := cache.MGet([]string{"u:1", "u:2", "u:3"}, time.Minute, users, loader); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(requested)
+	if !reflect.DeepEqual(requested, []string{"u:2", "u:3"}) {
+		t.Fatalf("unexpected loader keys %v", requested)
+	}
+	if len(users) != 2 || users["u:1"].Name != "a" || users["u:2"].Name != "b" {
+		t.Fatalf("unexpected users %+v", users)
+	}
+
+	// 已加载和不存在的key都命中缓存
+	requested = nil
+	values := make(map[string]cacheUser)
+	if err := cache.MGet([]string{"u:1", "u:2", "u:3"}, time.Minute, values, loader); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 0 || len(values) != 2 || values["u:2"].ID != 2 {
+		t.Fatalf("unexpected %v %+v", requested, values)
+	}
+	if err := cache.MGet(nil, time.Minute, users, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.MGet([]string{"u:1"}, time.Minute, &users, nil); err == nil {
+		t.Fatal("expected error for non-map dest")
+	}
+}
+
+func TestCacheLocal(t *testing.T) {
+	s, rpool := newFakePool(t, "cache-local")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	var gets int32
+	s.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+		if args[0] == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return nil, false
+	})
+
+	c1, c2 := rpool.NewCache(JSONCodec), rpool.NewCache(JSONCodec)
+	for _, c := range []*Cache{c1, c2} {
+		if err := c.EnableLocal(2, time.Minute, "cache:invalidate"); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	waitFor(t, "subscribers", func() bool { return c1.sub.Connected() && c2.sub.Connected() })
+
+	if err := c2.Set("u:1", &cacheUser{Name: "a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var u cacheUser
+	for i := 0; i < 3; i++ {
+		if err := c1.Get("u:1", &u); err != nil || u.Name != "a" {
+			t.Fatalf("unexpected %+v %v", u, err)
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Fatalf("expected 1 redis GET, got %d", n)
+	}
+
+	// 其他实例写入后本地副本失效
+	if err := c2.Set("u:1", &cacheUser{Name: "b"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "invalidation", func() bool {
+		return c1.Get("u:1", &u) == nil && u.Name == "b"
+	})
+
+	// 超过容量时淘汰最久未使用的key
+	c1.Set("u:2", &cacheUser{Name: "c"}, time.Minute)
+	c1.Set("u:3", &cacheUser{Name: "d"}, time.Minute)
+	c1.Get("u:2", &u)
+	c1.Get("u:3", &u)
+	if _, ok := c1.local.get("u:1"); ok {
+		t.Fatal("expected u:1 evicted")
+	}
+}
@@ -0,0 +1,800 @@
+package redis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pbconfig"
+)
+
+// 简单状态回复，如+OK
+type fakeStatus string
+
+// 依次写出多个回复，用于SUBSCRIBE等一条命令多个回复的情况
+type fakeMulti []interface{}
+
+// 进程内的RESP服务端，实现测试用到的少量命令
+// hook返回true时使用其回复，否则按内置命令处理
+type fakeRedis struct {
+	t    *testing.T
+	ln   net.Listener
+	addr string
+
+	mu      sync.Mutex
+	data    map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	streams map[string]*fakeStream
+	expires map[string]time.Time
+	scripts map[string]bool // 已加载脚本的sha1
+	version map[string]int  // 每次写入加一，用于WATCH
+	hook    func(c *fakeClient, args []string) (interface{}, bool)
+
+	conns   map[net.Conn]bool
+	clients map[*fakeClient]bool
+	wg      sync.WaitGroup
+}
+
+// 每个连接的状态
+type fakeClient struct {
+	srv    *fakeRedis
+	conn   net.Conn
+	asking bool
+
+	wmu      sync.Mutex
+	w        *bufio.Writer
+	channels map[string]bool
+	patterns map[string]bool
+
+	multi   bool
+	queued  [][]string
+	watched map[string]int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		t:       t,
+		ln:      ln,
+		addr:    ln.Addr().String(),
+		data:    make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		streams: make(map[string]*fakeStream),
+		expires: make(map[string]time.Time),
+		scripts: make(map[string]bool),
+		version: make(map[string]int),
+		conns:   make(map[net.Conn]bool),
+		clients: make(map[*fakeClient]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) setHook(hook func(c *fakeClient, args []string) (interface{}, bool)) {
+	s.mu.Lock()
+	s.hook = hook
+	s.mu.Unlock()
+}
+
+func (s *fakeRedis) Close() {
+	s.ln.Close()
+	s.closeConns()
+	s.wg.Wait()
+}
+
+// 断开所有客户端连接，模拟网络中断
+func (s *fakeRedis) closeConns() {
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	// 断开的客户端不再接收publish
+	for c := range s.clients {
+		delete(s.clients, c)
+	}
+	s.mu.Unlock()
+}
+
+func (s *fakeRedis) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		c := &fakeClient{
+			srv:      s,
+			conn:     conn,
+			w:        bufio.NewWriter(conn),
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+		}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+func (s *fakeRedis) serveConn(c *fakeClient) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c.conn)
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		hook := s.hook
+		s.mu.Unlock()
+		var reply interface{}
+		handled := false
+		if hook != nil {
+			reply, handled = hook(c, args)
+		}
+		if !handled {
+			reply = s.handleTx(c, args)
+		}
+		if strings.ToUpper(args[0]) != "ASKING" {
+			c.asking = false
+		}
+		if err := c.write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		head, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(head, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (c *fakeClient) write(reply interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if multi, ok := reply.(fakeMulti); ok {
+		for _, r := range multi {
+			writeReply(c.w, r)
+		}
+	} else {
+		writeReply(c.w, reply)
+	}
+	return c.w.Flush()
+}
+
+// 调用方持有s.mu
+func (c *fakeClient) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// 向订阅者推送消息，返回接收的客户端数
+func (s *fakeRedis) publish(channel, message string) int {
+	s.mu.Lock()
+	var targets []*fakeClient
+	var replies []interface{}
+	for c := range s.clients {
+		if c.channels[channel] {
+			targets = append(targets, c)
+			replies = append(replies, []interface{}{"message", channel, message})
+		}
+		for pattern := range c.patterns {
+			if ok, _ := path.Match(pattern, channel); ok {
+				targets = append(targets, c)
+				replies = append(replies, []interface{}{"pmessage", pattern, channel, message})
+			}
+		}
+	}
+	s.mu.Unlock()
+	for i, c := range targets {
+		c.write(replies[i])
+	}
+	return len(targets)
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case redigo.Error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case fakeNilArray:
+		w.WriteString("*-1\r\n")
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("fake redis: unsupported reply %T", reply))
+	}
+}
+
+// 按sha1模拟的lua脚本，由各测试注册，调用时持有s.mu
+var fakeScripts = map[string]func(s *fakeRedis, keys, argv []string) interface{}{}
+
+// 没有值的数组回复，EXEC因WATCH失败时返回
+type fakeNilArray struct{}
+
+var fakeWriteCommands = map[string]bool{
+	"SET": true, "SETEX": true, "DEL": true, "INCR": true, "INCRBY": true, "HSET": true, "EXPIRE": true, "PEXPIRE": true,
+}
+
+func (s *fakeRedis) handleTx(c *fakeClient, args []string) interface{} {
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "WATCH":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if c.watched == nil {
+			c.watched = make(map[string]int)
+		}
+		for _, key := range args[1:] {
+			c.watched[key] = s.version[key]
+		}
+		return fakeStatus("OK")
+	case "UNWATCH":
+		c.watched = nil
+		return fakeStatus("OK")
+	case "MULTI":
+		c.multi = true
+		return fakeStatus("OK")
+	case "DISCARD":
+		c.multi, c.queued, c.watched = false, nil, nil
+		return fakeStatus("OK")
+	case "EXEC":
+		queued, watched := c.queued, c.watched
+		c.multi, c.queued, c.watched = false, nil, nil
+		s.mu.Lock()
+		for key, v := range watched {
+			if s.version[key] != v {
+				s.mu.Unlock()
+				return fakeNilArray{}
+			}
+		}
+		s.mu.Unlock()
+		replies := make([]interface{}, 0, len(queued))
+		for _, q := range queued {
+			replies = append(replies, s.handle(c, q))
+		}
+		return replies
+	}
+	if c.multi {
+		c.queued = append(c.queued, args)
+		return fakeStatus("QUEUED")
+	}
+	return s.handle(c, args)
+}
+
+// 调用方持有s.mu
+func (s *fakeRedis) expireLocked(key string) {
+	if at, ok := s.expires[key]; ok && !time.Now().Before(at) {
+		delete(s.data, key)
+		delete(s.hashes, key)
+		delete(s.zsets, key)
+		delete(s.expires, key)
+	}
+}
+
+// 调用方持有s.mu
+func (s *fakeRedis) existsLocked(key string) bool {
+	_, ok1 := s.data[key]
+	_, ok2 := s.hashes[key]
+	_, ok3 := s.zsets[key]
+	return ok1 || ok2 || ok3
+}
+
+func (s *fakeRedis) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(key)
+	v, ok := s.data[key]
+	return v, ok
+}
+
+func (s *fakeRedis) set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+	s.version[key]++
+}
+
+func (s *fakeRedis) handle(c *fakeClient, args []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range args[1:] {
+		s.expireLocked(key)
+	}
+	if cmd := strings.ToUpper(args[0]); fakeWriteCommands[cmd] {
+		keys := args[1:2]
+		if cmd == "DEL" {
+			keys = args[1:]
+		}
+		for _, key := range keys {
+			s.version[key]++
+		}
+	}
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "PING":
+		if c.subscriptions() > 0 {
+			return []interface{}{"pong", ""}
+		}
+		return fakeStatus("PONG")
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		set := c.channels
+		if cmd[0] == 'P' {
+			set = c.patterns
+		}
+		names := args[1:]
+		if len(names) == 0 && strings.Contains(cmd, "UNSUBSCRIBE") {
+			for name := range set {
+				names = append(names, name)
+			}
+		}
+		var replies fakeMulti
+		for _, name := range names {
+			if strings.Contains(cmd, "UNSUBSCRIBE") {
+				delete(set, name)
+			} else {
+				set[name] = true
+			}
+			replies = append(replies, []interface{}{strings.ToLower(cmd), name, c.subscriptions()})
+		}
+		return replies
+	case "PUBLISH":
+		// 在锁外推送
+		channel, message := args[1], args[2]
+		s.mu.Unlock()
+		n := s.publish(channel, message)
+		s.mu.Lock()
+		return n
+	case "ASKING":
+		c.asking = true
+		return fakeStatus("OK")
+	case "KEYS":
+		keys := make([]interface{}, 0)
+		for key := range s.data {
+			if ok, _ := path.Match(args[1], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	case "DBSIZE":
+		return len(s.data)
+	case "RANDOMKEY":
+		for key := range s.data {
+			return key
+		}
+		return nil
+	case "FLUSHDB", "FLUSHALL":
+		s.data = make(map[string]string)
+		s.expires = make(map[string]time.Time)
+		return fakeStatus("OK")
+	case "SELECT", "AUTH":
+		return fakeStatus("OK")
+	case "GET":
+		if v, ok := s.data[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		key := args[1]
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			case "EX":
+				sec, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(sec) * time.Second
+				i++
+			}
+		}
+		if _, ok := s.data[key]; ok && nx {
+			return nil
+		}
+		s.data[key] = args[2]
+		delete(s.expires, key)
+		if ttl > 0 {
+			s.expires[key] = time.Now().Add(ttl)
+		}
+		return fakeStatus("OK")
+	case "SETEX":
+		sec, _ := strconv.Atoi(args[2])
+		s.data[args[1]] = args[3]
+		s.expires[args[1]] = time.Now().Add(time.Duration(sec) * time.Second)
+		return fakeStatus("OK")
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if s.existsLocked(key) {
+				n++
+			}
+			delete(s.data, key)
+			delete(s.hashes, key)
+			delete(s.zsets, key)
+			delete(s.expires, key)
+		}
+		return n
+	case "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			if s.existsLocked(key) {
+				n++
+			}
+		}
+		return n
+	case "INCR", "INCRBY":
+		by := int64(1)
+		if cmd == "INCRBY" {
+			by, _ = strconv.ParseInt(args[2], 10, 64)
+		}
+		n, _ := strconv.ParseInt(s.data[args[1]], 10, 64)
+		n += by
+		s.data[args[1]] = strconv.FormatInt(n, 10)
+		return n
+	case "PEXPIRE", "EXPIRE":
+		if !s.existsLocked(args[1]) {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[2])
+		unit := time.Second
+		if cmd == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		s.expires[args[1]] = time.Now().Add(time.Duration(n) * unit)
+		return 1
+	case "PTTL":
+		at, ok := s.expires[args[1]]
+		if !ok {
+			if s.existsLocked(args[1]) {
+				return -1
+			}
+			return -2
+		}
+		return int64(time.Until(at) / time.Millisecond)
+	case "HSET":
+		h, ok := s.hashes[args[1]]
+		if !ok {
+			h = make(map[string]string)
+			s.hashes[args[1]] = h
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return n
+	case "HGET":
+		if v, ok := s.hashes[args[1]][args[2]]; ok {
+			return v
+		}
+		return nil
+	case "ZREM":
+		n := 0
+		for _, member := range args[2:] {
+			if _, ok := s.zsets[args[1]][member]; ok {
+				delete(s.zsets[args[1]], member)
+				n++
+			}
+		}
+		if len(s.zsets[args[1]]) == 0 {
+			delete(s.zsets, args[1])
+		}
+		return n
+	case "ZCARD":
+		return len(s.zsets[args[1]])
+	case "SCRIPT":
+		switch strings.ToUpper(args[1]) {
+		case "LOAD":
+			sum := sha1.Sum([]byte(args[2]))
+			sha := hex.EncodeToString(sum[:])
+			s.scripts[sha] = true
+			return sha
+		case "FLUSH":
+			s.scripts = make(map[string]bool)
+			return fakeStatus("OK")
+		case "EXISTS":
+			exists := make([]interface{}, 0, len(args)-2)
+			for _, sha := range args[2:] {
+				if s.scripts[sha] {
+					exists = append(exists, 1)
+				} else {
+					exists = append(exists, 0)
+				}
+			}
+			return exists
+		}
+	case "XADD", "XLEN", "XGROUP", "XREADGROUP", "XACK", "XPENDING", "XCLAIM":
+		return s.handleStream(cmd, args)
+	case "EVAL", "EVALSHA":
+		sha := args[1]
+		if cmd == "EVAL" {
+			sum := sha1.Sum([]byte(args[1]))
+			sha = hex.EncodeToString(sum[:])
+			s.scripts[sha] = true
+		} else if !s.scripts[sha] {
+			return redigo.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		script, ok := fakeScripts[sha]
+		if !ok {
+			return redigo.Error("ERR fake script not registered")
+		}
+		numKeys, _ := strconv.Atoi(args[2])
+		return script(s, args[3:3+numKeys], args[3+numKeys:])
+	}
+	return redigo.Error("ERR unknown command '" + args[0] + "'")
+}
+
+func newConfigor(t *testing.T, conf map[string]interface{}) pbconfig.Configor {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configor, err := pbconfig.NewConfigData("json", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configor
+}
+
+// stream的ID只使用序号部分，形如"12-0"
+type fakeStream struct {
+	seq     int64
+	entries []fakeStreamEntry
+	groups  map[string]*fakeGroup
+}
+
+type fakeStreamEntry struct {
+	id     int64
+	fields []string
+}
+
+type fakeGroup struct {
+	last    int64
+	pending map[int64]*fakePending
+}
+
+type fakePending struct {
+	consumer  string
+	delivered time.Time
+	count     int64
+}
+
+func fakeStreamID(id int64) string {
+	return strconv.FormatInt(id, 10) + "-0"
+}
+
+func parseFakeStreamID(id string) int64 {
+	n, _ := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	return n
+}
+
+func (st *fakeStream) entry(id int64) []interface{} {
+	for _, e := range st.entries {
+		if e.id == id {
+			fields := make([]interface{}, len(e.fields))
+			for i, f := range e.fields {
+				fields[i] = f
+			}
+			return []interface{}{fakeStreamID(id), fields}
+		}
+	}
+	// 已被裁剪
+	return []interface{}{fakeStreamID(id), nil}
+}
+
+// 调用方持有s.mu，XREADGROUP阻塞时临时释放
+func (s *fakeRedis) handleStream(cmd string, args []string) interface{} {
+	st := s.streams[args[1]]
+	if cmd == "XGROUP" || cmd == "XREADGROUP" {
+		st = nil
+	}
+	switch cmd {
+	case "XADD":
+		if st == nil {
+			st = &fakeStream{groups: make(map[string]*fakeGroup)}
+			s.streams[args[1]] = st
+		}
+		i, maxLen := 2, 0
+		if strings.ToUpper(args[i]) == "MAXLEN" {
+			if i++; args[i] == "~" || args[i] == "=" {
+				i++
+			}
+			maxLen, _ = strconv.Atoi(args[i])
+			i++
+		}
+		st.seq++
+		st.entries = append(st.entries, fakeStreamEntry{id: st.seq, fields: args[i+1:]})
+		if maxLen > 0 && len(st.entries) > maxLen {
+			st.entries = st.entries[len(st.entries)-maxLen:]
+		}
+		return fakeStreamID(st.seq)
+	case "XLEN":
+		if st == nil {
+			return 0
+		}
+		return len(st.entries)
+	case "XGROUP":
+		// XGROUP CREATE key group start [MKSTREAM]
+		st = s.streams[args[2]]
+		if st == nil {
+			st = &fakeStream{groups: make(map[string]*fakeGroup)}
+			s.streams[args[2]] = st
+		}
+		if _, ok := st.groups[args[3]]; ok {
+			return redigo.Error("BUSYGROUP Consumer Group name already exists")
+		}
+		g := &fakeGroup{pending: make(map[int64]*fakePending)}
+		if args[4] == "$" {
+			g.last = st.seq
+		}
+		st.groups[args[3]] = g
+		return fakeStatus("OK")
+	case "XREADGROUP":
+		// XREADGROUP GROUP group consumer COUNT n [BLOCK ms] STREAMS key >
+		group, consumer := args[2], args[3]
+		count, _ := strconv.Atoi(args[5])
+		var block time.Duration
+		key := args[len(args)-2]
+		if strings.ToUpper(args[6]) == "BLOCK" {
+			ms, _ := strconv.Atoi(args[7])
+			block = time.Duration(ms) * time.Millisecond
+		}
+		deadline := time.Now().Add(block)
+		for {
+			st = s.streams[key]
+			if st == nil || st.groups[group] == nil {
+				return redigo.Error("NOGROUP No such key or consumer group")
+			}
+			g := st.groups[group]
+			var entries []interface{}
+			for _, e := range st.entries {
+				if e.id <= g.last || len(entries) >= count {
+					continue
+				}
+				g.last = e.id
+				g.pending[e.id] = &fakePending{consumer: consumer, delivered: time.Now(), count: 1}
+				entries = append(entries, st.entry(e.id))
+			}
+			if len(entries) > 0 {
+				return []interface{}{[]interface{}{key, entries}}
+			}
+			if !time.Now().Before(deadline) {
+				return nil
+			}
+			s.mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			s.mu.Lock()
+		}
+	case "XACK":
+		n := 0
+		if st == nil || st.groups[args[2]] == nil {
+			return n
+		}
+		g := st.groups[args[2]]
+		for _, id := range args[3:] {
+			if _, ok := g.pending[parseFakeStreamID(id)]; ok {
+				delete(g.pending, parseFakeStreamID(id))
+				n++
+			}
+		}
+		return n
+	case "XPENDING":
+		// XPENDING key group - + count
+		if st == nil || st.groups[args[2]] == nil {
+			return redigo.Error("NOGROUP No such key or consumer group")
+		}
+		g := st.groups[args[2]]
+		count, _ := strconv.Atoi(args[5])
+		ids := make([]int64, 0, len(g.pending))
+		for id := range g.pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		var replies []interface{}
+		for _, id := range ids {
+			if len(replies) >= count {
+				break
+			}
+			p := g.pending[id]
+			idle := int64(time.Since(p.delivered) / time.Millisecond)
+			replies = append(replies, []interface{}{fakeStreamID(id), p.consumer, idle, p.count})
+		}
+		return replies
+	case "XCLAIM":
+		// XCLAIM key group consumer min-idle id...
+		if st == nil || st.groups[args[2]] == nil {
+			return redigo.Error("NOGROUP No such key or consumer group")
+		}
+		g := st.groups[args[2]]
+		ms, _ := strconv.Atoi(args[4])
+		minIdle := time.Duration(ms) * time.Millisecond
+		var replies []interface{}
+		for _, id := range args[5:] {
+			p, ok := g.pending[parseFakeStreamID(id)]
+			if !ok || time.Since(p.delivered) < minIdle {
+				continue
+			}
+			p.consumer, p.delivered = args[3], time.Now()
+			p.count++
+			replies = append(replies, st.entry(parseFakeStreamID(id)))
+		}
+		return replies
+	}
+	return redigo.Error("ERR unknown command '" + cmd + "'")
+}
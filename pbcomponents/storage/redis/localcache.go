@@ -0,0 +1,86 @@
+package redis
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// 进程内LRU，nil时各方法为空操作
+type localCache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type localEntry struct {
+	key     string
+	entry   []byte
+	expires time.Time
+}
+
+func newLocalCache(size int, ttl time.Duration) *localCache {
+	return &localCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (lc *localCache) get(key string) ([]byte, bool) {
+	if lc == nil {
+		return nil, false
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	el, ok := lc.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*localEntry)
+	if !time.Now().Before(e.expires) {
+		lc.removeElement(el)
+		return nil, false
+	}
+	lc.ll.MoveToFront(el)
+	return e.entry, true
+}
+
+func (lc *localCache) set(key string, entry []byte) {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	expires := time.Now().Add(lc.ttl)
+	if el, ok := lc.items[key]; ok {
+		e := el.Value.(*localEntry)
+		e.entry, e.expires = entry, expires
+		lc.ll.MoveToFront(el)
+		return
+	}
+	lc.items[key] = lc.ll.PushFront(&localEntry{key: key, entry: entry, expires: expires})
+	for lc.ll.Len() > lc.size {
+		lc.removeElement(lc.ll.Back())
+	}
+}
+
+func (lc *localCache) remove(key string) {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if el, ok := lc.items[key]; ok {
+		lc.removeElement(el)
+	}
+}
+
+func (lc *localCache) removeElement(el *list.Element) {
+	lc.ll.Remove(el)
+	delete(lc.items, el.Value.(*localEntry).key)
+}
@@ -0,0 +1,380 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	defaultLockRetryInterval = 50 * time.Millisecond
+	// Redlock时钟漂移系数，有效期扣除 ttl*lockDriftFactor+2ms
+	lockDriftFactor = 0.01
+)
+
+var (
+	ErrLockNotObtained = errors.New("redis: lock not obtained")
+	ErrLockNotHeld     = errors.New("redis: lock not held")
+)
+
+// 值等于token时删除/续期，避免误操作他人的锁
+var (
+	lockReleaseScript = RegisterScript("lock.release", 1, `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+	lockExtendScript = RegisterScript("lock.extend", 1, `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// 基于SET NX PX的分布式锁，value为随机token
+// 由多个RPool创建时按Redlock算法在多数实例上加锁
+type Locker struct {
+	pools []*RPool
+
+	RetryInterval time.Duration // 阻塞加锁的重试间隔
+}
+
+func (rpool *RPool) NewLocker() *Locker {
+	return NewRedlock(rpool)
+}
+
+// 各RPool应为相互独立的redis实例，n/2+1个实例加锁成功且耗时小于TTL时才获得锁
+func NewRedlock(pools ...*RPool) *Locker {
+	return &Locker{
+		pools:         pools,
+		RetryInterval: defaultLockRetryInterval,
+	}
+}
+
+// 尝试加锁一次，锁被他人持有时返回ErrLockNotObtained
+func (l *Locker) TryLock(key string, ttl time.Duration) (*Lock, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{
+		key:   key,
+		token: token,
+		ttl:   ttl,
+		pools: l.pools,
+		extend: func(conn redigo.Conn, ttl time.Duration) (bool, error) {
+			n, err := redigo.Int(lockExtendScript.DoConn(conn, key, token, durationMs(ttl)))
+			return n == 1, err
+		},
+		release: func(conn redigo.Conn) (bool, error) {
+			n, err := redigo.Int(lockReleaseScript.DoConn(conn, key, token))
+			return n == 1, err
+		},
+	}
+	err = lock.acquire(func(conn redigo.Conn) (bool, error) {
+		_, err := redigo.String(conn.Do(REDIS_CMD_SET, key, token, "NX", "PX", durationMs(ttl)))
+		if err == redigo.ErrNil {
+			return false, nil
+		}
+		return err == nil, err
+	}, ErrLockNotObtained)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// 阻塞直到加锁成功或ctx结束
+func (l *Locker) Lock(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	return retryLock(ctx, l.RetryInterval, func() (*Lock, error) {
+		return l.TryLock(key, ttl)
+	})
+}
+
+// 计数信号量，同一key最多limit个持有者
+// 许可记录在有序集合中，score为过期时间，持有者崩溃后名额按TTL自动回收
+// 过期判断使用客户端时间，各客户端的时钟偏差应远小于TTL
+type Semaphore struct {
+	rpool *RPool
+	key   string
+	limit int
+
+	RetryInterval time.Duration
+}
+
+// KEYS[1]=key ARGV=now, expireAt, token, limit, ttl(ms)
+var semaphoreAcquireScript = RegisterScript("semaphore.acquire", 1, `redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[3])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[5]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[5])
+end
+return 1`)
+
+// KEYS[1]=key ARGV=now, expireAt, token, ttl(ms)
+var semaphoreExtendScript = RegisterScript("semaphore.extend", 1, `local score = redis.call("ZSCORE", KEYS[1], ARGV[3])
+if not score or tonumber(score) <= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[3])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return 1`)
+
+func (rpool *RPool) NewSemaphore(key string, limit int) *Semaphore {
+	return &Semaphore{
+		rpool:         rpool,
+		key:           key,
+		limit:         limit,
+		RetryInterval: defaultLockRetryInterval,
+	}
+}
+
+// 尝试获取一个许可，名额已满时返回ErrLockNotObtained
+func (s *Semaphore) TryAcquire(ttl time.Duration) (*Lock, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	key := s.key
+	lock := &Lock{
+		key:   key,
+		token: token,
+		ttl:   ttl,
+		pools: []*RPool{s.rpool},
+		extend: func(conn redigo.Conn, ttl time.Duration) (bool, error) {
+			now := time.Now()
+			n, err := redigo.Int(semaphoreExtendScript.DoConn(conn, key, unixMs(now), unixMs(now.Add(ttl)), token,
+				durationMs(ttl)))
+			return n == 1, err
+		},
+		release: func(conn redigo.Conn) (bool, error) {
+			n, err := redigo.Int(conn.Do(REDIS_CMD_ZREM, key, token))
+			return n == 1, err
+		},
+	}
+	err = lock.acquire(func(conn redigo.Conn) (bool, error) {
+		now := time.Now()
+		n, err := redigo.Int(semaphoreAcquireScript.DoConn(conn, key, unixMs(now), unixMs(now.Add(ttl)), token,
+			s.limit, durationMs(ttl)))
+		return n == 1, err
+	}, ErrLockNotObtained)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// 阻塞直到获取许可或ctx结束
+func (s *Semaphore) Acquire(ctx context.Context, ttl time.Duration) (*Lock, error) {
+	return retryLock(ctx, s.RetryInterval, func() (*Lock, error) {
+		return s.TryAcquire(ttl)
+	})
+}
+
+// 已持有的锁或信号量许可
+type Lock struct {
+	key     string
+	token   string
+	ttl     time.Duration
+	pools   []*RPool
+	extend  func(conn redigo.Conn, ttl time.Duration) (bool, error)
+	release func(conn redigo.Conn) (bool, error)
+
+	mu         sync.Mutex
+	validUntil time.Time
+	lost       chan struct{}
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func (lk *Lock) Key() string {
+	return lk.key
+}
+
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// 本地估算的有效期，已扣除加锁耗时和时钟漂移
+func (lk *Lock) ValidUntil() time.Time {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	return lk.validUntil
+}
+
+// 按TTL续期，锁已过期或被他人持有时返回ErrLockNotHeld
+func (lk *Lock) Extend() error {
+	return lk.acquire(func(conn redigo.Conn) (bool, error) {
+		return lk.extend(conn, lk.ttl)
+	}, ErrLockNotHeld)
+}
+
+// 后台每TTL/3续期一次，返回的channel在锁丢失时关闭；Release后停止续期
+func (lk *Lock) AutoRenew() <-chan struct{} {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	if lk.lost != nil {
+		return lk.lost
+	}
+	lk.lost = make(chan struct{})
+	lk.stop = make(chan struct{})
+	lk.wg.Add(1)
+	go lk.renewLoop(lk.stop, lk.lost)
+	return lk.lost
+}
+
+func (lk *Lock) renewLoop(stop, lost chan struct{}) {
+	defer lk.wg.Done()
+	ticker := time.NewTicker(lk.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := lk.Extend()
+		if err == nil {
+			continue
+		}
+		// 网络错误时在有效期内继续重试
+		if err != ErrLockNotHeld && time.Now().Before(lk.ValidUntil()) {
+			plog.Warn("[REDIS] renew lock failed", log.String("key", lk.key), log.Error(err))
+			continue
+		}
+		plog.Warn("[REDIS] lock lost", log.String("key", lk.key), log.Error(err))
+		close(lost)
+		return
+	}
+}
+
+// 释放锁并停止续期，锁已过期或被他人持有时返回ErrLockNotHeld
+func (lk *Lock) Release() error {
+	lk.mu.Lock()
+	if lk.stop != nil {
+		close(lk.stop)
+		lk.stop = nil
+	}
+	lk.mu.Unlock()
+	lk.wg.Wait()
+
+	n, err := quorumDo(lk.pools, lk.release)
+	lk.mu.Lock()
+	lk.validUntil = time.Time{}
+	lk.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// 在各实例上执行fn，多数成功且剩余有效期大于0时更新validUntil
+// 未达到多数时释放已成功的实例并返回failed；全部实例出错时返回首个错误
+func (lk *Lock) acquire(fn func(conn redigo.Conn) (bool, error), failed error) error {
+	start := time.Now()
+	n, err := quorumDo(lk.pools, fn)
+	drift := time.Duration(float64(lk.ttl)*lockDriftFactor) + 2*time.Millisecond
+	validity := lk.ttl - time.Since(start) - drift
+	lk.mu.Lock()
+	if n >= len(lk.pools)/2+1 && validity > 0 {
+		lk.validUntil = start.Add(validity)
+		lk.mu.Unlock()
+		return nil
+	}
+	lk.mu.Unlock()
+	if n > 0 {
+		quorumDo(lk.pools, lk.release)
+	}
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// 并发在各RPool上执行fn，返回成功的实例数；仅在全部实例出错时返回error
+func quorumDo(pools []*RPool, fn func(conn redigo.Conn) (bool, error)) (int, error) {
+	if len(pools) == 1 {
+		conn := pools[0].GetConn()
+		defer conn.Close()
+		ok, err := fn(conn)
+		if ok {
+			return 1, nil
+		}
+		return 0, err
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		n, fails int
+		firstErr error
+	)
+	for _, rpool := range pools {
+		wg.Add(1)
+		go func(rpool *RPool) {
+			defer wg.Done()
+			conn := rpool.GetConn()
+			defer conn.Close()
+			ok, err := fn(conn)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				n++
+			} else if err != nil {
+				plog.Debug("[REDIS] lock instance failed", log.String("pool", rpool.name), log.Error(err))
+				if fails++; firstErr == nil {
+					firstErr = err
+				}
+			}
+		}(rpool)
+	}
+	wg.Wait()
+	if fails < len(pools) {
+		firstErr = nil
+	}
+	return n, firstErr
+}
+
+func retryLock(ctx context.Context, interval time.Duration, try func() (*Lock, error)) (*Lock, error) {
+	for {
+		lock, err := try()
+		if err != ErrLockNotObtained {
+			return lock, err
+		}
+		// 加入抖动，避免竞争者同时重试
+		wait := interval + time.Duration(mrand.Int63n(int64(interval)/2+1))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func unixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,242 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	fakeScripts[lockReleaseScript.Hash()] = func(s *fakeRedis, keys, argv []string) interface{} {
+		if v, ok := s.data[keys[0]]; ok && v == argv[0] {
+			delete(s.data, keys[0])
+			delete(s.expires, keys[0])
+			return 1
+		}
+		return 0
+	}
+	fakeScripts[lockExtendScript.Hash()] = func(s *fakeRedis, keys, argv []string) interface{} {
+		if v, ok := s.data[keys[0]]; ok && v == argv[0] {
+			ms, _ := strconv.Atoi(argv[1])
+			s.expires[keys[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			return 1
+		}
+		return 0
+	}
+	fakeScripts[semaphoreAcquireScript.Hash()] = func(s *fakeRedis, keys, argv []string) interface{} {
+		now, _ := strconv.ParseFloat(argv[0], 64)
+		expireAt, _ := strconv.ParseFloat(argv[1], 64)
+		limit, _ := strconv.Atoi(argv[3])
+		z := s.zsets[keys[0]]
+		if z == nil {
+			z = make(map[string]float64)
+			s.zsets[keys[0]] = z
+		}
+		for member, score := range z {
+			if score <= now {
+				delete(z, member)
+			}
+		}
+		if len(z) >= limit {
+			return 0
+		}
+		z[argv[2]] = expireAt
+		s.expires[keys[0]] = time.Now().Add(time.Duration(expireAt-now) * time.Millisecond)
+		return 1
+	}
+	fakeScripts[semaphoreExtendScript.Hash()] = func(s *fakeRedis, keys, argv []string) interface{} {
+		now, _ := strconv.ParseFloat(argv[0], 64)
+		expireAt, _ := strconv.ParseFloat(argv[1], 64)
+		z := s.zsets[keys[0]]
+		if score, ok := z[argv[2]]; !ok || score <= now {
+			return 0
+		}
+		z[argv[2]] = expireAt
+		s.expires[keys[0]] = time.Now().Add(time.Duration(expireAt-now) * time.Millisecond)
+		return 1
+	}
+}
+
+func TestLock(t *testing.T) {
+	s, rpool := newFakePool(t, "lock")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	locker := rpool.NewLocker()
+	lock, err := locker.TryLock("lock:a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.get("lock:a"); v != lock.Token() {
+		t.Fatalf("expected token %s, got %s", lock.Token(), v)
+	}
+	if _, err := locker.TryLock("lock:a", time.Second); err != ErrLockNotObtained {
+		t.Fatalf("expected ErrLockNotObtained, got %v", err)
+	}
+	if err := lock.Extend(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 阻塞加锁在ctx超时时返回
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := locker.Lock(ctx, "lock:a", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	cancel()
+
+	// 释放后阻塞等待的一方获得锁
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Release()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	next, err := locker.Lock(ctx, "lock:a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token() == lock.Token() {
+		t.Fatal("expected a new token")
+	}
+	// 旧持有者不能释放或续期他人的锁
+	if err := lock.Release(); err != ErrLockNotHeld {
+		t.Fatalf("expected ErrLockNotHeld, got %v", err)
+	}
+	if err := lock.Extend(); err != ErrLockNotHeld {
+		t.Fatalf("expected ErrLockNotHeld, got %v", err)
+	}
+	if v, _ := s.get("lock:a"); v != next.Token() {
+		t.Fatal("lock released by previous holder")
+	}
+	if err := next.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockAutoRenew(t *testing.T) {
+	s, rpool := newFakePool(t, "lock-renew")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	locker := rpool.NewLocker()
+	lock, err := locker.TryLock("lock:renew", 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := lock.AutoRenew()
+	time.Sleep(400 * time.Millisecond)
+	if _, err := locker.TryLock("lock:renew", time.Second); err != ErrLockNotObtained {
+		t.Fatalf("expected lock kept by renewal, got %v", err)
+	}
+	select {
+	case <-lost:
+		t.Fatal("lock lost while renewing")
+	default:
+	}
+
+	// 锁被他人接管后通知丢失
+	s.set("lock:renew", "other")
+	select {
+	case <-lost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for lock lost")
+	}
+	if err := lock.Release(); err != ErrLockNotHeld {
+		t.Fatalf("expected ErrLockNotHeld, got %v", err)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	s, rpool := newFakePool(t, "semaphore")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	sem := rpool.NewSemaphore("sem:jobs", 2)
+	p1, err := sem.TryAcquire(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := sem.TryAcquire(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sem.TryAcquire(time.Second); err != ErrLockNotObtained {
+		t.Fatalf("expected ErrLockNotObtained, got %v", err)
+	}
+	if err := p1.Release(); err != nil {
+		t.Fatal(err)
+	}
+	p3, err := sem.Acquire(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.Extend(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 过期的许可被回收
+	short := rpool.NewSemaphore("sem:short", 1)
+	old, err := short.TryAcquire(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if _, err := short.TryAcquire(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Extend(); err != ErrLockNotHeld {
+		t.Fatalf("expected ErrLockNotHeld, got %v", err)
+	}
+
+	p2.Release()
+	p3.Release()
+	if n, err := rpool.Do("ZCARD", "sem:jobs"); err != nil || n.(int64) != 0 {
+		t.Fatalf("expected empty semaphore, got %v %v", n, err)
+	}
+}
+
+func TestRedlock(t *testing.T) {
+	var servers []*fakeRedis
+	var pools []*RPool
+	for i := 0; i < 3; i++ {
+		s, rpool := newFakePool(t, "redlock"+strconv.Itoa(i))
+		defer s.Close()
+		defer rpool.Destroy()
+		servers = append(servers, s)
+		pools = append(pools, rpool)
+	}
+	locker := NewRedlock(pools...)
+
+	lock, err := locker.TryLock("lock:red", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range servers {
+		if v, _ := s.get("lock:red"); v != lock.Token() {
+			t.Fatalf("instance %d not locked", i)
+		}
+	}
+	if !lock.ValidUntil().After(time.Now()) {
+		t.Fatal("expected validity in the future")
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 多数实例被他人持有时加锁失败，并释放已获得的实例
+	servers[0].set("lock:red", "other")
+	servers[1].set("lock:red", "other")
+	if _, err := locker.TryLock("lock:red", time.Second); err != ErrLockNotObtained {
+		t.Fatalf("expected ErrLockNotObtained, got %v", err)
+	}
+	if _, ok := servers[2].get("lock:red"); ok {
+		t.Fatal("minority lock not released")
+	}
+
+	// 少数实例不可用时仍可加锁
+	servers[0].Close()
+	if _, err := locker.TryLock("lock:red2", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,13 @@
+package redis
+
+import (
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+var (
+	plog = log.New("[REDIS].pbredis")
+)
+
+func SetLogLevel(level log.Level) {
+	plog.SetLevel(level)
+}
@@ -0,0 +1,383 @@
+package redis
+
+import (
+	"errors"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+var (
+	errNotExecuted = errors.New("redis: pipeline not executed")
+	errQueued      = errors.New("redis: command queued")
+)
+
+// 在一个连接上批量发送命令，Exec后按顺序取得各命令的结果
+// 命令通过包内的helper(HGetString、GetInt64等)入队，结果类型与helper一致
+// cluster模式下按节点分组发送，每个节点一次往返
+//
+//	p := rpool.Pipeline()
+//	name := p.HGetString("user:1", "name")
+//	age := p.HGetInt64("user:1", "age")
+//	if err := p.Exec(); err != nil {
+//		...
+//	}
+//	name.Val(), age.Val()
+type Pipeline struct {
+	rpool  *RPool
+	queued []*queuedCmd
+}
+
+// fn调用一个或多个helper，入队时记录其发出的命令，取得回复后以回复重放fn得到类型转换后的结果
+type queuedCmd struct {
+	fn  func(c *redigo.Conn) (interface{}, error)
+	n   int // fn发出的命令数
+	res *result
+}
+
+func (rpool *RPool) Pipeline() *Pipeline {
+	return &Pipeline{rpool: rpool}
+}
+
+// 入队任意helper调用，如 p.Queue(func(c *redigo.Conn) (interface{}, error) { return ZRange(c, key, 0, -1, true) })
+func (p *Pipeline) Queue(fn func(c *redigo.Conn) (interface{}, error)) *Result {
+	r := &Result{}
+	p.queue(fn, &r.result)
+	return r
+}
+
+func (p *Pipeline) queue(fn func(c *redigo.Conn) (interface{}, error), res *result) {
+	res.err = errNotExecuted
+	p.queued = append(p.queued, &queuedCmd{fn: fn, res: res})
+}
+
+// 已入队的命令数
+func (p *Pipeline) Len() int {
+	return len(p.queued)
+}
+
+// 发送全部命令并读取结果，返回第一个非ErrNil的错误，各命令的结果和错误在其Result中
+func (p *Pipeline) Exec() error {
+	if len(p.queued) == 0 {
+		return nil
+	}
+	conn := p.rpool.GetConn()
+	defer conn.Close()
+	queued := p.queued
+	p.queued = nil
+
+	if err := record(conn, queued); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	return replay(queued, conn.Receive)
+}
+
+// 以fn发出的命令调用conn.Send
+func record(conn redigo.Conn, queued []*queuedCmd) error {
+	rc := &recordConn{Conn: conn}
+	var c redigo.Conn = rc
+	for _, q := range queued {
+		before := rc.n
+		q.fn(&c)
+		if rc.err != nil {
+			return rc.err
+		}
+		q.n = rc.n - before
+	}
+	return nil
+}
+
+// 以next依次返回的回复重放fn，写入各命令的结果
+func replay(queued []*queuedCmd, next func() (interface{}, error)) error {
+	var firstErr error
+	for _, q := range queued {
+		var c redigo.Conn = &replayConn{next: next, n: q.n}
+		q.res.val, q.res.err = q.fn(&c)
+		if q.res.err != nil && q.res.err != redigo.ErrNil && firstErr == nil {
+			firstErr = q.res.err
+		}
+	}
+	return firstErr
+}
+
+// Do只发送命令不读取回复
+type recordConn struct {
+	redigo.Conn
+	n   int
+	err error
+}
+
+func (rc *recordConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := rc.Conn.Send(cmd, args...); err != nil && rc.err == nil {
+		rc.err = err
+	}
+	rc.n++
+	return nil, errQueued
+}
+
+// Do返回预先取得的回复
+type replayConn struct {
+	redigo.Conn
+	next func() (interface{}, error)
+	n    int
+}
+
+func (rc *replayConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if rc.n == 0 {
+		return nil, errors.New("redis: helper issued more commands on replay than when queued")
+	}
+	rc.n--
+	return rc.next()
+}
+
+// 命令结果，Exec前Err返回未执行错误
+type result struct {
+	val interface{}
+	err error
+}
+
+func (r *result) Err() error {
+	return r.err
+}
+
+type Result struct{ result }
+
+func (r *Result) Val() interface{}             { return r.val }
+func (r *Result) Result() (interface{}, error) { return r.val, r.err }
+
+type StringResult struct{ result }
+
+func (r *StringResult) Val() string             { s, _ := r.val.(string); return s }
+func (r *StringResult) Result() (string, error) { return r.Val(), r.err }
+
+type BytesResult struct{ result }
+
+func (r *BytesResult) Val() []byte             { b, _ := r.val.([]byte); return b }
+func (r *BytesResult) Result() ([]byte, error) { return r.Val(), r.err }
+
+type IntResult struct{ result }
+
+func (r *IntResult) Val() int             { n, _ := r.val.(int); return n }
+func (r *IntResult) Result() (int, error) { return r.Val(), r.err }
+
+type Int64Result struct{ result }
+
+func (r *Int64Result) Val() int64             { n, _ := r.val.(int64); return n }
+func (r *Int64Result) Result() (int64, error) { return r.Val(), r.err }
+
+type Uint64Result struct{ result }
+
+func (r *Uint64Result) Val() uint64             { n, _ := r.val.(uint64); return n }
+func (r *Uint64Result) Result() (uint64, error) { return r.Val(), r.err }
+
+type FloatResult struct{ result }
+
+func (r *FloatResult) Val() float64             { f, _ := r.val.(float64); return f }
+func (r *FloatResult) Result() (float64, error) { return r.Val(), r.err }
+
+type BoolResult struct{ result }
+
+func (r *BoolResult) Val() bool             { b, _ := r.val.(bool); return b }
+func (r *BoolResult) Result() (bool, error) { return r.Val(), r.err }
+
+type StringsResult struct{ result }
+
+func (r *StringsResult) Val() []string             { s, _ := r.val.([]string); return s }
+func (r *StringsResult) Result() ([]string, error) { return r.Val(), r.err }
+
+type ValuesResult struct{ result }
+
+func (r *ValuesResult) Val() []interface{}             { v, _ := r.val.([]interface{}); return v }
+func (r *ValuesResult) Result() ([]interface{}, error) { return r.Val(), r.err }
+
+// command
+func (p *Pipeline) Do(commandName string, args ...interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return (*c).Do(commandName, args...) })
+}
+
+func (p *Pipeline) Expire(key string, ttl int) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return Expire(c, key, ttl) })
+}
+
+func (p *Pipeline) Delete(key string) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return Delete(c, key) })
+}
+
+func (p *Pipeline) Set(key string, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return Set(c, key, data) })
+}
+
+func (p *Pipeline) SetNX(key string, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return SetNX(c, key, data) })
+}
+
+func (p *Pipeline) SetEx(key string, ttl int, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return SetEx(c, key, ttl, data) })
+}
+
+func (p *Pipeline) Get(key string) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return Get(c, key) })
+}
+
+func (p *Pipeline) GetString(key string) *StringResult {
+	r := &StringResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return GetString(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) GetBytes(key string) *BytesResult {
+	r := &BytesResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return redigo.Bytes(Get(c, key)) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) GetInt(key string) *IntResult {
+	r := &IntResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return GetInt(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) GetInt64(key string) *Int64Result {
+	r := &Int64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return GetInt64(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) GetUint64(key string) *Uint64Result {
+	r := &Uint64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return GetUInt64(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) Exists(key string) *BoolResult {
+	r := &BoolResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return Exists(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) Incr(key string) *Int64Result {
+	r := &Int64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return Incr(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) IncrBy(key string, incBy int64) *Int64Result {
+	r := &Int64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return IncrBy(c, key, incBy) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) Decr(key string) *Int64Result {
+	r := &Int64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return Decr(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) Publish(key string, message interface{}) *Int64Result {
+	r := &Int64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return Publish(c, key, message) }, &r.result)
+	return r
+}
+
+// set
+func (p *Pipeline) SAdd(setName string, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return SAdd(c, setName, data) })
+}
+
+func (p *Pipeline) SRem(setName string, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return SRem(c, setName, data) })
+}
+
+func (p *Pipeline) SIsMember(setName string, data interface{}) *BoolResult {
+	r := &BoolResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return SIsMember(c, setName, data) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) SMembers(setName string) *StringsResult {
+	r := &StringsResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return SMembers(c, setName) }, &r.result)
+	return r
+}
+
+// sorted set
+func (p *Pipeline) ZAdd(key string, score float64, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return ZAdd(c, key, score, data) })
+}
+
+func (p *Pipeline) ZRem(key string, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return ZRem(c, key, data) })
+}
+
+func (p *Pipeline) ZRange(key string, start int, end int, withScores bool) *ValuesResult {
+	r := &ValuesResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return ZRange(c, key, start, end, withScores) }, &r.result)
+	return r
+}
+
+// hash map
+func (p *Pipeline) HSet(key string, HKey string, data interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return HSet(c, key, HKey, data) })
+}
+
+func (p *Pipeline) HGet(key string, HKey string) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return HGet(c, key, HKey) })
+}
+
+func (p *Pipeline) HMGet(key string, hashKeys ...string) *ValuesResult {
+	r := &ValuesResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HMGet(c, key, hashKeys...) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HMSet(key string, hashKeys []string, vals []interface{}) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return HMSet(c, key, hashKeys, vals) })
+}
+
+func (p *Pipeline) HGetString(key string, HKey string) *StringResult {
+	r := &StringResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetString(c, key, HKey) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HGetFloat(key string, HKey string) *FloatResult {
+	r := &FloatResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetFloat(c, key, HKey) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HGetInt(key string, HKey string) *IntResult {
+	r := &IntResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetInt(c, key, HKey) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HGetInt64(key string, HKey string) *Int64Result {
+	r := &Int64Result{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetInt64(c, key, HKey) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HGetBool(key string, HKey string) *BoolResult {
+	r := &BoolResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetBool(c, key, HKey) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HDel(key string, HKey string) *Result {
+	return p.Queue(func(c *redigo.Conn) (interface{}, error) { return HDel(c, key, HKey) })
+}
+
+func (p *Pipeline) HGetAllValues(key string) *ValuesResult {
+	r := &ValuesResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetAllValues(c, key) }, &r.result)
+	return r
+}
+
+func (p *Pipeline) HGetAllString(key string) *StringsResult {
+	r := &StringsResult{}
+	p.queue(func(c *redigo.Conn) (interface{}, error) { return HGetAllString(c, key) }, &r.result)
+	return r
+}
@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"sync/atomic"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+func newFakePool(t *testing.T, name string) (*fakeRedis, *RPool) {
+	s := newFakeRedis(t)
+	rpool, err := NewPool(name, newConfigor(t, map[string]interface{}{
+		"server": s.addr,
+	}))
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, rpool
+}
+
+func TestPipeline(t *testing.T) {
+	s, rpool := newFakePool(t, "pipeline")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	var roundTrips int32
+	s.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+		atomic.AddInt32(&roundTrips, 1)
+		return nil, false
+	})
+
+	p := rpool.Pipeline()
+	p.Set("n", 41)
+	incr := p.Incr("n")
+	p.HSet("user:1", "name", "alice")
+	p.HSet("user:1", "age", 30)
+	name := p.HGetString("user:1", "name")
+	age := p.HGetInt64("user:1", "age")
+	missing := p.GetString("missing")
+	custom := p.Queue(func(c *redigo.Conn) (interface{}, error) { return Exists(c, "n") })
+	if err := name.Err(); err != errNotExecuted {
+		t.Fatalf("result before Exec must report not executed, got %v", err)
+	}
+	if p.Len() != 8 {
+		t.Fatalf("pipeline must queue 8 commands, got %d", p.Len())
+	}
+
+	if err := p.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if incr.Val() != 42 || name.Val() != "alice" || age.Val() != 30 {
+		t.Fatalf("typed results mismatch: %d %q %d", incr.Val(), name.Val(), age.Val())
+	}
+	if _, err := missing.Result(); err != redigo.ErrNil {
+		t.Fatalf("missing key must report ErrNil, got %v", err)
+	}
+	if custom.Val() != true {
+		t.Fatalf("queued helper must return its typed value, got %v", custom.Val())
+	}
+	if n := atomic.LoadInt32(&roundTrips); n != 8 {
+		t.Fatalf("each queued command is sent once, got %d", n)
+	}
+	if p.Len() != 0 {
+		t.Fatal("Exec must reset the queue")
+	}
+
+	// 命令错误不影响其他结果
+	p.Do("NOSUCHCMD")
+	ok := p.GetInt("n")
+	if err := p.Exec(); err == nil {
+		t.Fatal("Exec must return the command error")
+	}
+	if ok.Val() != 42 {
+		t.Fatalf("other commands must still succeed, got %d", ok.Val())
+	}
+}
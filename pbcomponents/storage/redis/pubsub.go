@@ -0,0 +1,392 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+	"keywea.com/cloud/pblib/pbactor/actor"
+)
+
+const (
+	subscriberPingInterval = 10 * time.Second
+	subscriberMinBackoff   = 100 * time.Millisecond
+	subscriberMaxBackoff   = 10 * time.Second
+)
+
+var errSubscriberClosed = errors.New("redis: subscriber closed")
+
+// 订阅收到的消息，Pattern仅PSUBSCRIBE时有值
+type Message struct {
+	Pattern string
+	Channel string
+	Data    []byte
+}
+
+type MessageHandler func(msg *Message)
+
+// 持有独立连接的订阅者，定时PING检查连接，断开后按退避重连并恢复全部订阅
+// 同一订阅者的消息在一个goroutine中按顺序分发，handler不应长时间阻塞
+type Subscriber struct {
+	rpool *RPool
+
+	channels  map[string][]MessageHandler
+	patterns  map[string][]MessageHandler
+	psc       *redigo.PubSubConn
+	connected bool
+	closed    bool
+	mu        sync.Mutex
+	wmu       sync.Mutex // 串行化向连接的写入
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (rpool *RPool) NewSubscriber() *Subscriber {
+	s := &Subscriber{
+		rpool:    rpool,
+		channels: make(map[string][]MessageHandler),
+		patterns: make(map[string][]MessageHandler),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+// 订阅使用不属于连接池的独立连接，cluster模式下消息在节点间广播，连接任一节点即可
+func (rpool *RPool) dialPubSub() (redigo.Conn, error) {
+	switch {
+	case rpool.cluster != nil:
+		addr, err := rpool.cluster.randomAddr()
+		if err != nil {
+			return nil, err
+		}
+		pool, err := rpool.cluster.pool(addr)
+		if err != nil {
+			return nil, err
+		}
+		return pool.Dial()
+	case rpool.sentinel != nil:
+		return rpool.sentinel.current.Load().(*redigo.Pool).Dial()
+	}
+	return rpool.pool.Dial()
+}
+
+func (s *Subscriber) Subscribe(handler MessageHandler, channels ...string) error {
+	return s.add(s.channels, "SUBSCRIBE", handler, channels)
+}
+
+func (s *Subscriber) PSubscribe(handler MessageHandler, patterns ...string) error {
+	return s.add(s.patterns, "PSUBSCRIBE", handler, patterns)
+}
+
+// 消息写入ch，ch已满时阻塞分发直到写入或订阅者关闭
+func (s *Subscriber) SubscribeChan(ch chan<- *Message, channels ...string) error {
+	return s.Subscribe(s.chanHandler(ch), channels...)
+}
+
+func (s *Subscriber) PSubscribeChan(ch chan<- *Message, patterns ...string) error {
+	return s.PSubscribe(s.chanHandler(ch), patterns...)
+}
+
+// 以*Message投递给actor
+func (s *Subscriber) SubscribePID(pid *actor.PID, channels ...string) error {
+	return s.Subscribe(pidHandler(pid), channels...)
+}
+
+func (s *Subscriber) PSubscribePID(pid *actor.PID, patterns ...string) error {
+	return s.PSubscribe(pidHandler(pid), patterns...)
+}
+
+func (s *Subscriber) chanHandler(ch chan<- *Message) MessageHandler {
+	return func(msg *Message) {
+		select {
+		case ch <- msg:
+		case <-s.stop:
+		}
+	}
+}
+
+func pidHandler(pid *actor.PID) MessageHandler {
+	return func(msg *Message) {
+		actor.EmptyRootContext.Send(pid, msg)
+	}
+}
+
+// 取消订阅并移除其全部handler
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	return s.remove(s.channels, "UNSUBSCRIBE", channels)
+}
+
+func (s *Subscriber) PUnsubscribe(patterns ...string) error {
+	return s.remove(s.patterns, "PUNSUBSCRIBE", patterns)
+}
+
+// 当前是否持有已订阅的连接
+func (s *Subscriber) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	psc := s.psc
+	s.mu.Unlock()
+	if psc != nil {
+		psc.Conn.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Subscriber) add(set map[string][]MessageHandler, cmd string, handler MessageHandler, names []string) error {
+	if handler == nil || len(names) == 0 {
+		return errors.New("redis: subscribe requires a handler and at least one channel")
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSubscriberClosed
+	}
+	var added []interface{}
+	for _, name := range names {
+		if len(set[name]) == 0 {
+			added = append(added, name)
+		}
+		set[name] = append(set[name], handler)
+	}
+	psc := s.psc
+	s.mu.Unlock()
+
+	if len(added) == 0 {
+		return nil
+	}
+	if psc == nil {
+		s.notify()
+		return nil
+	}
+	// 发送失败时连接已断开，重连后恢复订阅
+	s.send(psc, cmd, added)
+	return nil
+}
+
+func (s *Subscriber) remove(set map[string][]MessageHandler, cmd string, names []string) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSubscriberClosed
+	}
+	var removed []interface{}
+	for _, name := range names {
+		if _, ok := set[name]; ok {
+			delete(set, name)
+			removed = append(removed, name)
+		}
+	}
+	psc := s.psc
+	s.mu.Unlock()
+
+	if psc != nil && len(removed) > 0 {
+		s.send(psc, cmd, removed)
+	}
+	return nil
+}
+
+func (s *Subscriber) send(psc *redigo.PubSubConn, cmd string, args []interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := psc.Conn.Send(cmd, args...); err != nil {
+		return err
+	}
+	return psc.Conn.Flush()
+}
+
+func (s *Subscriber) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscriber) loop() {
+	defer s.wg.Done()
+	backoff := subscriberMinBackoff
+	for {
+		established, err := s.run()
+		if established {
+			backoff = subscriberMinBackoff
+		}
+		if err == nil {
+			// 没有订阅，等待新的订阅
+			select {
+			case <-s.stop:
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		plog.Warn("[REDIS] subscriber disconnected", log.String("pool", s.rpool.name), log.Error(err),
+			log.Duration("backoff", backoff))
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > subscriberMaxBackoff {
+			backoff = subscriberMaxBackoff
+		}
+	}
+}
+
+// 建立连接并订阅当前全部频道，读取消息直到连接出错；没有订阅时返回nil
+func (s *Subscriber) run() (bool, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, errSubscriberClosed
+	}
+	s.mu.Unlock()
+	if !s.hasSubscriptions() {
+		return false, nil
+	}
+
+	conn, err := s.rpool.dialPubSub()
+	if err != nil {
+		return false, err
+	}
+	psc := &redigo.PubSubConn{Conn: conn}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return false, errSubscriberClosed
+	}
+	channels := keysOf(s.channels)
+	patterns := keysOf(s.patterns)
+	s.psc = psc
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.psc = nil
+		s.connected = false
+		pending := len(s.channels) > 0 || len(s.patterns) > 0
+		s.mu.Unlock()
+		conn.Close()
+		// 释放连接期间新增的订阅
+		if pending {
+			s.notify()
+		}
+	}()
+
+	if len(channels) > 0 {
+		if err := s.send(psc, "SUBSCRIBE", channels); err != nil {
+			return false, err
+		}
+	}
+	if len(patterns) > 0 {
+		if err := s.send(psc, "PSUBSCRIBE", patterns); err != nil {
+			return false, err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(subscriberPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if s.send(psc, "PING", nil) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	established := false
+	for {
+		switch v := psc.ReceiveWithTimeout(3 * subscriberPingInterval).(type) {
+		case redigo.Message:
+			s.dispatch(v)
+		case redigo.Subscription:
+			if !established {
+				established = true
+				s.mu.Lock()
+				s.connected = true
+				s.mu.Unlock()
+				plog.Info("[REDIS] subscriber connected", log.String("pool", s.rpool.name),
+					log.Int("channels", len(channels)), log.Int("patterns", len(patterns)))
+			}
+			// 全部取消后释放连接，有新订阅时再连接
+			if v.Count == 0 && !s.hasSubscriptions() {
+				return established, nil
+			}
+		case redigo.Pong:
+		case error:
+			return established, v
+		}
+	}
+}
+
+func (s *Subscriber) dispatch(v redigo.Message) {
+	s.mu.Lock()
+	var handlers []MessageHandler
+	if v.Pattern != "" {
+		handlers = append(handlers, s.patterns[v.Pattern]...)
+	} else {
+		handlers = append(handlers, s.channels[v.Channel]...)
+	}
+	s.mu.Unlock()
+
+	msg := &Message{Pattern: v.Pattern, Channel: v.Channel, Data: v.Data}
+	for _, h := range handlers {
+		s.call(h, msg)
+	}
+}
+
+func (s *Subscriber) call(h MessageHandler, msg *Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			plog.Error("[REDIS] subscriber handler panic", log.String("pool", s.rpool.name),
+				log.String("channel", msg.Channel), log.String("panic", fmt.Sprint(r)))
+		}
+	}()
+	h(msg)
+}
+
+func (s *Subscriber) hasSubscriptions() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels) > 0 || len(s.patterns) > 0
+}
+
+func keysOf(m map[string][]MessageHandler) []interface{} {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
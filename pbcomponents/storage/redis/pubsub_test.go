@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"keywea.com/cloud/pblib/pbactor/actor"
+)
+
+func recvMessage(t *testing.T, ch <-chan *Message) *Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	return nil
+}
+
+// 重复发布直到有客户端接收，用于等待订阅生效
+func publishWhenSubscribed(t *testing.T, s *fakeRedis, channel, message string) {
+	waitFor(t, "subscription of "+channel, func() bool {
+		return s.publish(channel, message) > 0
+	})
+}
+
+func TestSubscriber(t *testing.T) {
+	s, rpool := newFakePool(t, "pubsub")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	sub := rpool.NewSubscriber()
+	defer sub.Close()
+
+	handled := make(chan *Message, 8)
+	if err := sub.Subscribe(func(msg *Message) { handled <- msg }, "news", "sports"); err != nil {
+		t.Fatal(err)
+	}
+	patterned := make(chan *Message, 8)
+	if err := sub.PSubscribeChan(patterned, "user.*"); err != nil {
+		t.Fatal(err)
+	}
+	pids := make(chan *Message, 8)
+	pid := actor.Spawn(actor.FromFunc(func(ctx actor.Context) {
+		if msg, ok := ctx.Message().(*Message); ok {
+			pids <- msg
+		}
+	}))
+	defer pid.Stop()
+	if err := sub.SubscribePID(pid, "events"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "connected", sub.Connected)
+
+	publishWhenSubscribed(t, s, "news", "hello")
+	if msg := recvMessage(t, handled); msg.Channel != "news" || string(msg.Data) != "hello" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if n, err := rpool.Publish("sports", "goal"); err != nil || n != 1 {
+		t.Fatalf("publish: %d %v", n, err)
+	}
+	if msg := recvMessage(t, handled); msg.Channel != "sports" || string(msg.Data) != "goal" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	publishWhenSubscribed(t, s, "user.42", "login")
+	if msg := recvMessage(t, patterned); msg.Pattern != "user.*" || msg.Channel != "user.42" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	publishWhenSubscribed(t, s, "events", "tick")
+	if msg := recvMessage(t, pids); string(msg.Data) != "tick" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	// 断开后重连并恢复全部订阅
+	s.closeConns()
+	waitFor(t, "reconnected", func() bool {
+		return s.publish("news", "again") > 0
+	})
+	if msg := recvMessage(t, handled); string(msg.Data) != "again" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	publishWhenSubscribed(t, s, "user.7", "back")
+	if msg := recvMessage(t, patterned); msg.Channel != "user.7" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	if err := sub.Unsubscribe("news", "sports"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unsubscribed", func() bool {
+		return s.publish("news", "gone") == 0
+	})
+	sub.Close()
+	if err := sub.Subscribe(func(*Message) {}, "news"); err != errSubscriberClosed {
+		t.Fatalf("expected errSubscriberClosed, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	redigo "github.com/gomodule/redigo/redis"
 	"keywea.com/cloud/pblib/pbconfig"
 	"keywea.com/cloud/pblib/pb/events"
+	"keywea.com/cloud/pblib/pb/log"
 	"sync"
 	"time"
 )
@@ -48,6 +49,12 @@ const (
 	REDIS_CMD_PUBLISH     	  = "PUBLISH"
 )
 
+const (
+	ModeStandalone = "standalone"
+	ModeCluster    = "cluster"
+	ModeSentinel   = "sentinel"
+)
+
 var (
 	errNotFoundRedisPool = errors.New("Redis Pool Not Found")
 
@@ -78,6 +85,8 @@ var (
 		return c.Err()
 	}
 
+	cmdLogger = log.NewStdLogger(log.New("[REDIS]"), log.LevelDebug)
+
 	rediS *pbredis
 	rmu sync.Mutex
 )
@@ -96,6 +105,16 @@ type PoolConfig struct {
 	TestOnBorrow      bool
 	IdleTimeout       time.Duration
 	Wait              bool
+	LogCommands       bool // 以Debug级别记录每条命令及返回
+
+	Mode                   string        // standalone(默认)、cluster、sentinel
+	Servers                []string      // cluster模式的种子节点，默认为Server
+	ClusterRefreshInterval time.Duration // cluster模式定时刷新slot分布的间隔(秒)
+
+	Sentinels        []string // sentinel模式的sentinel地址
+	MasterName       string
+	SentinelPassword string
+	ReadFromReplicas bool // sentinel模式下只读命令发往从节点
 }
 
 type pbredis struct {
@@ -137,6 +156,36 @@ func (r *pbredis) createPool(name string, configor pbconfig.Configor) (*RPool, e
 }
 
 func (r *pbredis) create(config PoolConfig) (*RPool, error) {
+	rpool := &RPool{name: config.Name}
+	switch config.Mode {
+	case ModeCluster:
+		cluster, err := newCluster(config)
+		if err != nil {
+			return nil, err
+		}
+		rpool.cluster = cluster
+	case ModeSentinel:
+		sentinel, err := newSentinel(config)
+		if err != nil {
+			return nil, err
+		}
+		rpool.sentinel = sentinel
+	default:
+		pool := newRedigoPool(config, config.Server)
+		if err := testFunc(pool); err != nil {
+			return nil, err
+		}
+		rpool.pool = pool
+	}
+
+	r.redisPool[config.Name] = rpool
+	r.poolConfigs[config.Name] = config
+
+	return rpool, nil
+}
+
+// 按配置创建连接address的连接池
+func newRedigoPool(config PoolConfig, address string) *redigo.Pool {
 	pool := &redigo.Pool{}
 	dialOptions := []redigo.DialOption{}
 	if config.ConnectionTimeout > 0 {
@@ -151,10 +200,20 @@ func (r *pbredis) create(config PoolConfig) (*RPool, error) {
 	if config.Password != "" {
 		dialOptions = append(dialOptions, redigo.DialPassword(config.Password))
 	}
-	dialOptions = append(dialOptions, redigo.DialDatabase(config.DB))
+	// cluster模式只有db 0
+	if config.Mode != ModeCluster {
+		dialOptions = append(dialOptions, redigo.DialDatabase(config.DB))
+	}
 
-	pool.Dial = dialFunc(config.Network, config.Server, dialOptions)
+	pool.Dial = dialFunc(config.Network, address, dialOptions)
+	if config.LogCommands {
+		pool.Dial = loggingDial(config.Name, pool.Dial)
+	}
+	tunePool(pool, config)
+	return pool
+}
 
+func tunePool(pool *redigo.Pool, config PoolConfig) {
 	if config.MaxIdle > 0 {
 		pool.MaxIdle = config.MaxIdle
 	}
@@ -163,24 +222,23 @@ func (r *pbredis) create(config PoolConfig) (*RPool, error) {
 	}
 	if config.TestOnBorrow {
 		pool.TestOnBorrow = testOnBorrowFunc
+	} else {
+		pool.TestOnBorrow = nil
 	}
-
 	if config.IdleTimeout > 0 {
 		pool.IdleTimeout = time.Second * config.IdleTimeout
 	}
 	pool.Wait = config.Wait
+}
 
-	if err := testFunc(pool); err != nil {
-		return nil, err
-	}
-
-	r.redisPool[config.Name] = &RPool{
-		name: config.Name,
-		pool: pool,
+func loggingDial(name string, dial func() (redigo.Conn, error)) func() (redigo.Conn, error) {
+	return func() (redigo.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		return redigo.NewLoggingConn(conn, cmdLogger, name), nil
 	}
-	r.poolConfigs[config.Name] = config
-
-	return r.redisPool[config.Name], nil
 }
 
 func (r *pbredis) parseConfig(configor pbconfig.Configor) PoolConfig {
@@ -192,11 +250,19 @@ func (r *pbredis) parseConfig(configor pbconfig.Configor) PoolConfig {
 	idleTimeout, _ := configor.GetInt("idleTimeout", 300) // 5min
 	testOnBorrow, _ := configor.GetBool("testOnBorrow")
 	wait, _ := configor.GetBool("wait")
+	logCommands, _ := configor.GetBool("logCommands")
 	db, _ := configor.GetInt("db", 0)
+	clusterRefreshInterval, _ := configor.GetInt("clusterRefreshInterval", 60)
+	server := configor.GetString("server", "127.0.0.1:6379")
+	readFromReplicas, _ := configor.GetBool("readFromReplicas")
+	servers := getStrings(configor, "servers")
+	if len(servers) == 0 {
+		servers = append(servers, server)
+	}
 
 	return PoolConfig{
 		Network: configor.GetString("network", "tcp"),
-		Server: configor.GetString("server", "127.0.0.1:6379"),
+		Server: server,
 		ConnectionTimeout: time.Duration(connectionTimeout),
 		ReadTimeout: time.Duration(readTimeout),
 		WriteTimeout: time.Duration(writeTimeout),
@@ -207,7 +273,29 @@ func (r *pbredis) parseConfig(configor pbconfig.Configor) PoolConfig {
 		IdleTimeout: time.Duration(idleTimeout),
 		TestOnBorrow: testOnBorrow,
 		Wait: wait,
+		LogCommands: logCommands,
+		Mode: configor.GetString("mode", ModeStandalone),
+		Servers: servers,
+		ClusterRefreshInterval: time.Duration(clusterRefreshInterval),
+		Sentinels: getStrings(configor, "sentinels"),
+		MasterName: configor.GetString("masterName", ""),
+		SentinelPassword: configor.GetString("sentinelPassword", ""),
+		ReadFromReplicas: readFromReplicas,
+	}
+}
+
+func getStrings(configor pbconfig.Configor, key string) []string {
+	values := []string{}
+	if raw, err := configor.GetRawValue(key); err == nil {
+		if list, ok := raw.([]interface{}); ok {
+			for _, v := range list {
+				if s, ok := v.(string); ok && s != "" {
+					values = append(values, s)
+				}
+			}
+		}
 	}
+	return values
 }
 
 func (r *pbredis) Get(name string) redigo.Conn {
@@ -1,5 +1,783 @@
 package redis
 
-func discoverClusterNodesAndSlots() {
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-}
\ No newline at end of file
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+)
+
+var (
+	errClusterNoNodes       = errors.New("redis cluster: no reachable node")
+	errClusterRedirects     = errors.New("redis cluster: too many redirections")
+	errClusterConnClosed    = errors.New("redis cluster: connection closed")
+	errClusterSlotUncovered = errors.New("redis cluster: slot not covered")
+
+	// 不带key的命令发往任意节点，事务中发往绑定节点
+	clusterKeylessCommands = map[string]bool{
+		"PING": true, "ECHO": true, "INFO": true, "TIME": true, "DBSIZE": true, "CLUSTER": true,
+		"SCRIPT": true, "KEYS": true, "RANDOMKEY": true, "FLUSHDB": true, "FLUSHALL": true,
+	}
+	// 作用于整个库的命令，事务外发往全部主节点并合并结果
+	clusterFanoutCommands = map[string]bool{
+		"KEYS": true, "DBSIZE": true, "RANDOMKEY": true, "FLUSHDB": true, "FLUSHALL": true,
+	}
+	clusterTxCommands = map[string]bool{
+		"WATCH": true, "UNWATCH": true, "MULTI": true, "EXEC": true, "DISCARD": true,
+	}
+)
+
+// Redis Cluster客户端，按CLUSTER SLOTS维护slot到节点的映射，每个节点一个连接池
+type Cluster struct {
+	name string
+
+	config     PoolConfig
+	slots      [clusterSlots]string // slot -> 主节点地址
+	pools      map[string]*redigo.Pool
+	refreshing int32
+	closed     bool
+	mu         sync.RWMutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCluster(config PoolConfig) (*Cluster, error) {
+	c := &Cluster{
+		name:   config.Name,
+		config: config,
+		pools:  make(map[string]*redigo.Pool),
+		stop:   make(chan struct{}),
+	}
+	if err := c.refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if config.ClusterRefreshInterval > 0 {
+		c.wg.Add(1)
+		go c.refreshLoop(time.Second * config.ClusterRefreshInterval)
+	}
+	return c, nil
+}
+
+func (c *Cluster) refreshLoop(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				plog.Warn("[REDIS] refresh cluster slots failed", log.String("pool", c.name), log.Error(err))
+			}
+		}
+	}
+}
+
+// 返回按key路由的连接，使用完需Close
+func (c *Cluster) Get() redigo.Conn {
+	return &clusterConn{cluster: c, conns: make(map[string]redigo.Conn)}
+}
+
+// 当前已知的主节点地址
+func (c *Cluster) Nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodesLocked()
+}
+
+// key所在的节点地址
+func (c *Cluster) NodeForKey(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[Slot(key)]
+}
+
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.stop)
+	pools := c.pools
+	c.pools = make(map[string]*redigo.Pool)
+	c.mu.Unlock()
+
+	c.wg.Wait()
+	for _, pool := range pools {
+		pool.Close()
+	}
+	return nil
+}
+
+func (c *Cluster) updateConfig(config PoolConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+	for _, pool := range c.pools {
+		tunePool(pool, config)
+	}
+}
+
+// 调用方持有写锁
+func (c *Cluster) poolLocked(addr string) *redigo.Pool {
+	pool, ok := c.pools[addr]
+	if !ok {
+		pool = newRedigoPool(c.config, addr)
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+func (c *Cluster) pool(addr string) (*redigo.Pool, error) {
+	c.mu.RLock()
+	pool, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return pool, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errClusterConnClosed
+	}
+	return c.poolLocked(addr), nil
+}
+
+func (c *Cluster) addrForSlot(slot int) (string, error) {
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr == "" {
+		c.triggerRefresh()
+		return "", fmt.Errorf("%v: %d", errClusterSlotUncovered, slot)
+	}
+	return addr, nil
+}
+
+func (c *Cluster) randomAddr() (string, error) {
+	nodes := c.Nodes()
+	if len(nodes) == 0 {
+		return "", errClusterNoNodes
+	}
+	return nodes[rand.Intn(len(nodes))], nil
+}
+
+// 收到MOVED时先更新该slot，再异步刷新整个映射
+func (c *Cluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+	c.triggerRefresh()
+}
+
+func (c *Cluster) triggerRefresh() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		atomic.StoreInt32(&c.refreshing, 0)
+		return
+	}
+	c.wg.Add(1)
+	c.mu.RUnlock()
+	go func() {
+		defer c.wg.Done()
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		if err := c.refresh(); err != nil {
+			plog.Warn("[REDIS] refresh cluster slots failed", log.String("pool", c.name), log.Error(err))
+		}
+	}()
+}
+
+// 依次向已知节点和种子节点请求CLUSTER SLOTS，成功后替换映射并关闭下线节点的连接池
+func (c *Cluster) refresh() error {
+	c.mu.RLock()
+	candidates := append(c.nodesLocked(), c.config.Servers...)
+	c.mu.RUnlock()
+
+	var lastErr error = errClusterNoNodes
+	for _, addr := range candidates {
+		slots, err := c.fetchSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.applySlots(slots)
+		return nil
+	}
+	return lastErr
+}
+
+func (c *Cluster) nodesLocked() []string {
+	nodes := make([]string, 0, len(c.pools))
+	for addr := range c.pools {
+		nodes = append(nodes, addr)
+	}
+	return nodes
+}
+
+type slotRange struct {
+	start, end int
+	addr       string
+}
+
+func (c *Cluster) fetchSlots(addr string) ([]slotRange, error) {
+	pool, err := c.pool(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redigo.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	return parseClusterSlots(values, addr)
+}
+
+// [[start, end, [ip, port, id], [replica...]], ...]
+func parseClusterSlots(values []interface{}, from string) ([]slotRange, error) {
+	ranges := make([]slotRange, 0, len(values))
+	for _, v := range values {
+		item, err := redigo.Values(v, nil)
+		if err != nil || len(item) < 3 {
+			return nil, fmt.Errorf("redis cluster: invalid CLUSTER SLOTS reply %v", v)
+		}
+		start, err1 := redigo.Int(item[0], nil)
+		end, err2 := redigo.Int(item[1], nil)
+		master, err3 := redigo.Values(item[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 {
+			return nil, fmt.Errorf("redis cluster: invalid CLUSTER SLOTS reply %v", v)
+		}
+		ip, _ := redigo.String(master[0], nil)
+		port, err := redigo.Int(master[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("redis cluster: invalid CLUSTER SLOTS reply %v", v)
+		}
+		// 节点未公布ip时使用请求的节点地址
+		if ip == "" {
+			ip, _, _ = net.SplitHostPort(from)
+		}
+		ranges = append(ranges, slotRange{start: start, end: end, addr: net.JoinHostPort(ip, strconv.Itoa(port))})
+	}
+	return ranges, nil
+}
+
+func (c *Cluster) applySlots(ranges []slotRange) {
+	var slots [clusterSlots]string
+	alive := make(map[string]bool)
+	for _, r := range ranges {
+		for i := r.start; i <= r.end && i < clusterSlots; i++ {
+			slots[i] = r.addr
+		}
+		alive[r.addr] = true
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	changed := c.slots != slots
+	c.slots = slots
+	for addr := range alive {
+		c.poolLocked(addr)
+	}
+	var removed []*redigo.Pool
+	for addr, pool := range c.pools {
+		if !alive[addr] {
+			removed = append(removed, pool)
+			delete(c.pools, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	if changed {
+		plog.Info("[REDIS] cluster slots updated", log.String("pool", c.name), log.Int("nodes", len(alive)))
+	}
+	for _, pool := range removed {
+		pool.Close()
+	}
+}
+
+// 计算key的slot，key含非空{tag}时只对tag计算
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// CRC16-CCITT(XMODEM)
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// 命令的第一个key，没有key时返回false
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	if clusterKeylessCommands[cmd] || len(args) == 0 {
+		return "", false
+	}
+	switch cmd {
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := redigo.Int(args[1], nil); err != nil || n == 0 {
+			return "", false
+		}
+		return argString(args[2]), true
+	case "XREAD", "XREADGROUP":
+		for i, arg := range args {
+			if strings.ToUpper(argString(arg)) == "STREAMS" && i+1 < len(args) {
+				return argString(args[i+1]), true
+			}
+		}
+		return "", false
+	case "XGROUP", "XINFO":
+		// XGROUP CREATE key group id
+		if len(args) < 2 {
+			return "", false
+		}
+		return argString(args[1]), true
+	}
+	return argString(args[0]), true
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// MOVED 3999 127.0.0.1:6381、ASK 3999 127.0.0.1:6381
+func parseRedirect(err error) (kind string, slot int, addr string, ok bool) {
+	rerr, isReply := err.(redigo.Error)
+	if !isReply {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, perr := strconv.Atoi(fields[1])
+	if perr != nil {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+type clusterReply struct {
+	reply interface{}
+	err   error
+}
+
+// 每条命令按key路由到对应节点并处理MOVED、ASK重定向
+// WATCH、MULTI之后的命令发往同一节点，事务内的key需使用相同的{tag}
+// Send缓存的命令在Receive时按节点分组pipeline执行，不同节点间的命令不保证执行顺序
+// 事务中的命令、不带key的命令逐条执行
+type clusterConn struct {
+	cluster *Cluster
+	conns   map[string]redigo.Conn
+
+	bound     string // 事务绑定的节点
+	multi     bool
+	multiSent bool
+	pending   []clusterCommand
+	replies   []clusterReply // 已pipeline执行、未Receive的结果
+	err       error
+}
+
+func (cc *clusterConn) Close() error {
+	if cc.err == errClusterConnClosed {
+		return nil
+	}
+	// 连接池归还连接时会丢弃未完成的事务和WATCH
+	var err error
+	for _, conn := range cc.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	cc.conns = nil
+	cc.err = errClusterConnClosed
+	return err
+}
+
+func (cc *clusterConn) Err() error {
+	return cc.err
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	if cc.err != nil {
+		return cc.err
+	}
+	cc.pending = append(cc.pending, clusterCommand{name: cmd, args: args})
+	return nil
+}
+
+func (cc *clusterConn) Flush() error {
+	return cc.err
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if cc.err != nil {
+		return nil, cc.err
+	}
+	if len(cc.replies) > 0 {
+		r := cc.replies[0]
+		cc.replies = cc.replies[1:]
+		return r.reply, r.err
+	}
+	if len(cc.pending) == 0 {
+		return nil, errors.New("redis cluster: no pending command to receive")
+	}
+	if n := cc.batchable(); n > 1 {
+		cc.replies = cc.pipeline(cc.pending[:n])
+		cc.pending = cc.pending[n:]
+		return cc.Receive()
+	}
+	cmd := cc.pending[0]
+	cc.pending = cc.pending[1:]
+	return cc.do(cmd.name, cmd.args)
+}
+
+// 与redigo一致，先执行缓存的命令，cmd为空时返回最后一条的结果
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cc.err != nil {
+		return nil, cc.err
+	}
+	var reply interface{}
+	var err error
+	for len(cc.pending) > 0 || len(cc.replies) > 0 {
+		reply, err = cc.Receive()
+	}
+	if cmd == "" {
+		return reply, err
+	}
+	return cc.do(cmd, args)
+}
+
+func (cc *clusterConn) conn(addr string) (redigo.Conn, error) {
+	if conn, ok := cc.conns[addr]; ok {
+		return conn, nil
+	}
+	pool, err := cc.cluster.pool(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := pool.Get()
+	cc.conns[addr] = conn
+	return conn, nil
+}
+
+func (cc *clusterConn) do(cmd string, args []interface{}) (interface{}, error) {
+	name := strings.ToUpper(cmd)
+	switch name {
+	case "WATCH":
+		if cc.bound == "" {
+			if err := cc.bind(name, args); err != nil {
+				return nil, err
+			}
+		}
+		return cc.doBound(cmd, args)
+	case "MULTI":
+		cc.multi = true
+		if cc.bound == "" {
+			// 第一条命令确定节点后再发送MULTI
+			return "OK", nil
+		}
+		cc.multiSent = true
+		return cc.doBound(cmd, args)
+	case "EXEC", "DISCARD":
+		if cc.bound == "" {
+			if err := cc.bind(name, args); err != nil {
+				return nil, err
+			}
+		}
+		if cc.multi && !cc.multiSent {
+			if _, err := cc.doBound("MULTI", nil); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := cc.doBound(cmd, args)
+		cc.bound, cc.multi, cc.multiSent = "", false, false
+		return reply, err
+	case "UNWATCH":
+		if cc.bound == "" {
+			return "OK", nil
+		}
+		reply, err := cc.doBound(cmd, args)
+		if !cc.multi {
+			cc.bound = ""
+		}
+		return reply, err
+	}
+
+	if cc.multi {
+		if cc.bound == "" {
+			if err := cc.bind(name, args); err != nil {
+				return nil, err
+			}
+		}
+		if !cc.multiSent {
+			if _, err := cc.doBound("MULTI", nil); err != nil {
+				return nil, err
+			}
+			cc.multiSent = true
+		}
+		return cc.doBound(cmd, args)
+	}
+	if cc.bound != "" {
+		return cc.doBound(cmd, args)
+	}
+
+	if clusterFanoutCommands[name] {
+		return cc.doAll(name, cmd, args)
+	}
+	key, ok := commandKey(name, args)
+	if !ok {
+		addr, err := cc.cluster.randomAddr()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := cc.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Do(cmd, args...)
+	}
+	return cc.doRouted(Slot(key), cmd, args)
+}
+
+func (cc *clusterConn) bind(name string, args []interface{}) error {
+	var addr string
+	var err error
+	if key, ok := commandKey(name, args); ok {
+		addr, err = cc.cluster.addrForSlot(Slot(key))
+	} else {
+		addr, err = cc.cluster.randomAddr()
+	}
+	if err != nil {
+		return err
+	}
+	cc.bound = addr
+	return nil
+}
+
+// 事务内的MOVED无法透明重试，刷新映射后返回给调用方
+func (cc *clusterConn) doBound(cmd string, args []interface{}) (interface{}, error) {
+	conn, err := cc.conn(cc.bound)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.Do(cmd, args...)
+	if kind, slot, addr, ok := parseRedirect(err); ok && kind == "MOVED" {
+		cc.cluster.moved(slot, addr)
+	}
+	return reply, err
+}
+
+func (cc *clusterConn) doRouted(slot int, cmd string, args []interface{}) (interface{}, error) {
+	addr, err := cc.cluster.addrForSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for i := 0; i <= clusterMaxRedirects; i++ {
+		conn, err := cc.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.Do(cmd, args...)
+		kind, rslot, raddr, ok := parseRedirect(err)
+		if !ok {
+			if err != nil && conn.Err() != nil {
+				// 节点不可用，可能正在故障转移
+				cc.cluster.triggerRefresh()
+			}
+			return reply, err
+		}
+		// ASK只对本次请求有效，不更新映射
+		if kind == "MOVED" {
+			cc.cluster.moved(rslot, raddr)
+		}
+		addr, asking = raddr, kind == "ASK"
+	}
+	return nil, errClusterRedirects
+}
+
+// 在全部主节点上执行，KEYS合并各节点的key，DBSIZE求和，RANDOMKEY返回随机节点上的非空结果
+func (cc *clusterConn) doAll(name, cmd string, args []interface{}) (interface{}, error) {
+	nodes := cc.cluster.Nodes()
+	if len(nodes) == 0 {
+		return nil, errClusterNoNodes
+	}
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	var (
+		last  interface{}
+		keys  = make([]interface{}, 0)
+		total int64
+	)
+	for _, addr := range nodes {
+		conn, err := cc.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := conn.Do(cmd, args...)
+		if err != nil {
+			return nil, fmt.Errorf("redis cluster: node %s: %v", addr, err)
+		}
+		switch name {
+		case "KEYS":
+			values, err := redigo.Values(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, values...)
+		case "DBSIZE":
+			n, err := redigo.Int64(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			total += n
+		case "RANDOMKEY":
+			if reply != nil {
+				return reply, nil
+			}
+		}
+		last = reply
+	}
+	switch name {
+	case "KEYS":
+		return keys, nil
+	case "DBSIZE":
+		return total, nil
+	}
+	return last, nil
+}
+
+// 待执行命令中可以pipeline的前缀长度，不在事务中且命令带key
+func (cc *clusterConn) batchable() int {
+	if cc.bound != "" || cc.multi {
+		return 0
+	}
+	for i, cmd := range cc.pending {
+		name := strings.ToUpper(cmd.name)
+		if clusterTxCommands[name] {
+			return i
+		}
+		if _, ok := commandKey(name, cmd.args); !ok {
+			return i
+		}
+	}
+	return len(cc.pending)
+}
+
+// 按slot映射分组，在各节点上pipeline执行，收到MOVED、ASK的命令之后逐条重试
+func (cc *clusterConn) pipeline(cmds []clusterCommand) []clusterReply {
+	replies := make([]clusterReply, len(cmds))
+	slots := make([]int, len(cmds))
+	groups := make(map[string][]int)
+	var addrs []string
+	for i, cmd := range cmds {
+		key, _ := commandKey(strings.ToUpper(cmd.name), cmd.args)
+		slots[i] = Slot(key)
+		addr, err := cc.cluster.addrForSlot(slots[i])
+		if err != nil {
+			replies[i].err = err
+			continue
+		}
+		if _, ok := groups[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		groups[addr] = append(groups[addr], i)
+	}
+
+	var redirected []int
+	for _, addr := range addrs {
+		idx := groups[addr]
+		conn, err := cc.conn(addr)
+		for j := 0; err == nil && j < len(idx); j++ {
+			err = conn.Send(cmds[idx[j]].name, cmds[idx[j]].args...)
+		}
+		if err == nil {
+			err = conn.Flush()
+		}
+		if err != nil {
+			for _, i := range idx {
+				replies[i].err = err
+			}
+			cc.cluster.triggerRefresh()
+			continue
+		}
+		for _, i := range idx {
+			reply, err := conn.Receive()
+			if kind, slot, raddr, ok := parseRedirect(err); ok {
+				if kind == "MOVED" {
+					cc.cluster.moved(slot, raddr)
+				}
+				redirected = append(redirected, i)
+				continue
+			}
+			if err != nil && conn.Err() != nil {
+				cc.cluster.triggerRefresh()
+			}
+			replies[i] = clusterReply{reply: reply, err: err}
+		}
+	}
+	sort.Ints(redirected)
+	for _, i := range redirected {
+		replies[i].reply, replies[i].err = cc.doRouted(slots[i], cmds[i].name, cmds[i].args)
+	}
+	return replies
+}
@@ -0,0 +1,321 @@
+package redis
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 模拟两个主节点的集群，owner[slot]为负责该slot的节点序号
+type fakeCluster struct {
+	nodes []*fakeRedis
+
+	mu    sync.Mutex
+	owner [clusterSlots]int
+	// 迁移中的slot，源节点上不存在的key回复ASK
+	migrating map[int]int
+}
+
+func newFakeCluster(t *testing.T) *fakeCluster {
+	fc := &fakeCluster{migrating: make(map[int]int)}
+	for i := 0; i < 2; i++ {
+		fc.nodes = append(fc.nodes, newFakeRedis(t))
+	}
+	for slot := clusterSlots / 2; slot < clusterSlots; slot++ {
+		fc.owner[slot] = 1
+	}
+	for i, node := range fc.nodes {
+		i := i
+		node.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+			return fc.handle(i, c, args)
+		})
+	}
+	return fc
+}
+
+func (fc *fakeCluster) Close() {
+	for _, node := range fc.nodes {
+		node.Close()
+	}
+}
+
+func (fc *fakeCluster) hostPort(i int) (string, int) {
+	host, port, _ := net.SplitHostPort(fc.nodes[i].addr)
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func (fc *fakeCluster) slotsReply() []interface{} {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	var reply []interface{}
+	start := 0
+	for slot := 1; slot <= clusterSlots; slot++ {
+		if slot < clusterSlots && fc.owner[slot] == fc.owner[start] {
+			continue
+		}
+		host, port := fc.hostPort(fc.owner[start])
+		reply = append(reply, []interface{}{start, slot - 1, []interface{}{host, port, "node" + strconv.Itoa(fc.owner[start])}})
+		start = slot
+	}
+	return reply
+}
+
+func (fc *fakeCluster) handle(i int, c *fakeClient, args []string) (interface{}, bool) {
+	cmd := strings.ToUpper(args[0])
+	if cmd == "CLUSTER" {
+		return fc.slotsReply(), true
+	}
+	if len(args) < 2 || cmd == "ASKING" || clusterKeylessCommands[cmd] {
+		return nil, false
+	}
+	slot := Slot(args[1])
+	fc.mu.Lock()
+	owner := fc.owner[slot]
+	target, migrating := fc.migrating[slot]
+	fc.mu.Unlock()
+	if owner != i {
+		if c.asking && migrating && target == i {
+			return nil, false
+		}
+		return redigo.Error("MOVED " + strconv.Itoa(slot) + " " + fc.nodes[owner].addr), true
+	}
+	if migrating {
+		if _, ok := fc.nodes[i].get(args[1]); !ok {
+			return redigo.Error("ASK " + strconv.Itoa(slot) + " " + fc.nodes[target].addr), true
+		}
+	}
+	return nil, false
+}
+
+func (fc *fakeCluster) newPool(t *testing.T, name string) *RPool {
+	rpool, err := NewPool(name, newConfigor(t, map[string]interface{}{
+		"mode":    ModeCluster,
+		"servers": []string{fc.nodes[0].addr},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rpool
+}
+
+func TestSlot(t *testing.T) {
+	// CRC16/XMODEM校验值
+	if slot := Slot("123456789"); slot != 0x31C3 {
+		t.Fatalf("slot of 123456789 must be %d, got %d", 0x31C3, slot)
+	}
+	if Slot("{user1000}.following") != Slot("{user1000}.followers") {
+		t.Fatal("keys with the same hash tag must map to the same slot")
+	}
+	if Slot("foo{}{bar}") != int(crc16("foo{}{bar}")%clusterSlots) {
+		t.Fatal("empty hash tag must hash the whole key")
+	}
+	if Slot("foo{{bar}}zap") != Slot("{bar") {
+		t.Fatal("hash tag ends at the first closing brace")
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	fc := newFakeCluster(t)
+	defer fc.Close()
+	rpool := fc.newPool(t, "cluster_routing")
+	defer rpool.Destroy()
+
+	if nodes := rpool.Cluster().Nodes(); len(nodes) != 2 {
+		t.Fatalf("cluster must discover 2 nodes, got %v", nodes)
+	}
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		if _, err := rpool.Set(key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		v, err := rpool.GetString(key)
+		if err != nil || v != "v-"+key {
+			t.Fatalf("get %s: %q %v", key, v, err)
+		}
+		owner := 0
+		if Slot(key) >= clusterSlots/2 {
+			owner = 1
+		}
+		if _, ok := fc.nodes[owner].get(key); !ok {
+			t.Fatalf("key %s must be stored on node %d", key, owner)
+		}
+	}
+}
+
+func TestClusterMoved(t *testing.T) {
+	fc := newFakeCluster(t)
+	defer fc.Close()
+	rpool := fc.newPool(t, "cluster_moved")
+	defer rpool.Destroy()
+
+	key := "a"
+	slot := Slot(key)
+	from := fc.owner[slot]
+	to := 1 - from
+
+	// slot迁移完成，客户端映射已过期
+	fc.mu.Lock()
+	fc.owner[slot] = to
+	fc.mu.Unlock()
+
+	if _, err := rpool.Set(key, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fc.nodes[to].get(key); !ok {
+		t.Fatal("MOVED must be followed to the new owner")
+	}
+	if addr := rpool.Cluster().NodeForKey(key); addr != fc.nodes[to].addr {
+		t.Fatalf("MOVED must update the slot map, got %s", addr)
+	}
+
+	// 异步刷新后整个映射与CLUSTER SLOTS一致
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&rpool.Cluster().refreshing) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr := rpool.Cluster().NodeForKey(key); addr != fc.nodes[to].addr {
+		t.Fatalf("refresh must keep the moved slot, got %s", addr)
+	}
+}
+
+func TestClusterAsk(t *testing.T) {
+	fc := newFakeCluster(t)
+	defer fc.Close()
+	rpool := fc.newPool(t, "cluster_ask")
+	defer rpool.Destroy()
+
+	key := "b"
+	slot := Slot(key)
+	from := fc.owner[slot]
+	to := 1 - from
+	fc.nodes[to].mu.Lock()
+	fc.nodes[to].data[key] = "migrated"
+	fc.nodes[to].mu.Unlock()
+
+	fc.mu.Lock()
+	fc.migrating[slot] = to
+	fc.mu.Unlock()
+
+	v, err := rpool.GetString(key)
+	if err != nil || v != "migrated" {
+		t.Fatalf("ASK must be followed with ASKING, got %q %v", v, err)
+	}
+	if addr := rpool.Cluster().NodeForKey(key); addr != fc.nodes[from].addr {
+		t.Fatalf("ASK must not update the slot map, got %s", addr)
+	}
+}
+
+func TestClusterRedirectLoop(t *testing.T) {
+	fc := newFakeCluster(t)
+	defer fc.Close()
+	rpool := fc.newPool(t, "cluster_loop")
+	defer rpool.Destroy()
+
+	for _, node := range fc.nodes {
+		addr := node.addr
+		node.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+			if strings.ToUpper(args[0]) == "GET" {
+				return redigo.Error("ASK 1 " + addr), true
+			}
+			return nil, false
+		})
+	}
+	if _, err := rpool.Get("a"); err != errClusterRedirects {
+		t.Fatalf("redirect loop must stop, got %v", err)
+	}
+}
+
+func TestClusterKeyspace(t *testing.T) {
+	fc := newFakeCluster(t)
+	defer fc.Close()
+	rpool := fc.newPool(t, "cluster_keyspace")
+	defer rpool.Destroy()
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		if _, err := rpool.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, node := range fc.nodes {
+		node.mu.Lock()
+		n := len(node.data)
+		node.mu.Unlock()
+		if n == 0 {
+			t.Fatalf("test keys must be spread over both nodes, node %d is empty", i)
+		}
+	}
+	found, err := rpool.Keys("*")
+	if err != nil || len(found) != len(keys) {
+		t.Fatalf("KEYS must merge all nodes, got %v %v", found, err)
+	}
+	conn := rpool.GetConn()
+	defer conn.Close()
+	if n, err := redigo.Int(conn.Do("DBSIZE")); err != nil || n != len(keys) {
+		t.Fatalf("DBSIZE must sum all nodes, got %d %v", n, err)
+	}
+
+	// 只有一个节点有key时RANDOMKEY不能返回空
+	fc.nodes[0].mu.Lock()
+	fc.nodes[0].data = make(map[string]string)
+	fc.nodes[0].mu.Unlock()
+	for i := 0; i < 10; i++ {
+		if key, err := redigo.String(conn.Do("RANDOMKEY")); err != nil || key == "" {
+			t.Fatalf("RANDOMKEY must find a key on any node, got %q %v", key, err)
+		}
+	}
+
+	if _, err := conn.Do("FLUSHDB"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := redigo.Int(conn.Do("DBSIZE")); err != nil || n != 0 {
+		t.Fatalf("FLUSHDB must flush all nodes, got %d %v", n, err)
+	}
+}
+
+func TestClusterPipeline(t *testing.T) {
+	fc := newFakeCluster(t)
+	defer fc.Close()
+	rpool := fc.newPool(t, "cluster_pipeline")
+	defer rpool.Destroy()
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		if _, err := rpool.Set(key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 其中一个key的slot已迁移
+	moved := "a"
+	to := 1 - fc.owner[Slot(moved)]
+	fc.mu.Lock()
+	fc.owner[Slot(moved)] = to
+	fc.mu.Unlock()
+	fc.nodes[to].set(moved, "v-"+moved)
+
+	p := rpool.Pipeline()
+	results := make([]*StringResult, len(keys))
+	for i, key := range keys {
+		results[i] = p.GetString(key)
+	}
+	if err := p.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if v, err := results[i].Result(); err != nil || v != "v-"+key {
+			t.Fatalf("get %s: %q %v", key, v, err)
+		}
+	}
+	if addr := rpool.Cluster().NodeForKey(moved); addr != fc.nodes[to].addr {
+		t.Fatalf("MOVED in a pipeline must update the slot map, got %s", addr)
+	}
+}
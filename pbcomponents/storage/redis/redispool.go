@@ -9,8 +9,10 @@ import (
 )
 
 type RPool struct {
-	name string
-	pool *redigo.Pool
+	name    string
+	pool    *redigo.Pool
+	cluster  *Cluster  // cluster模式下按key路由到各节点的连接池
+	sentinel *Sentinel // sentinel模式下随故障转移切换的主从连接池
 
 	closed bool
 	rpmu sync.Mutex
@@ -29,7 +31,10 @@ func (rpool *RPool) UpdatePool(config PoolConfig) (*RPool, error) {
 	if oldConfig.Network != config.Network || oldConfig.Server != config.Server ||
 		oldConfig.ConnectionTimeout != config.ConnectionTimeout || oldConfig.ReadTimeout != config.ReadTimeout ||
 		oldConfig.WriteTimeout != config.WriteTimeout || oldConfig.Password != config.Password ||
-		oldConfig.DB != config.DB { // reset pool
+		oldConfig.DB != config.DB || oldConfig.LogCommands != config.LogCommands ||
+		oldConfig.Mode != config.Mode || !sameServers(oldConfig.Servers, config.Servers) ||
+		!sameServers(oldConfig.Sentinels, config.Sentinels) || oldConfig.MasterName != config.MasterName ||
+		oldConfig.SentinelPassword != config.SentinelPassword || oldConfig.ReadFromReplicas != config.ReadFromReplicas { // reset pool
 		err := rpool.Destroy()
 		if err != nil {
 		}
@@ -38,32 +43,48 @@ func (rpool *RPool) UpdatePool(config PoolConfig) (*RPool, error) {
 		return rediS.create(config)
 	}
 
-	if config.MaxIdle > 0 && oldConfig.MaxIdle != config.MaxIdle {
-		rpool.pool.MaxIdle = config.MaxIdle
-	}
-	if config.MaxActive > 0 && oldConfig.MaxActive != config.MaxActive {
-		rpool.pool.MaxActive = config.MaxActive
-	}
-	if config.TestOnBorrow {
-		rpool.pool.TestOnBorrow = testOnBorrowFunc
+	if rpool.cluster != nil {
+		rpool.cluster.updateConfig(config)
+	} else if rpool.sentinel != nil {
+		rpool.sentinel.updateConfig(config)
 	} else {
-		rpool.pool.TestOnBorrow = nil
-	}
-
-	if config.IdleTimeout > 0 && oldConfig.IdleTimeout != config.IdleTimeout {
-		rpool.pool.IdleTimeout = time.Second * config.IdleTimeout
+		tunePool(rpool.pool, config)
 	}
-	rpool.pool.Wait = config.Wait
 	delete(rediS.poolConfigs, config.Name)
 	rediS.poolConfigs[config.Name] = config
 
 	return rpool, nil
 }
 
+// cluster模式返回按key路由的连接
 func (rpool *RPool) GetConn() redigo.Conn {
+	if rpool.cluster != nil {
+		return rpool.cluster.Get()
+	}
+	if rpool.sentinel != nil {
+		return rpool.sentinel.Get()
+	}
 	return rpool.pool.Get()
 }
 
+// 只读命令使用的连接，sentinel模式开启readFromReplicas时为从节点连接
+func (rpool *RPool) GetReadConn() redigo.Conn {
+	if rpool.sentinel != nil {
+		return rpool.sentinel.GetReplica()
+	}
+	return rpool.GetConn()
+}
+
+// 非cluster模式为nil
+func (rpool *RPool) Cluster() *Cluster {
+	return rpool.cluster
+}
+
+// 非sentinel模式为nil
+func (rpool *RPool) Sentinel() *Sentinel {
+	return rpool.sentinel
+}
+
 func (rpool *RPool) Destroy() error {
 	rpool.rpmu.Lock()
 	defer rpool.rpmu.Unlock()
@@ -71,6 +92,12 @@ func (rpool *RPool) Destroy() error {
 		return nil
 	}
 	rpool.closed = true
+	if rpool.cluster != nil {
+		return rpool.cluster.Close()
+	}
+	if rpool.sentinel != nil {
+		return rpool.sentinel.Close()
+	}
 	return rpool.pool.Close()
 }
 
@@ -88,7 +115,7 @@ func (rpool *RPool) Expire(key string, ttl int) (interface{}, error) {
 }
 
 func (rpool *RPool) GetTTL(key string) (time.Duration, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	ttl, err := redigo.Int64(conn.Do(REDIS_CMD_TTL, key))
 	return time.Duration(ttl) * time.Second, err
@@ -107,61 +134,62 @@ func (rpool *RPool) Set(key string, data interface{}) (interface{}, error) {
 }
 
 func (rpool *RPool) Get(key string) (interface{}, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return conn.Do(REDIS_CMD_GET, key)
 }
 
 func (rpool *RPool) GetString(key string) (string, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.String(conn.Do(REDIS_CMD_GET, key))
 }
 
 func (rpool *RPool) GetBytes(key string) ([]byte, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Bytes(conn.Do(REDIS_CMD_GET, key))
 }
 
 func (rpool *RPool) GetInt(key string) (int, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Int(conn.Do(REDIS_CMD_GET, key))
 }
 
 func (rpool *RPool) GetInt64(key string) (int64, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Int64(conn.Do(REDIS_CMD_GET, key))
 }
 
 func (rpool *RPool) GetUint64(key string) (uint64, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Uint64(conn.Do(REDIS_CMD_GET, key))
 }
 
+// cluster模式下合并全部主节点的结果
 func (rpool *RPool) Keys(pattern string) ([]string, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Strings(conn.Do(REDIS_CMD_KEYS, pattern))
 }
 
 func (rpool *RPool) KeysByteSlices(pattern string) ([][]byte, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.ByteSlices(conn.Do(REDIS_CMD_KEYS, pattern))
 }
 
 func (rpool *RPool) HKeys(key string) ([]string, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Strings(conn.Do(REDIS_CMD_HKEYS, key))
 }
 
 func (rpool *RPool) Exists(key string) (bool, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	count, err := redigo.Int(conn.Do(REDIS_CMD_EXISTS, key))
 	if count == 0 {
@@ -221,13 +249,13 @@ func (rpool *RPool) HSet(key string, HKey string, data interface{}) (interface{}
 }
 
 func (rpool *RPool) HGet(key string, HKey string) (interface{}, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return conn.Do(REDIS_CMD_HGET, key, HKey)
 }
 
 func (rpool *RPool) HMGet(key string, hashKeys ...string) ([]interface{}, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	ret, err := conn.Do(REDIS_CMD_HMGET, key, hashKeys)
 	if err != nil {
@@ -255,33 +283,33 @@ func (rpool *RPool) HMSet(key string, hashKeys []string, vals []interface{}) (in
 }
 
 func (rpool *RPool) HGetString(key string, HKey string) (string, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.String(conn.Do(REDIS_CMD_HGET, key, HKey))
 }
 func (rpool *RPool) HGetFloat(key string, HKey string) (float64, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	f, err := redigo.Float64(conn.Do(REDIS_CMD_HGET, key, HKey))
 	return float64(f), err
 }
 func (rpool *RPool) HGetInt(key string, HKey string) (int, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Int(conn.Do(REDIS_CMD_HGET, key, HKey))
 }
 func (rpool *RPool) HGetInt64(key string, HKey string) (int64, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Int64(conn.Do(REDIS_CMD_HGET, key, HKey))
 }
 func (rpool *RPool) HGetUint64(key string, HKey string) (uint64, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Uint64(conn.Do(REDIS_CMD_HGET, key, HKey))
 }
 func (rpool *RPool) HGetBool(key string, HKey string) (bool, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Bool(conn.Do(REDIS_CMD_HGET, key, HKey))
 }
@@ -291,18 +319,30 @@ func (rpool *RPool) HDel(key string, HKey string) (interface{}, error) {
 	return conn.Do(REDIS_CMD_HDEL, key, HKey)
 }
 func (rpool *RPool) HGetAll(key string) (interface{}, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return conn.Do(REDIS_CMD_HGETALL, key)
 }
 
 func (rpool *RPool) HGetAllValues(key string) ([]interface{}, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Values(conn.Do(REDIS_CMD_HGETALL, key))
 }
 func (rpool *RPool) HGetAllString(key string) ([]string, error) {
-	conn := rpool.GetConn()
+	conn := rpool.GetReadConn()
 	defer conn.Close()
 	return redigo.Strings(conn.Do(REDIS_CMD_HGETALL, key))
 }
+
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+// 包初始化时声明的脚本，RPool.LoadScripts加载其中全部脚本
+var DefaultScripts = NewScriptRegistry()
+
+func RegisterScript(name string, keyCount int, src string) *Script {
+	return DefaultScripts.Register(name, keyCount, src)
+}
+
+func (rpool *RPool) LoadScripts() error {
+	return DefaultScripts.Load(rpool)
+}
+
+// lua脚本注册表，脚本声明一次后在各RPool上以EVALSHA执行
+type ScriptRegistry struct {
+	mu        sync.Mutex
+	scripts   map[string]*Script
+	reloading map[*RPool]bool
+}
+
+func NewScriptRegistry() *ScriptRegistry {
+	return &ScriptRegistry{
+		scripts:   make(map[string]*Script),
+		reloading: make(map[*RPool]bool),
+	}
+}
+
+// keyCount为-1时由调用方在keysAndArgs首位传入key数量
+// 同名脚本内容不同时panic，应在包初始化时声明
+func (r *ScriptRegistry) Register(name string, keyCount int, src string) *Script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.scripts[name]; ok {
+		if s.src != src || s.keyCount != keyCount {
+			panic("redis: script " + name + " registered twice")
+		}
+		return s
+	}
+	sum := sha1.Sum([]byte(src))
+	s := &Script{
+		registry: r,
+		name:     name,
+		keyCount: keyCount,
+		src:      src,
+		hash:     hex.EncodeToString(sum[:]),
+	}
+	r.scripts[name] = s
+	return s
+}
+
+// 未注册时返回nil
+func (r *ScriptRegistry) Lookup(name string) *Script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.scripts[name]
+}
+
+// 在rpool的各节点上SCRIPT LOAD全部脚本，cluster模式下加载到每个节点
+func (r *ScriptRegistry) Load(rpool *RPool) error {
+	r.mu.Lock()
+	scripts := make([]*Script, 0, len(r.scripts))
+	for _, s := range r.scripts {
+		scripts = append(scripts, s)
+	}
+	r.mu.Unlock()
+	if len(scripts) == 0 {
+		return nil
+	}
+
+	return rpool.eachNode(func(conn redigo.Conn) error {
+		for _, s := range scripts {
+			if err := conn.Send("SCRIPT", "LOAD", s.src); err != nil {
+				return err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for _, s := range scripts {
+			hash, err := redigo.String(conn.Receive())
+			if err != nil {
+				return fmt.Errorf("redis: load script %s: %v", s.name, err)
+			}
+			if hash != s.hash {
+				return fmt.Errorf("redis: load script %s: unexpected sha1 %s", s.name, hash)
+			}
+		}
+		return nil
+	})
+}
+
+// 服务端缺少脚本时在后台重新加载，同一RPool同时只有一次加载
+func (r *ScriptRegistry) reload(rpool *RPool) {
+	r.mu.Lock()
+	if r.reloading[rpool] {
+		r.mu.Unlock()
+		return
+	}
+	r.reloading[rpool] = true
+	r.mu.Unlock()
+
+	go func() {
+		if err := r.Load(rpool); err != nil {
+			plog.Warn("[REDIS] reload scripts failed", log.String("pool", rpool.name), log.Error(err))
+		} else {
+			plog.Info("[REDIS] scripts reloaded", log.String("pool", rpool.name))
+		}
+		r.mu.Lock()
+		delete(r.reloading, rpool)
+		r.mu.Unlock()
+	}()
+}
+
+// 已注册的脚本，回复可用redigo的helper转换
+//
+//	n, err := redigo.Int(script.Do(rpool, "key", 1))
+type Script struct {
+	registry *ScriptRegistry
+	name     string
+	keyCount int
+	src      string
+	hash     string
+}
+
+func (s *Script) Name() string {
+	return s.name
+}
+
+// 脚本的sha1
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+// 以EVALSHA执行，服务端返回NOSCRIPT时(SCRIPT FLUSH或故障转移到新节点)改用EVAL，并后台重新加载注册表中的全部脚本
+func (s *Script) Do(rpool *RPool, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := rpool.GetConn()
+	defer conn.Close()
+	reply, noscript, err := s.eval(conn, keysAndArgs)
+	if noscript {
+		s.registry.reload(rpool)
+	}
+	return reply, err
+}
+
+// 在指定连接上执行，NOSCRIPT时改用EVAL
+func (s *Script) DoConn(conn redigo.Conn, keysAndArgs ...interface{}) (interface{}, error) {
+	reply, _, err := s.eval(conn, keysAndArgs)
+	return reply, err
+}
+
+func (s *Script) eval(conn redigo.Conn, keysAndArgs []interface{}) (interface{}, bool, error) {
+	args := s.args(s.hash, keysAndArgs)
+	reply, err := conn.Do("EVALSHA", args...)
+	if e, ok := err.(redigo.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		args[0] = s.src
+		reply, err = conn.Do("EVAL", args...)
+		return reply, true, err
+	}
+	return reply, false, err
+}
+
+func (s *Script) args(spec string, keysAndArgs []interface{}) []interface{} {
+	if s.keyCount < 0 {
+		return append([]interface{}{spec}, keysAndArgs...)
+	}
+	return append([]interface{}{spec, s.keyCount}, keysAndArgs...)
+}
+
+// 在每个节点的连接上执行fn，非cluster模式为当前主节点
+func (rpool *RPool) eachNode(fn func(conn redigo.Conn) error) error {
+	if rpool.cluster == nil {
+		conn := rpool.GetConn()
+		defer conn.Close()
+		return fn(conn)
+	}
+	for _, addr := range rpool.cluster.Nodes() {
+		pool, err := rpool.cluster.pool(addr)
+		if err != nil {
+			return err
+		}
+		conn := pool.Get()
+		err = fn(conn)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("redis: node %s: %v", addr, err)
+		}
+	}
+	return nil
+}
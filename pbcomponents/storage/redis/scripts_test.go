@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+var (
+	testScripts      = NewScriptRegistry()
+	testIncrScript   = testScripts.Register("test.incrby", 1, `return redis.call("INCRBY", KEYS[1], ARGV[1])`)
+	testConcatScript = testScripts.Register("test.concat", -1, `return redis.call("GET", KEYS[1]) .. ARGV[1]`)
+)
+
+func init() {
+	fakeScripts[testIncrScript.Hash()] = func(s *fakeRedis, keys, argv []string) interface{} {
+		n, _ := strconv.ParseInt(s.data[keys[0]], 10, 64)
+		by, _ := strconv.ParseInt(argv[0], 10, 64)
+		n += by
+		s.data[keys[0]] = strconv.FormatInt(n, 10)
+		return n
+	}
+	fakeScripts[testConcatScript.Hash()] = func(s *fakeRedis, keys, argv []string) interface{} {
+		return s.data[keys[0]] + argv[0]
+	}
+}
+
+func TestScripts(t *testing.T) {
+	s, rpool := newFakePool(t, "scripts")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	var evals, evalshas int32
+	s.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+		switch args[0] {
+		case "EVAL":
+			atomic.AddInt32(&evals, 1)
+		case "EVALSHA":
+			atomic.AddInt32(&evalshas, 1)
+		}
+		return nil, false
+	})
+
+	if testScripts.Register("test.incrby", 1, `return redis.call("INCRBY", KEYS[1], ARGV[1])`) != testIncrScript {
+		t.Fatal("expected the registered script")
+	}
+	if testScripts.Lookup("test.concat") != testConcatScript || testScripts.Lookup("missing") != nil {
+		t.Fatal("unexpected lookup result")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic on conflicting registration")
+			}
+		}()
+		testScripts.Register("test.incrby", 1, `return 0`)
+	}()
+
+	if err := testScripts.Load(rpool); err != nil {
+		t.Fatal(err)
+	}
+	n, err := redigo.Int64(testIncrScript.Do(rpool, "counter", 5))
+	if err != nil || n != 5 {
+		t.Fatalf("unexpected %d %v", n, err)
+	}
+	s.set("greeting", "hello")
+	str, err := redigo.String(testConcatScript.Do(rpool, 1, "greeting", " world"))
+	if err != nil || str != "hello world" {
+		t.Fatalf("unexpected %q %v", str, err)
+	}
+	if e, es := atomic.LoadInt32(&evals), atomic.LoadInt32(&evalshas); e != 0 || es != 2 {
+		t.Fatalf("expected only EVALSHA, got %d EVAL %d EVALSHA", e, es)
+	}
+
+	// SCRIPT FLUSH后回退EVAL，并重新加载其他脚本
+	if _, err := rpool.Do("SCRIPT", "FLUSH"); err != nil {
+		t.Fatal(err)
+	}
+	n, err = redigo.Int64(testIncrScript.Do(rpool, "counter", 2))
+	if err != nil || n != 7 {
+		t.Fatalf("unexpected %d %v", n, err)
+	}
+	if e := atomic.LoadInt32(&evals); e != 1 {
+		t.Fatalf("expected EVAL fallback, got %d", e)
+	}
+	waitFor(t, "scripts reloaded", func() bool {
+		exists, err := redigo.Ints(rpool.Do("SCRIPT", "EXISTS", testConcatScript.Hash()))
+		return err == nil && exists[0] == 1
+	})
+	if _, err := testConcatScript.Do(rpool, 1, "greeting", "!"); err != nil {
+		t.Fatal(err)
+	}
+	if e := atomic.LoadInt32(&evals); e != 1 {
+		t.Fatalf("expected EVALSHA after reload, got %d EVAL", e)
+	}
+}
@@ -0,0 +1,437 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	sentinelPingInterval = 10 * time.Second
+	sentinelMaxBackoff   = 5 * time.Second
+)
+
+var (
+	errSentinelNoMaster = errors.New("redis sentinel: no sentinel knows the master")
+	errSentinelClosed   = errors.New("redis sentinel: closed")
+)
+
+// 通过Sentinel发现主节点，订阅+switch-master在故障转移后切换连接池
+type Sentinel struct {
+	name             string
+	masterName       string
+	readFromReplicas bool
+
+	config    PoolConfig
+	sentinels []string // 最近一次成功应答的sentinel排在最前
+	master    string
+	current   atomic.Value // *redigo.Pool，主节点
+	replicas  atomic.Value // []*replicaPool，只读从节点
+	next      uint32
+	resolving int32
+	closed    bool
+	subConn   redigo.Conn
+	mu        sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type replicaPool struct {
+	addr string
+	pool *redigo.Pool
+}
+
+func newSentinel(config PoolConfig) (*Sentinel, error) {
+	if config.MasterName == "" || len(config.Sentinels) == 0 {
+		return nil, errors.New("redis sentinel: masterName and sentinels are required")
+	}
+	s := &Sentinel{
+		name:             config.Name,
+		masterName:       config.MasterName,
+		readFromReplicas: config.ReadFromReplicas,
+		config:           config,
+		sentinels:        append([]string{}, config.Sentinels...),
+		stop:             make(chan struct{}),
+	}
+	s.replicas.Store([]*replicaPool{})
+	addr, err := s.resolveMaster()
+	if err != nil {
+		return nil, err
+	}
+	pool := s.newMasterPool(addr)
+	s.master = addr
+	s.current.Store(pool)
+	if err := testFunc(pool); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.readFromReplicas {
+		s.refreshReplicas()
+	}
+	plog.Info("[REDIS] sentinel master resolved", log.String("pool", s.name), log.String("master", s.masterName),
+		log.String("addr", addr))
+
+	s.wg.Add(1)
+	go s.watch()
+	return s, nil
+}
+
+// 主节点连接
+func (s *Sentinel) Get() redigo.Conn {
+	return s.current.Load().(*redigo.Pool).Get()
+}
+
+// 按轮询返回从节点连接，没有可用从节点时返回主节点连接
+func (s *Sentinel) GetReplica() redigo.Conn {
+	replicas := s.replicas.Load().([]*replicaPool)
+	if len(replicas) == 0 {
+		return s.Get()
+	}
+	n := atomic.AddUint32(&s.next, 1)
+	return replicas[int(n)%len(replicas)].pool.Get()
+}
+
+// 当前主节点地址
+func (s *Sentinel) Master() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.master
+}
+
+func (s *Sentinel) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	if s.subConn != nil {
+		s.subConn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	for _, r := range s.replicas.Load().([]*replicaPool) {
+		r.pool.Close()
+	}
+	return s.current.Load().(*redigo.Pool).Close()
+}
+
+func (s *Sentinel) updateConfig(config PoolConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	tunePool(s.current.Load().(*redigo.Pool), config)
+	for _, r := range s.replicas.Load().([]*replicaPool) {
+		tunePool(r.pool, config)
+	}
+}
+
+// 新连接确认对端仍是主节点，故障转移后旧主节点降级时触发重新解析
+func (s *Sentinel) newMasterPool(addr string) *redigo.Pool {
+	pool := newRedigoPool(s.config, addr)
+	dial := pool.Dial
+	pool.Dial = func() (redigo.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			s.triggerResolve()
+			return nil, err
+		}
+		role, err := redigo.Values(conn.Do("ROLE"))
+		if err == nil && len(role) > 0 {
+			if kind, _ := redigo.String(role[0], nil); kind != "master" {
+				conn.Close()
+				s.triggerResolve()
+				return nil, fmt.Errorf("redis sentinel: %s is %s, not master", addr, kind)
+			}
+		}
+		return conn, nil
+	}
+	return pool
+}
+
+func (s *Sentinel) dialSentinel(addr string, readTimeout time.Duration) (redigo.Conn, error) {
+	s.mu.Lock()
+	config := s.config
+	s.mu.Unlock()
+	options := []redigo.DialOption{redigo.DialReadTimeout(readTimeout)}
+	if config.ConnectionTimeout > 0 {
+		options = append(options, redigo.DialConnectTimeout(time.Second*config.ConnectionTimeout))
+	}
+	if config.WriteTimeout > 0 {
+		options = append(options, redigo.DialWriteTimeout(time.Second*config.WriteTimeout))
+	}
+	if config.SentinelPassword != "" {
+		options = append(options, redigo.DialPassword(config.SentinelPassword))
+	}
+	return redigo.Dial(config.Network, addr, options...)
+}
+
+// 依次询问各sentinel，应答的sentinel移到最前
+func (s *Sentinel) querySentinels(fn func(conn redigo.Conn) error) error {
+	s.mu.Lock()
+	sentinels := append([]string{}, s.sentinels...)
+	readTimeout := time.Second * s.config.ReadTimeout
+	s.mu.Unlock()
+
+	var lastErr error = errSentinelNoMaster
+	for i, addr := range sentinels {
+		conn, err := s.dialSentinel(addr, readTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = fn(conn)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if i > 0 {
+			s.mu.Lock()
+			for j, a := range s.sentinels {
+				if a == addr {
+					s.sentinels = append(append([]string{addr}, s.sentinels[:j]...), s.sentinels[j+1:]...)
+					break
+				}
+			}
+			s.mu.Unlock()
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (s *Sentinel) resolveMaster() (string, error) {
+	var addr string
+	err := s.querySentinels(func(conn redigo.Conn) error {
+		hostPort, err := redigo.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+		if err != nil {
+			return err
+		}
+		if len(hostPort) != 2 {
+			return errSentinelNoMaster
+		}
+		addr = net.JoinHostPort(hostPort[0], hostPort[1])
+		return nil
+	})
+	return addr, err
+}
+
+func (s *Sentinel) triggerResolve() {
+	if !atomic.CompareAndSwapInt32(&s.resolving, 0, 1) {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		atomic.StoreInt32(&s.resolving, 0)
+		return
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go func() {
+		defer s.wg.Done()
+		defer atomic.StoreInt32(&s.resolving, 0)
+		s.resolve()
+	}()
+}
+
+func (s *Sentinel) resolve() {
+	addr, err := s.resolveMaster()
+	if err != nil {
+		plog.Warn("[REDIS] sentinel resolve master failed", log.String("pool", s.name), log.Error(err))
+		return
+	}
+	s.switchMaster(addr)
+}
+
+// 切换到新的主节点连接池，旧连接池中的连接归还时关闭
+func (s *Sentinel) switchMaster(addr string) {
+	s.mu.Lock()
+	if s.closed || addr == s.master {
+		s.mu.Unlock()
+		return
+	}
+	old := s.master
+	oldPool := s.current.Load().(*redigo.Pool)
+	s.master = addr
+	s.current.Store(s.newMasterPool(addr))
+	s.mu.Unlock()
+
+	plog.Warn("[REDIS] sentinel master switched", log.String("pool", s.name), log.String("master", s.masterName),
+		log.String("from", old), log.String("to", addr))
+	go oldPool.Close()
+	if s.readFromReplicas {
+		s.refreshReplicas()
+	}
+}
+
+func (s *Sentinel) refreshReplicas() {
+	var addrs []string
+	err := s.querySentinels(func(conn redigo.Conn) error {
+		reply, err := redigo.Values(conn.Do("SENTINEL", "replicas", s.masterName))
+		if err != nil {
+			// Redis 5之前的命令名
+			reply, err = redigo.Values(conn.Do("SENTINEL", "slaves", s.masterName))
+			if err != nil {
+				return err
+			}
+		}
+		addrs = addrs[:0]
+		for _, item := range reply {
+			info, err := redigo.StringMap(item, nil)
+			if err != nil {
+				return err
+			}
+			flags := info["flags"]
+			if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(info["ip"], info["port"]))
+		}
+		return nil
+	})
+	if err != nil {
+		plog.Warn("[REDIS] sentinel list replicas failed", log.String("pool", s.name), log.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	old := s.replicas.Load().([]*replicaPool)
+	existing := make(map[string]*replicaPool, len(old))
+	for _, r := range old {
+		existing[r.addr] = r
+	}
+	replicas := make([]*replicaPool, 0, len(addrs))
+	for _, addr := range addrs {
+		if r, ok := existing[addr]; ok {
+			replicas = append(replicas, r)
+			delete(existing, addr)
+			continue
+		}
+		replicas = append(replicas, &replicaPool{addr: addr, pool: newRedigoPool(s.config, addr)})
+	}
+	s.replicas.Store(replicas)
+	s.mu.Unlock()
+
+	for _, r := range existing {
+		r.pool.Close()
+	}
+	plog.Info("[REDIS] sentinel replicas updated", log.String("pool", s.name), log.Int("replicas", len(replicas)))
+}
+
+// 订阅sentinel事件，连接断开后退避重连
+func (s *Sentinel) watch() {
+	defer s.wg.Done()
+	backoff := 100 * time.Millisecond
+	for {
+		subscribed, err := s.subscribe()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if subscribed {
+			backoff = 100 * time.Millisecond
+		}
+		plog.Warn("[REDIS] sentinel subscription lost", log.String("pool", s.name), log.Error(err),
+			log.Duration("backoff", backoff))
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > sentinelMaxBackoff {
+			backoff = sentinelMaxBackoff
+		}
+	}
+}
+
+func (s *Sentinel) subscribe() (bool, error) {
+	s.mu.Lock()
+	sentinels := append([]string{}, s.sentinels...)
+	s.mu.Unlock()
+
+	var conn redigo.Conn
+	var err error = errSentinelNoMaster
+	for _, addr := range sentinels {
+		if conn, err = s.dialSentinel(addr, 3*sentinelPingInterval); err == nil {
+			break
+		}
+	}
+	if conn == nil {
+		return false, err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return false, errSentinelClosed
+	}
+	s.subConn = conn
+	s.mu.Unlock()
+
+	psc := redigo.PubSubConn{Conn: conn}
+	defer psc.Close()
+	if err := psc.Subscribe("+switch-master", "+slave", "+sdown", "-sdown"); err != nil {
+		return false, err
+	}
+	// 断开期间可能错过了切换
+	s.resolve()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(sentinelPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redigo.Message:
+			s.handleEvent(v.Channel, string(v.Data))
+		case error:
+			return true, v
+		}
+	}
+}
+
+func (s *Sentinel) handleEvent(channel, data string) {
+	fields := strings.Fields(data)
+	switch channel {
+	case "+switch-master":
+		// <master-name> <old-ip> <old-port> <new-ip> <new-port>
+		if len(fields) == 5 && fields[0] == s.masterName {
+			s.switchMaster(net.JoinHostPort(fields[3], fields[4]))
+		}
+	default:
+		// <instance-type> <name> <ip> <port> @ <master-name> <master-ip> <master-port>
+		if s.readFromReplicas && len(fields) >= 6 && fields[0] == "slave" && fields[5] == s.masterName {
+			s.refreshReplicas()
+		}
+	}
+}
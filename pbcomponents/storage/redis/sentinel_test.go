@@ -0,0 +1,198 @@
+package redis
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 模拟sentinel，master为当前主节点地址
+type fakeSentinel struct {
+	*fakeRedis
+	master   string
+	replicas []string
+}
+
+func newFakeSentinel(t *testing.T, master string, replicas ...string) *fakeSentinel {
+	fs := &fakeSentinel{fakeRedis: newFakeRedis(t), master: master, replicas: replicas}
+	fs.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+		if strings.ToUpper(args[0]) != "SENTINEL" {
+			return nil, false
+		}
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		switch strings.ToLower(args[1]) {
+		case "get-master-addr-by-name":
+			if args[2] != "mymaster" {
+				return nil, true
+			}
+			host, port, _ := net.SplitHostPort(fs.master)
+			return []string{host, port}, true
+		case "replicas":
+			var reply []interface{}
+			for _, addr := range fs.replicas {
+				host, port, _ := net.SplitHostPort(addr)
+				reply = append(reply, []string{"ip", host, "port", port, "flags", "slave"})
+			}
+			return reply, true
+		}
+		return nil, false
+	})
+	return fs
+}
+
+// 故障转移：更新主节点并广播+switch-master
+func (fs *fakeSentinel) failover(to string) {
+	fs.mu.Lock()
+	from := fs.master
+	fs.master = to
+	fs.mu.Unlock()
+	oldHost, oldPort, _ := net.SplitHostPort(from)
+	newHost, newPort, _ := net.SplitHostPort(to)
+	fs.publish("+switch-master", strings.Join([]string{"mymaster", oldHost, oldPort, newHost, newPort}, " "))
+}
+
+func setRole(s *fakeRedis, role string) {
+	s.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+		if strings.ToUpper(args[0]) == "ROLE" {
+			return []interface{}{role}, true
+		}
+		return nil, false
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	m1, m2 := newFakeRedis(t), newFakeRedis(t)
+	defer m1.Close()
+	defer m2.Close()
+	setRole(m1, "master")
+	setRole(m2, "slave")
+	fs := newFakeSentinel(t, m1.addr)
+	defer fs.Close()
+
+	rpool, err := NewPool("sentinel_failover", newConfigor(t, map[string]interface{}{
+		"mode":       ModeSentinel,
+		"sentinels":  []string{"127.0.0.1:1", fs.addr},
+		"masterName": "mymaster",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpool.Destroy()
+
+	if _, err := rpool.Set("k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m1.get("k"); !ok {
+		t.Fatal("writes must go to the resolved master")
+	}
+	// 应答的sentinel排到最前
+	s := rpool.Sentinel()
+	s.mu.Lock()
+	first := s.sentinels[0]
+	s.mu.Unlock()
+	if first != fs.addr {
+		t.Fatalf("answering sentinel must be tried first, got %s", first)
+	}
+
+	// 等待订阅建立后切换
+	waitFor(t, "sentinel subscription", func() bool {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		for c := range fs.clients {
+			if c.channels["+switch-master"] {
+				return true
+			}
+		}
+		return false
+	})
+	setRole(m1, "slave")
+	setRole(m2, "master")
+	fs.failover(m2.addr)
+	waitFor(t, "master switch", func() bool {
+		return rpool.Sentinel().Master() == m2.addr
+	})
+	if _, err := rpool.Set("k", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m2.get("k"); v != "2" {
+		t.Fatal("writes must go to the new master after failover")
+	}
+}
+
+func TestSentinelResolveOnStaleMaster(t *testing.T) {
+	m1, m2 := newFakeRedis(t), newFakeRedis(t)
+	defer m1.Close()
+	defer m2.Close()
+	setRole(m1, "master")
+	setRole(m2, "slave")
+	fs := newFakeSentinel(t, m1.addr)
+	defer fs.Close()
+
+	rpool, err := NewPool("sentinel_stale", newConfigor(t, map[string]interface{}{
+		"mode":       ModeSentinel,
+		"sentinels":  []string{fs.addr},
+		"masterName": "mymaster",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpool.Destroy()
+
+	// 错过+switch-master：旧主节点降级且断开连接
+	fs.mu.Lock()
+	fs.master = m2.addr
+	fs.mu.Unlock()
+	setRole(m1, "slave")
+	setRole(m2, "master")
+	m1.closeConns()
+
+	waitFor(t, "master re-resolved", func() bool {
+		rpool.Set("k", "v")
+		return rpool.Sentinel().Master() == m2.addr
+	})
+}
+
+func TestSentinelReadFromReplicas(t *testing.T) {
+	master, replica := newFakeRedis(t), newFakeRedis(t)
+	defer master.Close()
+	defer replica.Close()
+	setRole(master, "master")
+	fs := newFakeSentinel(t, master.addr, replica.addr)
+	defer fs.Close()
+
+	rpool, err := NewPool("sentinel_replicas", newConfigor(t, map[string]interface{}{
+		"mode":             ModeSentinel,
+		"sentinels":        []string{fs.addr},
+		"masterName":       "mymaster",
+		"readFromReplicas": true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpool.Destroy()
+
+	replica.mu.Lock()
+	replica.data["k"] = "replica"
+	replica.mu.Unlock()
+	if v, err := rpool.GetString("k"); err != nil || v != "replica" {
+		t.Fatalf("reads must go to the replica, got %q %v", v, err)
+	}
+	if _, err := rpool.Set("k", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := master.get("k"); v != "master" {
+		t.Fatal("writes must go to the master")
+	}
+}
@@ -0,0 +1,494 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	defaultStreamBatchSize     = 10
+	defaultStreamBlock         = 5 * time.Second
+	defaultStreamClaimInterval = 30 * time.Second
+	defaultStreamMinIdle       = time.Minute
+	defaultStreamMaxDeliveries = 5
+	streamPendingScanCount     = 100
+	// 阻塞命令在阻塞时间之外额外等待的读超时
+	streamBlockReadSlack = 5 * time.Second
+)
+
+type StreamEntry struct {
+	ID     string
+	Values map[string]string
+}
+
+// XPENDING的一条记录
+type PendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// maxLen大于0时按MAXLEN ~近似裁剪，返回消息ID
+func (rpool *RPool) XAdd(stream string, maxLen int64, values map[string]interface{}) (string, error) {
+	args := make([]interface{}, 0, 4+2*len(values))
+	args = append(args, stream)
+	if maxLen > 0 {
+		args = append(args, "MAXLEN", "~", maxLen)
+	}
+	args = append(args, "*")
+	for field, value := range values {
+		args = append(args, field, value)
+	}
+	conn := rpool.GetConn()
+	defer conn.Close()
+	return redigo.String(conn.Do("XADD", args...))
+}
+
+func (rpool *RPool) XLen(stream string) (int64, error) {
+	conn := rpool.GetConn()
+	defer conn.Close()
+	return redigo.Int64(conn.Do("XLEN", stream))
+}
+
+// 创建消费组，stream不存在时一并创建，组已存在时返回nil
+// start为"0"时从头消费，"$"时只消费之后的新消息
+func (rpool *RPool) XGroupCreate(stream, group, start string) error {
+	conn := rpool.GetConn()
+	defer conn.Close()
+	_, err := conn.Do("XGROUP", "CREATE", stream, group, start, "MKSTREAM")
+	if e, ok := err.(redigo.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// 读取未投递给组内任何消费者的新消息，block大于0时最多阻塞block，超时返回空
+// 阻塞期间占用一个连接，cluster模式下连接读超时须大于block
+func (rpool *RPool) XReadGroup(stream, group, consumer string, count int, block time.Duration) ([]StreamEntry, error) {
+	args := []interface{}{"GROUP", group, consumer, "COUNT", count}
+	if block > 0 {
+		args = append(args, "BLOCK", durationMs(block))
+	}
+	args = append(args, "STREAMS", stream, ">")
+
+	conn := rpool.GetConn()
+	defer conn.Close()
+	var reply interface{}
+	var err error
+	if _, ok := conn.(redigo.ConnWithTimeout); ok && block > 0 {
+		reply, err = redigo.DoWithTimeout(conn, block+streamBlockReadSlack, "XREADGROUP", args...)
+	} else {
+		reply, err = conn.Do("XREADGROUP", args...)
+	}
+	if err == redigo.ErrNil || (err == nil && reply == nil) {
+		return nil, nil
+	}
+	streams, err := redigo.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	var entries []StreamEntry
+	for _, s := range streams {
+		item, err := redigo.Values(s, nil)
+		if err != nil || len(item) != 2 {
+			return nil, fmt.Errorf("redis: invalid XREADGROUP reply %v", s)
+		}
+		parsed, err := parseStreamEntries(item[1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, parsed...)
+	}
+	return entries, nil
+}
+
+func (rpool *RPool) XAck(stream, group string, ids ...string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, 0, 2+len(ids))
+	args = append(args, stream, group)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	conn := rpool.GetConn()
+	defer conn.Close()
+	return redigo.Int64(conn.Do("XACK", args...))
+}
+
+// 组内已投递未确认的消息，按ID升序最多count条
+func (rpool *RPool) XPending(stream, group string, count int) ([]PendingEntry, error) {
+	conn := rpool.GetConn()
+	defer conn.Close()
+	values, err := redigo.Values(conn.Do("XPENDING", stream, group, "-", "+", count))
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]PendingEntry, 0, len(values))
+	for _, v := range values {
+		item, err := redigo.Values(v, nil)
+		if err != nil || len(item) != 4 {
+			return nil, fmt.Errorf("redis: invalid XPENDING reply %v", v)
+		}
+		id, _ := redigo.String(item[0], nil)
+		consumer, _ := redigo.String(item[1], nil)
+		idle, err1 := redigo.Int64(item[2], nil)
+		deliveries, err2 := redigo.Int64(item[3], nil)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("redis: invalid XPENDING reply %v", v)
+		}
+		pending = append(pending, PendingEntry{
+			ID:         id,
+			Consumer:   consumer,
+			Idle:       time.Duration(idle) * time.Millisecond,
+			Deliveries: deliveries,
+		})
+	}
+	return pending, nil
+}
+
+// 将空闲超过minIdle的消息转给consumer并增加投递次数，已被裁剪的消息Values为nil
+// Redis 7之前已被裁剪的消息只回复nil，结果中不包含
+func (rpool *RPool) XClaim(stream, group, consumer string, minIdle time.Duration, ids ...string) ([]StreamEntry, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, 0, 4+len(ids))
+	args = append(args, stream, group, consumer, durationMs(minIdle))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	conn := rpool.GetConn()
+	defer conn.Close()
+	reply, err := conn.Do("XCLAIM", args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamEntries(reply)
+}
+
+// [[id, [field, value, ...]], ...]，已删除的消息Values为nil
+func parseStreamEntries(reply interface{}) ([]StreamEntry, error) {
+	values, err := redigo.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StreamEntry, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		item, err := redigo.Values(v, nil)
+		if err != nil || len(item) != 2 {
+			return nil, fmt.Errorf("redis: invalid stream entry %v", v)
+		}
+		id, err := redigo.String(item[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{ID: id}
+		if item[1] != nil {
+			if entry.Values, err = redigo.StringMap(item[1], nil); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// 返回nil时XACK确认，返回error或panic时消息留在pending中，MinIdle后被重新认领
+type StreamHandler func(entry *StreamEntry) error
+
+// 消费组中的一个消费者，读取新消息交给handler并发处理
+// 后台定期检查pending，认领崩溃消费者遗留的消息；投递次数达到MaxDeliveries的消息写入DeadLetter后确认
+type StreamWorker struct {
+	rpool    *RPool
+	stream   string
+	group    string
+	consumer string
+	handler  StreamHandler
+
+	Concurrency   int           // 同时处理的消息数
+	BatchSize     int           // 每次XREADGROUP读取的条数，不超过Concurrency
+	Block         time.Duration // XREADGROUP阻塞时间，Stop最多等待该时长
+	ClaimInterval time.Duration // 检查pending的间隔
+	MinIdle       time.Duration // pending超过该时长视为消费者已崩溃，应大于handler的最长处理时间
+	MaxDeliveries int64         // 0为不限制
+	DeadLetter    string        // 死信stream，默认为stream+":dead"
+	MaxLen        int64         // 死信stream的最大长度，0不裁剪
+
+	sem     chan struct{}
+	running bool
+	mu      sync.Mutex
+	stop    chan struct{}
+	wg      sync.WaitGroup // 读取与认领循环
+	tasks   sync.WaitGroup // 处理中的消息
+}
+
+func (rpool *RPool) NewStreamWorker(stream, group, consumer string, handler StreamHandler) *StreamWorker {
+	return &StreamWorker{
+		rpool:         rpool,
+		stream:        stream,
+		group:         group,
+		consumer:      consumer,
+		handler:       handler,
+		Concurrency:   1,
+		BatchSize:     defaultStreamBatchSize,
+		Block:         defaultStreamBlock,
+		ClaimInterval: defaultStreamClaimInterval,
+		MinIdle:       defaultStreamMinIdle,
+		MaxDeliveries: defaultStreamMaxDeliveries,
+		DeadLetter:    stream + ":dead",
+	}
+}
+
+// 创建消费组(从头消费)并启动读取和认领循环
+func (w *StreamWorker) Start() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running {
+		return nil
+	}
+	if err := w.rpool.XGroupCreate(w.stream, w.group, "0"); err != nil {
+		return err
+	}
+	if w.Concurrency < 1 {
+		w.Concurrency = 1
+	}
+	w.sem = make(chan struct{}, w.Concurrency)
+	w.stop = make(chan struct{})
+	w.running = true
+	w.wg.Add(2)
+	go w.readLoop()
+	go w.claimLoop()
+	plog.Info("[REDIS] stream worker started", log.String("stream", w.stream), log.String("group", w.group),
+		log.String("consumer", w.consumer))
+	return nil
+}
+
+// 停止读取并等待处理中的消息完成
+func (w *StreamWorker) Stop() {
+	w.mu.Lock()
+	if !w.running {
+		w.mu.Unlock()
+		return
+	}
+	w.running = false
+	close(w.stop)
+	w.mu.Unlock()
+	w.wg.Wait()
+	w.tasks.Wait()
+}
+
+func (w *StreamWorker) readLoop() {
+	defer w.wg.Done()
+	backoff := subscriberMinBackoff
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		// 有空闲的处理名额时才读取，避免读出的消息长时间等待
+		select {
+		case <-w.stop:
+			return
+		case w.sem <- struct{}{}:
+			<-w.sem
+		}
+		count := w.BatchSize
+		if count > w.Concurrency {
+			count = w.Concurrency
+		}
+		entries, err := w.rpool.XReadGroup(w.stream, w.group, w.consumer, count, w.Block)
+		if err != nil {
+			plog.Warn("[REDIS] read stream failed", log.String("stream", w.stream), log.String("group", w.group),
+				log.Error(err), log.Duration("backoff", backoff))
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > subscriberMaxBackoff {
+				backoff = subscriberMaxBackoff
+			}
+			continue
+		}
+		backoff = subscriberMinBackoff
+		for i := range entries {
+			w.dispatch(&entries[i])
+		}
+	}
+}
+
+// 占用一个处理名额后异步处理；已读出的消息在Stop时仍会处理完
+func (w *StreamWorker) dispatch(entry *StreamEntry) {
+	w.sem <- struct{}{}
+	w.tasks.Add(1)
+	go func() {
+		defer w.tasks.Done()
+		defer func() { <-w.sem }()
+		if err := w.handle(entry); err != nil {
+			plog.Warn("[REDIS] handle stream entry failed", log.String("stream", w.stream), log.String("id", entry.ID),
+				log.Error(err))
+			return
+		}
+		if _, err := w.rpool.XAck(w.stream, w.group, entry.ID); err != nil {
+			plog.Warn("[REDIS] ack stream entry failed", log.String("stream", w.stream), log.String("id", entry.ID),
+				log.Error(err))
+		}
+	}()
+}
+
+func (w *StreamWorker) handle(entry *StreamEntry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return w.handler(entry)
+}
+
+func (w *StreamWorker) claimLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.ClaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := w.reclaim(); err != nil {
+			plog.Warn("[REDIS] reclaim stream entries failed", log.String("stream", w.stream),
+				log.String("group", w.group), log.Error(err))
+		}
+	}
+}
+
+// 认领空闲超过MinIdle的pending消息重新处理，投递次数用尽的写入死信
+func (w *StreamWorker) reclaim() error {
+	pending, err := w.rpool.XPending(w.stream, w.group, streamPendingScanCount)
+	if err != nil {
+		return err
+	}
+	var retry, dead []string
+	for _, p := range pending {
+		if p.Idle < w.MinIdle {
+			continue
+		}
+		if w.MaxDeliveries > 0 && p.Deliveries >= w.MaxDeliveries {
+			dead = append(dead, p.ID)
+		} else {
+			retry = append(retry, p.ID)
+		}
+	}
+
+	if len(dead) > 0 {
+		if err := w.deadLetter(pending, dead); err != nil {
+			return err
+		}
+	}
+	if len(retry) == 0 {
+		return nil
+	}
+	entries, err := w.rpool.XClaim(w.stream, w.group, w.consumer, w.MinIdle, retry...)
+	if err != nil {
+		return err
+	}
+	plog.Info("[REDIS] reclaimed stream entries", log.String("stream", w.stream), log.String("group", w.group),
+		log.Int("count", len(entries)))
+	trimmed, err := w.claimedMissing(retry, entries)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].Values == nil {
+			trimmed = append(trimmed, entries[i].ID)
+			continue
+		}
+		select {
+		case <-w.stop:
+			return nil
+		default:
+		}
+		w.dispatch(&entries[i])
+	}
+	_, err = w.rpool.XAck(w.stream, w.group, trimmed...)
+	return err
+}
+
+func (w *StreamWorker) deadLetter(pending []PendingEntry, ids []string) error {
+	// 先认领以取得消息内容，并防止其他消费者同时处理
+	entries, err := w.rpool.XClaim(w.stream, w.group, w.consumer, w.MinIdle, ids...)
+	if err != nil {
+		return err
+	}
+	deliveries := make(map[string]int64, len(pending))
+	for _, p := range pending {
+		deliveries[p.ID] = p.Deliveries
+	}
+	acked, err := w.claimedMissing(ids, entries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		acked = append(acked, entry.ID)
+		// 已被裁剪的消息没有内容，直接确认
+		if entry.Values == nil {
+			continue
+		}
+		values := make(map[string]interface{}, len(entry.Values)+2)
+		for field, value := range entry.Values {
+			values[field] = value
+		}
+		values["_source_id"] = entry.ID
+		values["_deliveries"] = strconv.FormatInt(deliveries[entry.ID], 10)
+		if _, err := w.rpool.XAdd(w.DeadLetter, w.MaxLen, values); err != nil {
+			return err
+		}
+		plog.Warn("[REDIS] stream entry dead-lettered", log.String("stream", w.stream), log.String("id", entry.ID),
+			log.Int64("deliveries", deliveries[entry.ID]), log.String("deadLetter", w.DeadLetter))
+	}
+	// 只确认本次认领到的消息，其余已被其他消费者认领
+	_, err = w.rpool.XAck(w.stream, w.group, acked...)
+	return err
+}
+
+// 请求认领但XCLAIM未返回的消息中已转给本消费者的，即已被删除或裁剪的消息
+// Redis 7之前XCLAIM对这类消息回复nil而不带ID，不确认会一直留在pending中
+// 其余未返回的已被其他消费者认领或已确认
+func (w *StreamWorker) claimedMissing(ids []string, entries []StreamEntry) ([]string, error) {
+	returned := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		returned[entry.ID] = true
+	}
+	missing := make(map[string]bool)
+	for _, id := range ids {
+		if !returned[id] {
+			missing[id] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	pending, err := w.rpool.XPending(w.stream, w.group, streamPendingScanCount)
+	if err != nil {
+		return nil, err
+	}
+	var claimed []string
+	for _, p := range pending {
+		if missing[p.ID] && p.Consumer == w.consumer {
+			claimed = append(claimed, p.ID)
+		}
+	}
+	return claimed, nil
+}
@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	s, rpool := newFakePool(t, "streams")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	for i := 0; i < 5; i++ {
+		if _, err := rpool.XAdd("events", 3, map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := rpool.XLen("events"); err != nil || n != 3 {
+		t.Fatalf("expected trimmed length 3, got %d %v", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := rpool.XGroupCreate("events", "g", "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := rpool.XReadGroup("events", "g", "c1", 2, 0)
+	if err != nil || len(entries) != 2 || entries[0].Values["n"] != "2" || entries[1].Values["n"] != "3" {
+		t.Fatalf("unexpected %+v %v", entries, err)
+	}
+	if n, err := rpool.XAck("events", "g", entries[0].ID); err != nil || n != 1 {
+		t.Fatalf("ack: %d %v", n, err)
+	}
+	pending, err := rpool.XPending("events", "g", 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != entries[1].ID || pending[0].Consumer != "c1" ||
+		pending[0].Deliveries != 1 {
+		t.Fatalf("unexpected pending %+v %v", pending, err)
+	}
+
+	entries, err = rpool.XReadGroup("events", "g", "c1", 10, 50*time.Millisecond)
+	if err != nil || len(entries) != 1 || entries[0].Values["n"] != "4" {
+		t.Fatalf("unexpected %+v %v", entries, err)
+	}
+	start := time.Now()
+	if entries, err = rpool.XReadGroup("events", "g", "c1", 10, 50*time.Millisecond); err != nil || len(entries) != 0 {
+		t.Fatalf("expected empty read, got %+v %v", entries, err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatal("expected XREADGROUP to block")
+	}
+
+	claimed, err := rpool.XClaim("events", "g", "c2", 0, pending[0].ID)
+	if err != nil || len(claimed) != 1 || claimed[0].Values["n"] != "3" {
+		t.Fatalf("unexpected claim %+v %v", claimed, err)
+	}
+	if pending, _ = rpool.XPending("events", "g", 10); pending[0].Consumer != "c2" || pending[0].Deliveries != 2 {
+		t.Fatalf("unexpected pending %+v", pending)
+	}
+}
+
+func TestStreamWorker(t *testing.T) {
+	s, rpool := newFakePool(t, "stream-worker")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	// 崩溃的消费者读取后未确认的消息
+	if err := rpool.XGroupCreate("jobs", "workers", "0"); err != nil {
+		t.Fatal(err)
+	}
+	rpool.XAdd("jobs", 0, map[string]interface{}{"job": "orphan"})
+	if entries, err := rpool.XReadGroup("jobs", "workers", "crashed", 1, 0); err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected %+v %v", entries, err)
+	}
+
+	var (
+		mu       sync.Mutex
+		handled  = make(map[string]bool)
+		inflight int
+		peak     int
+	)
+	w := rpool.NewStreamWorker("jobs", "workers", "w1", func(entry *StreamEntry) error {
+		if entry.Values["job"] == "poison" {
+			panic("poison job")
+		}
+		mu.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		handled[entry.Values["job"]] = true
+		mu.Unlock()
+		return nil
+	})
+	w.Concurrency = 3
+	w.Block = 50 * time.Millisecond
+	w.ClaimInterval = 30 * time.Millisecond
+	w.MinIdle = 50 * time.Millisecond
+	w.MaxDeliveries = 3
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	for i := 0; i < 10; i++ {
+		rpool.XAdd("jobs", 0, map[string]interface{}{"job": strconv.Itoa(i)})
+	}
+	poisonID, _ := rpool.XAdd("jobs", 0, map[string]interface{}{"job": "poison"})
+
+	waitFor(t, "jobs handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 11
+	})
+	mu.Lock()
+	if !handled["orphan"] || peak > 3 {
+		t.Fatalf("orphan handled %v, peak concurrency %d", handled["orphan"], peak)
+	}
+	mu.Unlock()
+
+	waitFor(t, "dead letter", func() bool {
+		n, _ := rpool.XLen("jobs:dead")
+		return n == 1
+	})
+	if err := rpool.XGroupCreate("jobs:dead", "inspect", "0"); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := rpool.XReadGroup("jobs:dead", "inspect", "me", 1, 0)
+	if err != nil || len(dead) != 1 || dead[0].Values["job"] != "poison" || dead[0].Values["_source_id"] != poisonID ||
+		dead[0].Values["_deliveries"] != "3" {
+		t.Fatalf("unexpected dead letter %+v %v", dead, err)
+	}
+	waitFor(t, "pending drained", func() bool {
+		pending, err := rpool.XPending("jobs", "workers", 10)
+		return err == nil && len(pending) == 0
+	})
+}
+
+// Redis 7之前XCLAIM对已裁剪的消息回复nil，认领后仍需确认
+func TestStreamWorkerClaimTrimmed(t *testing.T) {
+	s, rpool := newFakePool(t, "stream-worker-trimmed")
+	defer s.Close()
+	defer rpool.Destroy()
+	s.setHook(func(c *fakeClient, args []string) (interface{}, bool) {
+		if !strings.EqualFold(args[0], "XCLAIM") {
+			return nil, false
+		}
+		reply := s.handleTx(c, args)
+		if entries, ok := reply.([]interface{}); ok {
+			for i, e := range entries {
+				if e.([]interface{})[1] == nil {
+					entries[i] = nil
+				}
+			}
+		}
+		return reply, true
+	})
+
+	if err := rpool.XGroupCreate("jobs", "workers", "0"); err != nil {
+		t.Fatal(err)
+	}
+	// 两条消息都被崩溃的消费者读取，第一条随后被裁剪
+	for _, job := range []string{"trimmed", "kept"} {
+		rpool.XAdd("jobs", 1, map[string]interface{}{"job": job})
+		if entries, err := rpool.XReadGroup("jobs", "workers", "crashed", 10, 0); err != nil || len(entries) != 1 {
+			t.Fatalf("unexpected %+v %v", entries, err)
+		}
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string]bool)
+	w := rpool.NewStreamWorker("jobs", "workers", "w1", func(entry *StreamEntry) error {
+		mu.Lock()
+		handled[entry.Values["job"]] = true
+		mu.Unlock()
+		return nil
+	})
+	w.Block = 50 * time.Millisecond
+	w.ClaimInterval = 30 * time.Millisecond
+	w.MinIdle = 10 * time.Millisecond
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	waitFor(t, "pending drained", func() bool {
+		pending, err := rpool.XPending("jobs", "workers", 10)
+		return err == nil && len(pending) == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !handled["kept"] || handled["trimmed"] {
+		t.Fatalf("unexpected handled %v", handled)
+	}
+}
@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"keywea.com/cloud/pblib/pb/log"
+)
+
+const (
+	defaultTxMaxRetries   = 3
+	defaultTxRetryBackoff = 10 * time.Millisecond
+)
+
+var ErrTxConflict = errors.New("redis: transaction aborted, watched key changed")
+
+// 乐观事务，WATCH之后在Conn上读取，写命令通过内嵌的Pipeline方法入队，在MULTI/EXEC中执行
+type Tx struct {
+	*Pipeline
+	conn redigo.Conn
+}
+
+// WATCH所在的连接，可直接传给包内helper读取，如 GetInt64(tx.Conn(), key)
+func (tx *Tx) Conn() *redigo.Conn {
+	return &tx.conn
+}
+
+// WATCH keys后调用fn，fn返回nil时以MULTI/EXEC执行入队的命令
+// keys在此期间被修改时按退避重试整个fn，重试用尽返回ErrTxConflict；fn返回error时放弃事务
+//
+//	err := rpool.Watch(func(tx *redis.Tx) error {
+//		n, err := redis.GetInt64(tx.Conn(), "counter")
+//		if err != nil && err != redigo.ErrNil {
+//			return err
+//		}
+//		tx.Set("counter", n*2)
+//		return nil
+//	}, "counter")
+func (rpool *RPool) Watch(fn func(tx *Tx) error, keys ...string) error {
+	for attempt := 0; ; attempt++ {
+		err := rpool.watchOnce(fn, keys)
+		if err != ErrTxConflict || attempt >= defaultTxMaxRetries {
+			return err
+		}
+		backoff := defaultTxRetryBackoff << uint(attempt)
+		backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		plog.Debug("[REDIS] retry transaction", log.String("pool", rpool.name), log.Int("attempt", attempt+1),
+			log.Duration("backoff", backoff))
+		time.Sleep(backoff)
+	}
+}
+
+func (rpool *RPool) watchOnce(fn func(tx *Tx) error, keys []string) error {
+	conn := rpool.GetConn()
+	defer conn.Close()
+
+	if len(keys) > 0 {
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+			args[i] = key
+		}
+		if _, err := conn.Do("WATCH", args...); err != nil {
+			return err
+		}
+	}
+	tx := &Tx{Pipeline: &Pipeline{rpool: rpool}, conn: conn}
+	if err := fn(tx); err != nil {
+		conn.Do("UNWATCH")
+		return err
+	}
+	return tx.exec()
+}
+
+// 入队的命令在Watch的回调返回后执行
+func (tx *Tx) Exec() error {
+	return errors.New("redis: transaction commands are executed when the Watch callback returns")
+}
+
+func (tx *Tx) exec() error {
+	queued := tx.queued
+	tx.queued = nil
+	if len(queued) == 0 {
+		_, err := tx.conn.Do("UNWATCH")
+		return err
+	}
+
+	if err := tx.conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := record(tx.conn, queued); err != nil {
+		return err
+	}
+	// 先读取MULTI和各命令的QUEUED回复
+	reply, err := tx.conn.Do("EXEC")
+	if err == redigo.ErrNil || (err == nil && reply == nil) {
+		return ErrTxConflict
+	}
+	if err != nil {
+		return err
+	}
+	replies, err := redigo.Values(reply, nil)
+	if err != nil {
+		return err
+	}
+	return replay(queued, func() (interface{}, error) {
+		if len(replies) == 0 {
+			return nil, errors.New("redis: EXEC returned fewer replies than queued commands")
+		}
+		r := replies[0]
+		replies = replies[1:]
+		if e, ok := r.(redigo.Error); ok {
+			return nil, e
+		}
+		return r, nil
+	})
+}
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+func TestWatch(t *testing.T) {
+	s, rpool := newFakePool(t, "watch")
+	defer s.Close()
+	defer rpool.Destroy()
+
+	rpool.Set("counter", 10)
+	attempts := 0
+	var incr *Int64Result
+	err := rpool.Watch(func(tx *Tx) error {
+		attempts++
+		n, err := GetInt64(tx.Conn(), "counter")
+		if err != nil {
+			return err
+		}
+		// 第一次执行期间被其他客户端修改
+		if attempts == 1 {
+			rpool.Set("counter", 20)
+		}
+		tx.Set("counter", n*2)
+		incr = tx.Incr("counter")
+		return nil
+	}, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("conflict must retry once, got %d attempts", attempts)
+	}
+	if incr.Val() != 41 {
+		t.Fatalf("transaction must see the latest value, got %d", incr.Val())
+	}
+
+	// 持续冲突时重试用尽
+	attempts = 0
+	err = rpool.Watch(func(tx *Tx) error {
+		attempts++
+		rpool.Incr("counter")
+		tx.Incr("counter")
+		return nil
+	}, "counter")
+	if err != ErrTxConflict || attempts != defaultTxMaxRetries+1 {
+		t.Fatalf("want ErrTxConflict after %d attempts, got %v after %d", defaultTxMaxRetries+1, err, attempts)
+	}
+
+	// fn失败时不执行
+	before, _ := rpool.GetInt64("counter")
+	errAbort := errors.New("abort")
+	err = rpool.Watch(func(tx *Tx) error {
+		tx.Incr("counter")
+		return errAbort
+	}, "counter")
+	if err != errAbort {
+		t.Fatalf("fn error must be returned, got %v", err)
+	}
+	if after, _ := rpool.GetInt64("counter"); after != before {
+		t.Fatal("aborted transaction must not run queued commands")
+	}
+
+	// 事务内的命令错误只影响该命令
+	var bad *Result
+	var good *StringResult
+	err = rpool.Watch(func(tx *Tx) error {
+		bad = tx.Do("NOSUCHCMD")
+		tx.Set("k", "v")
+		good = tx.GetString("k")
+		return nil
+	})
+	if _, ok := bad.Err().(redigo.Error); !ok || err == nil {
+		t.Fatalf("command error must be reported, got %v %v", bad.Err(), err)
+	}
+	if good.Val() != "v" {
+		t.Fatalf("other commands must succeed, got %q", good.Val())
+	}
+}